@@ -8,9 +8,12 @@
 package base
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"time"
 )
 
 const (
@@ -18,6 +21,331 @@ const (
 	VlogPrefix = "V: "
 )
 
+// Protocol is a transport protocol that a port forwarding entry applies to.
+type Protocol int
+
+const (
+	// TCP is the Transmission Control Protocol.
+	TCP Protocol = iota
+
+	// UDP is the User Datagram Protocol.
+	UDP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case TCP:
+		return "TCP"
+	case UDP:
+		return "UDP"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (p Protocol) MarshalText() ([]byte, error) {
+	switch p {
+	case TCP, UDP:
+		return []byte(p.String()), nil
+	default:
+		return nil, fmt.Errorf("invalid protocol: %d", int(p))
+	}
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *Protocol) UnmarshalText(text []byte) error {
+	var err error
+	*p, err = ParseProtocol(string(text))
+	return err
+}
+
+// ParseProtocol parses a case insensitive protocol name ("TCP" or "UDP").
+func ParseProtocol(s string) (Protocol, error) {
+	switch strings.ToUpper(s) {
+	case "TCP":
+		return TCP, nil
+	case "UDP":
+		return UDP, nil
+	default:
+		return 0, fmt.Errorf("invalid protocol '%s'", s)
+	}
+}
+
+// PortMapping is a port forwarding entry.
+type PortMapping struct {
+	// Description is the human readable description of the entry.
+	Description string `json:"description"`
+
+	// InternalIP is the address that traffic is forwarded to.
+	InternalIP net.IP `json:"internal_ip"`
+
+	// InternalPort is the port that traffic is forwarded to.
+	InternalPort int `json:"internal_port"`
+
+	// RemoteHost is the remote host that the entry applies to, nil if the
+	// entry applies to all remote hosts.
+	RemoteHost net.IP `json:"remote_host,omitempty"`
+
+	// ExternalPort is the port on the router's external address.
+	ExternalPort int `json:"external_port"`
+
+	// Protocol is the transport protocol that is forwarded.
+	Protocol Protocol `json:"protocol"`
+
+	// Enabled is set if the entry is active.
+	Enabled bool `json:"enabled"`
+
+	// LeaseDuration is the remaining lease in seconds, 0 if the lease is
+	// indefinite.
+	LeaseDuration int `json:"lease_duration"`
+}
+
+// Pinhole is an inbound IPv6 firewall pinhole.
+type Pinhole struct {
+	// UniqueID is the router assigned identifier of the pinhole, which is
+	// needed to renew or close it.  It is 0 if no pinhole was needed (Eg:
+	// the firewall is disabled).
+	UniqueID int `json:"unique_id"`
+
+	// InternalIP and InternalPort are where inbound traffic is allowed to.
+	InternalIP   net.IP `json:"internal_ip,omitempty"`
+	InternalPort int    `json:"internal_port"`
+
+	// Protocol is the transport protocol that is allowed.
+	Protocol Protocol `json:"protocol"`
+
+	// LeaseDuration is the lease in seconds, 0 if the lease is indefinite.
+	LeaseDuration int `json:"lease_duration"`
+}
+
+// Router describes the router that a Client is talking to.  Only the fields
+// that are relevant to the backend are set.
+type Router struct {
+	// Backend is the name of the backend (Eg: "UPnP").
+	Backend string `json:"backend"`
+
+	// Address is the router's address (the host of the control URL for
+	// UPnP).
+	Address string `json:"address"`
+
+	// LocalAddr is the address of the host, as seen by the router.
+	LocalAddr net.IP `json:"local_addr,omitempty"`
+
+	// ControlURL and ServiceType are the UPnP WAN connection service that is
+	// in use, and UDN, Manufacturer, and ModelName identify the
+	// InternetGatewayDevice.
+	ControlURL   string `json:"control_url,omitempty"`
+	ServiceType  string `json:"service_type,omitempty"`
+	UDN          string `json:"udn,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	ModelName    string `json:"model_name,omitempty"`
+}
+
+// Options are the tunables for a Client.  The zero value of each field selects
+// the backend's default, and a nil *Options is equivalent to the zero value.
+// Backends ignore the fields that do not apply to them.
+type Options struct {
+	// Verbose enables verbose debug logging to stderr.  It is ignored if
+	// Logger is set.
+	Verbose bool
+
+	// Logger, if set, receives all of the log messages, regardless of level,
+	// instead of them being written to stderr.
+	Logger Logger
+
+	// Description is the port forwarding entry description that is used
+	// when AddPortMapping is called with an empty description.
+	Description string
+
+	// UserAgent is the User-Agent header sent in SSDP and HTTP requests
+	// (UPnP).
+	UserAgent string
+
+	// OutgoingPort is the local UDP port that SSDP M-SEARCH requests are
+	// sent from (UPnP).  The default is to use a random port.
+	OutgoingPort int
+
+	// SSDPMX is the number of seconds that devices may wait before
+	// answering a M-SEARCH request, and the amount of time spent waiting
+	// for responses after each request (UPnP).
+	SSDPMX int
+
+	// Retries is the number of times a SSDP M-SEARCH (UPnP) or a NAT-PMP/PCP
+	// request is sent before giving up.
+	Retries int
+
+	// RequestTimeout bounds each HTTP request, including the SOAP control
+	// requests (UPnP).
+	RequestTimeout time.Duration
+
+	// RetryTimeout is how long the first NAT-PMP/PCP request waits for a
+	// response, with each subsequent retransmission waiting twice as long
+	// as the previous one.
+	RetryTimeout time.Duration
+
+	// Interface is the name of the network interface that is used for
+	// discovery and for talking to the router.  The default is to use
+	// whatever the routing table picks.
+	Interface string
+
+	// SourceAddress is the local IPv4 address that is used for talking to
+	// the router.  It defaults to the first IPv4 address of Interface, and
+	// if Interface is not set, the interface that has the address is used.
+	SourceAddress net.IP
+
+	// Cache, if set, is used to skip the expensive parts of discovery when
+	// the results of a previous run are still valid.
+	Cache DiscoveryCache
+
+	// AlternatePort allows AddPortMapping to map a different external port
+	// than the one requested when it is taken, instead of failing.  The
+	// returned PortMapping has the external port that was actually mapped.
+	AlternatePort bool
+
+	// AlternatePortRange restricts the external ports that AlternatePort
+	// accepts.
+	AlternatePortRange PortRange
+}
+
+// PortRange is an inclusive range of ports.  The zero value is all of the
+// unprivileged ports.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+func (r PortRange) bounds() (int, int) {
+	if r.Min == 0 && r.Max == 0 {
+		return 1024, 65535
+	}
+	return r.Min, r.Max
+}
+
+// Contains returns true iff port is in the range.
+func (r PortRange) Contains(port int) bool {
+	min, max := r.bounds()
+	return port >= min && port <= max
+}
+
+// Next returns the port after port in the range, wrapping around to the
+// start of the range.
+func (r PortRange) Next(port int) int {
+	min, max := r.bounds()
+	if port < min || port >= max {
+		return min
+	}
+	return port + 1
+}
+
+func (r PortRange) String() string {
+	min, max := r.bounds()
+	return fmt.Sprintf("%d-%d", min, max)
+}
+
+// CachedService is a cached UPnP service.
+type CachedService struct {
+	ServiceType string `json:"service_type"`
+	ControlURL  string `json:"control_url"`
+	SCPDURL     string `json:"scpd_url,omitempty"`
+	EventSubURL string `json:"event_sub_url,omitempty"`
+}
+
+// CacheEntry is a cached discovery result.  Only the fields that are relevant
+// to the backend are set.  NAT-PMP and PCP always talk to the default gateway,
+// which the cache is already keyed by, so their entries only record that the
+// backend worked.
+type CacheEntry struct {
+	// Backend is the name of the backend that discovered the router.
+	Backend string `json:"backend"`
+
+	// Service and FirewallService are the UPnP WAN connection and
+	// WANIPv6FirewallControl services, UDN, Manufacturer, and ModelName
+	// identify the InternetGatewayDevice, and LocalAddr is the address that
+	// was used to talk to it.
+	Service         *CachedService `json:"service,omitempty"`
+	FirewallService *CachedService `json:"firewall_service,omitempty"`
+	UDN             string         `json:"udn,omitempty"`
+	Manufacturer    string         `json:"manufacturer,omitempty"`
+	ModelName       string         `json:"model_name,omitempty"`
+	LocalAddr       net.IP         `json:"local_addr,omitempty"`
+
+	// LeasePolicy is the kind of lease that the UPnP router was found to
+	// require ("indefinite" or "finite"), if any.
+	LeasePolicy string `json:"lease_policy,omitempty"`
+}
+
+// DiscoveryCache persists discovery results across runs, for the network
+// that the host is currently attached to.  Implementations must be safe for
+// concurrent use, as the backends are probed concurrently.
+type DiscoveryCache interface {
+	// Lookup returns the cached entry for backend, or nil if there is none.
+	Lookup(backend string) *CacheEntry
+
+	// Store caches e, replacing any existing entry for the same backend.
+	Store(e *CacheEntry) error
+
+	// Remove removes the cached entry for backend, if any.
+	Remove(backend string) error
+}
+
+// LocalInterface returns the network interface and local IPv4 address that
+// were selected via Interface and/or SourceAddress, or nil if neither is set.
+func (o *Options) LocalInterface() (*net.Interface, net.IP, error) {
+	if o == nil || (o.Interface == "" && o.SourceAddress == nil) {
+		return nil, nil, nil
+	}
+
+	var srcAddr net.IP
+	if o.SourceAddress != nil {
+		if srcAddr = o.SourceAddress.To4(); srcAddr == nil {
+			return nil, nil, fmt.Errorf("source address is not IPv4: %s", o.SourceAddress)
+		}
+	}
+	var ifaces []net.Interface
+	if o.Interface != "" {
+		iface, err := net.InterfaceByName(o.Interface)
+		if err != nil {
+			return nil, nil, err
+		}
+		ifaces = []net.Interface{*iface}
+	} else {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip := ipNet.IP.To4(); ip != nil && (srcAddr == nil || ip.Equal(srcAddr)) {
+				return &ifaces[i], ip, nil
+			}
+		}
+	}
+	switch {
+	case srcAddr == nil:
+		return nil, nil, fmt.Errorf("interface %s has no IPv4 address", o.Interface)
+	case o.Interface != "":
+		return nil, nil, fmt.Errorf("interface %s does not have the address %s", o.Interface, srcAddr)
+	default:
+		return nil, nil, fmt.Errorf("no interface has the address %s", srcAddr)
+	}
+}
+
+// AcceptsAlternatePort returns true iff AddPortMapping may map port in place
+// of the external port that was requested.
+func (o *Options) AcceptsAlternatePort(port int) bool {
+	return o.AlternatePort && o.AlternatePortRange.Contains(port)
+}
+
 // ClientFactory is a Client factory.
 type ClientFactory interface {
 	// Name returns the name of the port forwarding configuration mechanism.
@@ -25,39 +353,136 @@ type ClientFactory interface {
 
 	// Initializes and probes for a suitable configuration mechanism and
 	// returns a ready to use Client.
-	New(verbose bool) (Client, error)
+	New(opts *Options) (Client, error)
+
+	// NewContext behaves like New, but aborts the discovery process when ctx
+	// is canceled or expires.
+	NewContext(ctx context.Context, opts *Options) (Client, error)
 }
 
 // Client is a NAT port forwarding mechanism configuration client.
+//
+// Each request has a variant that takes a context.Context, which aborts any
+// in-flight network exchange with the router when the context is canceled or
+// expires, and returns the context's error.  The variants without a context
+// behave as if they were passed context.Background().
 type Client interface {
-	// AddPortMapping adds a new TCP/IP port forwarding entry between
-	// clientIP:internalPort and 0.0.0.0:externalPort.  A duration of "0" will
-	// have the backend pick an "appropriate" and "safe" duration.
-	AddPortMapping(description string, internalPort, externalPort, duration int) error
+	// AddPortMapping adds a new port forwarding entry for the given protocol
+	// between clientIP:internalPort and 0.0.0.0:externalPort.  A duration of
+	// "0" will have the backend pick an "appropriate" and "safe" duration.
+	// The entry that was actually created is returned, with LeaseDuration
+	// set to the lease that was granted by the router, and ExternalPort set
+	// to the port that was mapped (See Options.AlternatePort).
+	AddPortMapping(description string, protocol Protocol, internalPort, externalPort, duration int) (*PortMapping, error)
+	AddPortMappingContext(ctx context.Context, description string, protocol Protocol, internalPort, externalPort, duration int) (*PortMapping, error)
+
+	// DeletePortMapping removes an existing port forwarding entry for the
+	// given protocol between clientIP:internalPort and 0.0.0.0:externalPort.
+	DeletePortMapping(protocol Protocol, internalPort, externalPort int) error
+	DeletePortMappingContext(ctx context.Context, protocol Protocol, internalPort, externalPort int) error
+
+	// OpenIPv6Pinhole opens an inbound IPv6 firewall pinhole for the given
+	// protocol to the client's global IPv6 address and internalPort.  A
+	// duration of "0" will have the backend pick an "appropriate" duration.
+	// The pinhole that was opened is returned, with the UniqueID that is
+	// needed to renew or close it.
+	OpenIPv6Pinhole(protocol Protocol, internalPort, duration int) (*Pinhole, error)
+	OpenIPv6PinholeContext(ctx context.Context, protocol Protocol, internalPort, duration int) (*Pinhole, error)
+
+	// RenewIPv6Pinhole extends the lease of the pinhole with the given
+	// UniqueID, and returns the lease that was granted.  A duration of "0"
+	// behaves as with OpenIPv6Pinhole.
+	RenewIPv6Pinhole(uniqueID, duration int) (int, error)
+	RenewIPv6PinholeContext(ctx context.Context, uniqueID, duration int) (int, error)
 
-	// DeletePortMapping removes an existing TCP/IP port forwarding entry
-	// between clientIP:internalPort and 0.0.0.0:externalPort.
-	DeletePortMapping(internalPort, externalPort int) error
+	// CloseIPv6Pinhole closes the pinhole with the given UniqueID.
+	CloseIPv6Pinhole(uniqueID int) error
+	CloseIPv6PinholeContext(ctx context.Context, uniqueID int) error
 
 	// GetExternalIPAddress queries the router for the external public IP
 	// address.
 	GetExternalIPAddress() (net.IP, error)
+	GetExternalIPAddressContext(ctx context.Context) (net.IP, error)
 
 	// GetListOfPortMappings queries the router for the list of port forwarding
-	// entries, and returns all that were found as a string slice.  Each string
-	// in the slice is of the format "'description' internalIP:internalPort <->
-	// externalIP:externalPort protocol (leaseDuration sec)".
-	GetListOfPortMappings() ([]string, error)
+	// entries, and returns all that were found.
+	GetListOfPortMappings() ([]PortMapping, error)
+	GetListOfPortMappingsContext(ctx context.Context) ([]PortMapping, error)
 
-	// Vlogf logs verbose debugging messages to stderror.  It is up to the
-	// implementation to squelch output when constructed with verbose = false.
+	// GetPortMapping queries the router for the port forwarding entry for
+	// the given protocol and external port, with LeaseDuration set to the
+	// remaining lease.  An error in CategoryNotFound is returned if there is
+	// no such entry.
+	GetPortMapping(protocol Protocol, externalPort int) (*PortMapping, error)
+	GetPortMappingContext(ctx context.Context, protocol Protocol, externalPort int) (*PortMapping, error)
+
+	// Router returns a description of the router.
+	Router() *Router
+
+	// Vlogf logs verbose debugging messages, at LevelDebug, to the
+	// Options.Logger, or to stderr if Options.Verbose is set.
 	Vlogf(f string, a ...interface{})
 
 	// Close cleans up all the state associated with the particular Client.
 	Close()
 }
 
-// Vlogf logs verbose debugging messages to stderr.
+// Vlogf logs verbose debugging messages to stderr unconditionally.  Prefer
+// Logf, which honors Options.
 func Vlogf(f string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, VlogPrefix+f, a...)
 }
+
+// Deadliner is a connection with a settable deadline (Eg: net.Conn).
+type Deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// WatchContext arranges for blocking I/O on conn to be interrupted when ctx is
+// canceled or expires, by setting the deadline to a time in the past.  The
+// returned function stops watching ctx, and must be called once the I/O is
+// complete, before the caller resets the deadline.
+func WatchContext(ctx context.Context, conn Deadliner) (stop func()) {
+	if ctx.Done() == nil {
+		// context.Background() and friends, nothing to watch.
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// ContextDeadline returns the earlier of t and the deadline of ctx.
+func ContextDeadline(ctx context.Context, t time.Time) time.Time {
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		return d
+	}
+	return t
+}
+
+// Sleep pauses for d, returning early with the context's error if ctx is
+// canceled or expires.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package base
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Category is a protocol independent classification of the errors reported by
+// routers.  Categories are errors themselves, so that they can be used as
+// errors.Is targets:
+//
+//	if errors.Is(err, base.CategoryConflict) {
+//		// Try another external port.
+//	}
+type Category int
+
+const (
+	// CategoryUnknown is for errors that do not fit any other category.
+	CategoryUnknown Category = iota
+
+	// CategoryConflict is for requests that conflict with an existing
+	// mapping (Eg: the external port is taken).
+	CategoryConflict
+
+	// CategoryUnauthorized is for requests that were refused by policy.
+	CategoryUnauthorized
+
+	// CategoryUnsupported is for requests (or parameters) that the router
+	// does not support.
+	CategoryUnsupported
+
+	// CategoryResource is for requests that failed because the router ran
+	// out of something (Eg: mapping table entries).
+	CategoryResource
+
+	// CategoryTransient is for failures that may succeed if retried later.
+	CategoryTransient
+
+	// CategoryNotFound is for requests that refer to an entry that does not
+	// exist.
+	CategoryNotFound
+)
+
+func (c Category) String() string {
+	switch c {
+	case CategoryUnknown:
+		return "unknown"
+	case CategoryConflict:
+		return "conflict"
+	case CategoryUnauthorized:
+		return "unauthorized"
+	case CategoryUnsupported:
+		return "unsupported"
+	case CategoryResource:
+		return "resource"
+	case CategoryTransient:
+		return "transient"
+	case CategoryNotFound:
+		return "not found"
+	default:
+		return fmt.Sprintf("[Unknown Category: %d]", int(c))
+	}
+}
+
+func (c Category) Error() string {
+	return c.String()
+}
+
+// Error is an error reported by a router, along with the protocol specific
+// code.
+//
+// errors.Is matches an Error against its Category, and against another Error
+// with the same Protocol and (non-zero) Code, so the sentinels exported by the backends
+// (Eg: upnp.ErrConflictInMappingEntry) can be used as targets.  errors.As
+// can be used to retrieve the Code.
+type Error struct {
+	// Protocol is the name of the backend (Eg: "UPnP").
+	Protocol string
+
+	// Code is the protocol's error code (Eg: the UPnP error code, or the
+	// NAT-PMP/PCP result code), 0 if there is none.
+	Code int
+
+	// Name is the protocol's name for the code (Eg:
+	// "ConflictInMappingEntry").
+	Name string
+
+	// Category is the normalized category of the error.
+	Category Category
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s error: %d - %s", e.Protocol, e.Code, e.Name)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true iff target is e's Category, or an Error with the same
+// Protocol and Code.  Errors without a Code only match themselves.
+func (e *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case Category:
+		return t == e.Category
+	case *Error:
+		if e.Code == 0 || t.Code == 0 {
+			return t == e
+		}
+		return t.Protocol == e.Protocol && t.Code == e.Code
+	}
+	return false
+}
+
+// CategoryOf returns the Category of err, CategoryUnknown if err is not
+// categorized.
+func CategoryOf(err error) Category {
+	var c Category
+	if errors.As(err, &c) {
+		return c
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Category
+	}
+	return CategoryUnknown
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	conflict := &Error{Protocol: "UPnP", Code: 718, Name: "ConflictInMappingEntry", Category: CategoryConflict}
+	wrapped := fmt.Errorf("add failed: %w", &Error{Protocol: "UPnP", Code: 718, Category: CategoryConflict, Err: errors.New("fault")})
+	uncoded := &Error{Protocol: "UPnP", Category: CategoryNotFound, Err: errors.New("no such mapping")}
+	otherUncoded := &Error{Protocol: "UPnP", Category: CategoryConflict, Err: errors.New("port reassigned")}
+
+	for _, tc := range []struct {
+		name   string
+		err    error
+		target error
+		want   bool
+	}{
+		{"same code", wrapped, conflict, true},
+		{"category", wrapped, CategoryConflict, true},
+		{"other category", wrapped, CategoryNotFound, false},
+		{"other protocol", wrapped, &Error{Protocol: "NAT-PMP", Code: 718}, false},
+		{"other code", wrapped, &Error{Protocol: "UPnP", Code: 714}, false},
+		{"uncoded vs uncoded", uncoded, otherUncoded, false},
+		{"uncoded vs coded", uncoded, conflict, false},
+		{"coded vs uncoded", conflict, otherUncoded, false},
+		{"uncoded vs itself", uncoded, uncoded, true},
+		{"uncoded category", uncoded, CategoryNotFound, true},
+	} {
+		if got := errors.Is(tc.err, tc.target); got != tc.want {
+			t.Errorf("%s: errors.Is() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces the file at path with one containing b, readable
+// only by the user.  The data is written to a temporary file in the same
+// directory and renamed over path, so that a crash does not leave a truncated
+// file behind, and so that concurrent writers do not clobber each other's
+// temporary file.
+func WriteFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err = f.Write(b); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
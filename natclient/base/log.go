@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package base
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	// LevelDebug is for the play by play of what the backend is doing.
+	LevelDebug Level = iota
+
+	// LevelInfo is for notable events, such as the router that was found or
+	// the lease that was granted.
+	LevelInfo
+
+	// LevelWarn is for failures that were recovered from.
+	LevelWarn
+
+	// LevelError is for failures that render a backend unusable.
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("[Unknown Level: %d]", int(l))
+	}
+}
+
+// OpDiscover is the Operation of messages logged while discovering and
+// initializing a backend.  The rest of the messages use the name of the
+// Client method being invoked (Eg: "AddPortMapping").
+const OpDiscover = "discover"
+
+// Record is a log message.
+type Record struct {
+	Level Level
+
+	// Backend is the name of the backend that the message is from (Eg:
+	// "UPnP"), or "" if it is from natclient itself.
+	Backend string
+
+	// Operation is what was being done when the message was logged (Eg:
+	// OpDiscover, "AddPortMapping"), or "" if it is unknown.
+	Operation string
+
+	// Message is the message, without a trailing newline.
+	Message string
+}
+
+// Logger is a destination for log messages.  Implementations must be safe for
+// concurrent use, as the backends are probed concurrently.
+type Logger interface {
+	Log(r *Record)
+}
+
+// StderrLogger is the default Logger, which writes messages to stderr in the
+// same "V: UPnP: ..." format as Vlogf.  Messages below LevelError are only
+// written if Verbose is set.
+type StderrLogger struct {
+	Verbose bool
+}
+
+var stderrLock sync.Mutex
+
+// Log writes r to stderr.
+func (l *StderrLogger) Log(r *Record) {
+	if r.Level < LevelError && !l.Verbose {
+		return
+	}
+	msg := VlogPrefix
+	if r.Backend != "" {
+		msg += r.Backend + ": "
+	}
+	msg += r.Message + "\n"
+
+	// Keep concurrently probed backends from interleaving their output.
+	stderrLock.Lock()
+	defer stderrLock.Unlock()
+	fmt.Fprint(os.Stderr, msg)
+}
+
+// Logf formats a message and sends it to the Logger in opts (which may be
+// nil), or a StderrLogger honoring opts.Verbose if there is none.
+func Logf(opts *Options, level Level, backend, op, f string, a ...interface{}) {
+	var l Logger
+	if opts != nil && opts.Logger != nil {
+		l = opts.Logger
+	} else {
+		if level < LevelError && (opts == nil || !opts.Verbose) {
+			// Skip the formatting, it'd get thrown away anyway.
+			return
+		}
+		l = &StderrLogger{Verbose: opts != nil && opts.Verbose}
+	}
+	l.Log(&Record{
+		Level:     level,
+		Backend:   backend,
+		Operation: op,
+		Message:   strings.TrimSuffix(fmt.Sprintf(f, a...), "\n"),
+	})
+}
+
+var _ Logger = (*StderrLogger)(nil)
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+// Package cache implements an on-disk cache of discovery results, so that
+// subsequent runs on the same network can skip SSDP and the device
+// description download.  Entries are keyed by the default gateway and the
+// interface, so that results from other networks are ignored.
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/natpmp"
+)
+
+const (
+	cacheDir  = "tor-fw-helper"
+	cacheFile = "discovery.json"
+)
+
+type entry struct {
+	base.CacheEntry
+
+	// Gateway and Interface identify the network that the entry is valid
+	// for.
+	Gateway   string `json:"gateway"`
+	Interface string `json:"interface"`
+
+	// Updated is when the entry was stored.
+	Updated time.Time `json:"updated"`
+}
+
+// Cache is an on-disk discovery cache, bound to the network that the host was
+// attached to when it was opened.  It is safe for concurrent use.  Multiple
+// processes sharing a cache will not corrupt it, but the last one to write it
+// wins, which at worst costs the others a rediscovery on the next run.
+type Cache struct {
+	lock sync.Mutex
+
+	path    string
+	gateway string
+	iface   string
+	entries []entry
+}
+
+// DefaultPath returns the default location of the cache in the user's cache
+// directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, cacheDir, cacheFile), nil
+}
+
+// Open opens the cache at path, for the network selected by opts (which may be
+// nil).  A cache that does not exist yet is treated as empty, and will be
+// created on the first modification.
+func Open(path string, opts *base.Options) (*Cache, error) {
+	c := &Cache{path: path}
+
+	// Not being able to determine the gateway is not fatal, since UPnP works
+	// fine without knowing it.
+	if gwAddr, err := natpmp.LookupGateway(opts); err == nil {
+		c.gateway = gwAddr.String()
+	}
+	iface, _, err := opts.LocalInterface()
+	if err != nil {
+		return nil, err
+	}
+	if iface != nil {
+		c.iface = iface.Name
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &c.entries); err != nil {
+		// It's a cache, so start over instead of failing.
+		c.entries = nil
+	}
+	return c, nil
+}
+
+// Path returns the location of the cache on disk.
+func (c *Cache) Path() string {
+	return c.path
+}
+
+func (c *Cache) find(backend string) int {
+	for i := range c.entries {
+		e := &c.entries[i]
+		if e.Backend == backend && e.Gateway == c.gateway && e.Interface == c.iface {
+			return i
+		}
+	}
+	return -1
+}
+
+// Lookup returns the cached entry for backend on the current network, or nil
+// if there is none.
+func (c *Cache) Lookup(backend string) *base.CacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if i := c.find(backend); i >= 0 {
+		e := c.entries[i].CacheEntry
+		return &e
+	}
+	return nil
+}
+
+// Store caches e for the current network, replacing any existing entry for
+// the same backend.
+func (c *Cache) Store(e *base.CacheEntry) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ent := entry{CacheEntry: *e, Gateway: c.gateway, Interface: c.iface, Updated: time.Now()}
+	if i := c.find(e.Backend); i >= 0 {
+		c.entries[i] = ent
+	} else {
+		c.entries = append(c.entries, ent)
+	}
+	return c.save()
+}
+
+// Remove removes the cached entry for backend on the current network, if any.
+func (c *Cache) Remove(backend string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	i := c.find(backend)
+	if i < 0 {
+		return nil
+	}
+	c.entries = append(c.entries[:i], c.entries[i+1:]...)
+	return c.save()
+}
+
+func (c *Cache) save() error {
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	return base.WriteFileAtomic(c.path, b)
+}
+
+var _ base.DiscoveryCache = (*Cache)(nil)
@@ -0,0 +1,290 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+// Package journal implements an on-disk record of the port mappings created
+// by the helper, so that mappings can be listed on protocols that lack a list
+// operation, and so that only mappings that the helper created get removed.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	journalDir  = "tor-fw-helper"
+	journalFile = "journal.json"
+
+	// lockTimeout is how long to wait for another process to release the
+	// lock file.
+	lockTimeout       = 5 * time.Second
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+// Entry is a journaled port mapping.
+type Entry struct {
+	// Backend is the name of the backend that created the mapping.
+	Backend string `json:"backend"`
+
+	// Gateway identifies the router that the mapping was created on.
+	Gateway string `json:"gateway"`
+
+	Protocol     base.Protocol `json:"protocol"`
+	Description  string        `json:"description"`
+	InternalIP   net.IP        `json:"internal_ip"`
+	InternalPort int           `json:"internal_port"`
+	ExternalPort int           `json:"external_port"`
+
+	// Lifetime is the lease in seconds that was granted by the router, 0 if
+	// the lease is indefinite.
+	Lifetime int `json:"lifetime"`
+
+	// Created is when the mapping was created (or last refreshed).
+	Created time.Time `json:"created"`
+
+	// Expired is set once the lease is known to have run out.
+	Expired bool `json:"expired"`
+
+	// Nonce is the mapping nonce, for backends that need it to refresh or
+	// remove the mapping (PCP).
+	Nonce []byte `json:"nonce,omitempty"`
+}
+
+// Remaining returns the remaining lease in seconds at time now.  Entries with
+// indefinite leases always return 0.
+func (e *Entry) Remaining(now time.Time) int {
+	if e.Lifetime == 0 || e.Expired {
+		return 0
+	}
+	left := e.Created.Add(time.Duration(e.Lifetime) * time.Second).Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return int(left / time.Second)
+}
+
+// IsExpired returns true iff the entry's lease has run out at time now.
+func (e *Entry) IsExpired(now time.Time) bool {
+	if e.Expired {
+		return true
+	}
+	if e.Lifetime == 0 {
+		return false
+	}
+	return !now.Before(e.Created.Add(time.Duration(e.Lifetime) * time.Second))
+}
+
+// PortMapping returns the entry as a base.PortMapping as of time now.
+// Expired entries are returned as disabled.
+func (e *Entry) PortMapping(now time.Time) base.PortMapping {
+	return base.PortMapping{
+		Description:   e.Description,
+		InternalIP:    e.InternalIP,
+		InternalPort:  e.InternalPort,
+		ExternalPort:  e.ExternalPort,
+		Protocol:      e.Protocol,
+		Enabled:       !e.IsExpired(now),
+		LeaseDuration: e.Remaining(now),
+	}
+}
+
+func (e *Entry) matches(backend, gateway string) bool {
+	return e.Backend == backend && e.Gateway == gateway
+}
+
+func (e *Entry) sameMapping(o *Entry) bool {
+	return e.matches(o.Backend, o.Gateway) && e.Protocol == o.Protocol &&
+		e.InternalPort == o.InternalPort && e.ExternalPort == o.ExternalPort
+}
+
+// Journal is an on-disk port mapping journal.  It is safe for concurrent use,
+// including by multiple processes (Eg: a daemon and a one-shot
+// "--unforward-journaled"), as modifications are made to the latest journal
+// on disk while holding a lock file.
+type Journal struct {
+	lock sync.Mutex
+
+	path    string
+	entries []Entry
+}
+
+// DefaultPath returns the default location of the journal in the user's
+// cache directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, journalDir, journalFile), nil
+}
+
+// Open opens the journal at path.  A journal that does not exist yet is
+// treated as empty, and will be created on the first modification.
+func Open(path string) (*Journal, error) {
+	j := &Journal{path: path}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Path returns the location of the journal on disk.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Entries returns the entries created by backend on gateway.
+func (j *Journal) Entries(backend, gateway string) []Entry {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	var ents []Entry
+	for _, e := range j.entries {
+		if e.matches(backend, gateway) {
+			ents = append(ents, e)
+		}
+	}
+	return ents
+}
+
+// Record adds an entry to the journal, replacing any existing entry for the
+// same mapping.
+func (j *Journal) Record(e Entry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.update(func() bool {
+		for i := range j.entries {
+			if j.entries[i].sameMapping(&e) {
+				j.entries[i] = e
+				return true
+			}
+		}
+		j.entries = append(j.entries, e)
+		return true
+	})
+}
+
+// Remove removes the entry for the given mapping from the journal, if any.
+func (j *Journal) Remove(backend, gateway string, protocol base.Protocol, internalPort, externalPort int) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	k := &Entry{Backend: backend, Gateway: gateway, Protocol: protocol, InternalPort: internalPort, ExternalPort: externalPort}
+	return j.update(func() bool {
+		for i := range j.entries {
+			if j.entries[i].sameMapping(k) {
+				j.entries = append(j.entries[:i], j.entries[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Expire marks all entries whose lease has run out at time now as expired.
+func (j *Journal) Expire(now time.Time) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.update(func() bool {
+		dirty := false
+		for i := range j.entries {
+			e := &j.entries[i]
+			if !e.Expired && e.IsExpired(now) {
+				e.Expired = true
+				dirty = true
+			}
+		}
+		return dirty
+	})
+}
+
+// update reloads the journal and applies fn to it while holding the lock file,
+// so that modifications made by other processes are not lost, and saves the
+// result if fn returns true.
+func (j *Journal) update(fn func() bool) error {
+	unlock, err := j.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = j.load(); err != nil {
+		return err
+	}
+	if !fn() {
+		return nil
+	}
+	return j.save()
+}
+
+// lockFile locks the lock file, waiting for other processes to release it,
+// and returns a function that releases it.  The lock is held by the OS and
+// goes away with the process, so a crash can not leave a stale lock behind.
+// The lock file itself is never removed, as removing it would allow another
+// process to lock a new file while the old one is still locked.
+func (j *Journal) lockFile() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return nil, err
+	}
+	lockPath := j.path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("timed out waiting for journal lock: %s", lockPath)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+func (j *Journal) load() error {
+	b, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			j.entries = nil
+			return nil
+		}
+		return err
+	}
+	var entries []Entry
+	if err = json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	j.entries = entries
+	return nil
+}
+
+func (j *Journal) save() error {
+	b, err := json.MarshalIndent(j.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return base.WriteFileAtomic(j.path, b)
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package journal
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	testBackend = "UPnP"
+	testGateway = "192.168.1.1"
+)
+
+// newTestJournal opens a journal in a new temporary directory, which the
+// caller must remove.
+func newTestJournal(t *testing.T) (string, *Journal) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() failed: %s", err)
+	}
+	j, err := Open(filepath.Join(dir, journalDir, journalFile))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Open() failed: %s", err)
+	}
+	return dir, j
+}
+
+func testEntry(port int) Entry {
+	return Entry{
+		Backend:      testBackend,
+		Gateway:      testGateway,
+		Protocol:     base.TCP,
+		Description:  "tor-fw-helper test",
+		InternalIP:   net.IPv4(192, 168, 1, 2),
+		InternalPort: port,
+		ExternalPort: port,
+		Lifetime:     3600,
+		Created:      time.Now(),
+	}
+}
+
+// reopen returns the entries of the journal as stored on disk.
+func reopen(t *testing.T, j *Journal) []Entry {
+	t.Helper()
+	j2, err := Open(j.Path())
+	if err != nil {
+		t.Fatalf("Open() failed: %s", err)
+	}
+	return j2.Entries(testBackend, testGateway)
+}
+
+func TestRecord(t *testing.T) {
+	dir, j := newTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	for _, port := range []int{9001, 9030} {
+		if err := j.Record(testEntry(port)); err != nil {
+			t.Fatalf("Record(%d) failed: %s", port, err)
+		}
+	}
+
+	// Recording the same mapping again replaces it.
+	e := testEntry(9001)
+	e.Lifetime = 7200
+	if err := j.Record(e); err != nil {
+		t.Fatalf("Record() failed: %s", err)
+	}
+	ents := reopen(t, j)
+	if len(ents) != 2 {
+		t.Fatalf("journal has %d entries, want 2", len(ents))
+	}
+	for _, e := range ents {
+		if e.ExternalPort == 9001 && e.Lifetime != 7200 {
+			t.Errorf("entry %+v was not replaced", e)
+		}
+	}
+
+	// Entries are per backend and gateway.
+	if ents = j.Entries(testBackend, "192.168.2.1"); len(ents) != 0 {
+		t.Errorf("Entries() returned %+v for another gateway", ents)
+	}
+	if ents = j.Entries("NAT-PMP", testGateway); len(ents) != 0 {
+		t.Errorf("Entries() returned %+v for another backend", ents)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir, j := newTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	for _, port := range []int{9001, 9030} {
+		if err := j.Record(testEntry(port)); err != nil {
+			t.Fatalf("Record(%d) failed: %s", port, err)
+		}
+	}
+	if err := j.Remove(testBackend, testGateway, base.TCP, 9001, 9001); err != nil {
+		t.Fatalf("Remove() failed: %s", err)
+	}
+
+	// Removing something that is not there is not an error.
+	if err := j.Remove(testBackend, testGateway, base.UDP, 9030, 9030); err != nil {
+		t.Fatalf("Remove() failed for a missing entry: %s", err)
+	}
+	if ents := reopen(t, j); len(ents) != 1 || ents[0].ExternalPort != 9030 || ents[0].Protocol != base.TCP {
+		t.Errorf("journal has entries %+v after Remove()", ents)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	dir, j := newTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	expired := testEntry(9001)
+	expired.Lifetime = 60
+	expired.Created = now.Add(-2 * time.Minute)
+	indefinite := testEntry(9030)
+	indefinite.Lifetime = 0
+	indefinite.Created = now.Add(-24 * time.Hour)
+	for _, e := range []Entry{expired, indefinite, testEntry(9050)} {
+		if err := j.Record(e); err != nil {
+			t.Fatalf("Record() failed: %s", err)
+		}
+	}
+
+	if err := j.Expire(now); err != nil {
+		t.Fatalf("Expire() failed: %s", err)
+	}
+	ents := reopen(t, j)
+	if len(ents) != 3 {
+		t.Fatalf("journal has %d entries, want 3", len(ents))
+	}
+	for _, e := range ents {
+		if want := e.ExternalPort == 9001; e.Expired != want {
+			t.Errorf("entry for port %d has Expired = %v, want %v", e.ExternalPort, e.Expired, want)
+		}
+		if m := e.PortMapping(now); m.Enabled == e.Expired {
+			t.Errorf("entry for port %d returned %+v", e.ExternalPort, m)
+		}
+	}
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	dir, j := newTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	// Each update is made to the latest journal on disk, so a second handle
+	// (Eg: another process) does not undo the first one's changes.
+	j2, err := Open(j.Path())
+	if err != nil {
+		t.Fatalf("Open() failed: %s", err)
+	}
+	if err = j.Record(testEntry(9001)); err != nil {
+		t.Fatalf("Record() failed: %s", err)
+	}
+	if err = j2.Record(testEntry(9030)); err != nil {
+		t.Fatalf("Record() failed: %s", err)
+	}
+	if err = j.Remove(testBackend, testGateway, base.TCP, 9030, 9030); err != nil {
+		t.Fatalf("Remove() failed: %s", err)
+	}
+	if ents := reopen(t, j); len(ents) != 1 || ents[0].ExternalPort != 9001 {
+		t.Errorf("journal has entries %+v", ents)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(jj *Journal, port int) {
+			defer wg.Done()
+			if err := jj.Record(testEntry(port)); err != nil {
+				t.Errorf("Record(%d) failed: %s", port, err)
+			}
+		}([]*Journal{j, j2}[i%2], 10000+i)
+	}
+	wg.Wait()
+	if ents := reopen(t, j); len(ents) != 21 {
+		t.Errorf("journal has %d entries after concurrent updates, want 21", len(ents))
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, j := newTestJournal(t)
+	defer os.RemoveAll(dir)
+
+	// A lock file left behind by a process that went away does not block.
+	if err := os.MkdirAll(filepath.Dir(j.Path()), 0700); err != nil {
+		t.Fatalf("os.MkdirAll() failed: %s", err)
+	}
+	if err := ioutil.WriteFile(j.Path()+".lock", nil, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile() failed: %s", err)
+	}
+	if err := j.Record(testEntry(9001)); err != nil {
+		t.Fatalf("Record() failed with a leftover lock file: %s", err)
+	}
+
+	// A held lock blocks other handles till it is released.
+	j2, err := Open(j.Path())
+	if err != nil {
+		t.Fatalf("Open() failed: %s", err)
+	}
+	unlock, err := j.lockFile()
+	if err != nil {
+		t.Fatalf("lockFile() failed: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- j2.Record(testEntry(9030))
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("Record() returned %v while the lock was held", err)
+	case <-time.After(4 * lockRetryInterval):
+	}
+	unlock()
+	if err = <-done; err != nil {
+		t.Errorf("Record() failed after the lock was released: %s", err)
+	}
+	if ents := reopen(t, j); len(ents) != 2 {
+		t.Errorf("journal has %d entries, want 2", len(ents))
+	}
+}
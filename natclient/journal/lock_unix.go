@@ -0,0 +1,29 @@
+// Copyright (c) 2014, The Tor Project, Inc.
+// See LICENSE for licensing information
+
+//go:build linux || dragonfly || freebsd || netbsd || openbsd || darwin
+// +build linux dragonfly freebsd netbsd openbsd darwin
+
+package journal
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile attempts to take an exclusive lock on f without blocking, and
+// returns false if another process (or handle) holds it.
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch err {
+	case nil:
+		return true, nil
+	case syscall.EWOULDBLOCK, syscall.EINTR:
+		return false, nil
+	}
+	return false, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
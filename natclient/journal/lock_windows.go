@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package journal
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errorLockViolation syscall.Errno = 33
+)
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+var procLockFileEx = kernel32.NewProc("LockFileEx")
+var procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+
+// tryLockFile attempts to take an exclusive lock on f without blocking, and
+// returns false if another process (or handle) holds it.
+func tryLockFile(f *os.File) (bool, error) {
+	// See: https://learn.microsoft.com/en-us/windows/win32/api/fileapi/nf-fileapi-lockfileex
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return true, nil
+	}
+	if err == errorLockViolation || err == syscall.ERROR_IO_PENDING {
+		return false, nil
+	}
+	return false, err
+}
+
+func unlockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package natclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/journal"
+	"git.torproject.org/tor-fw-helper.git/natclient/natpmp"
+)
+
+// JournaledClient is a Client that records the port mappings that it creates
+// in a Journal.  Backends that can not list or query port mappings will use
+// the journaled mappings instead.
+type JournaledClient struct {
+	base.Client
+
+	opts    *base.Options
+	journal *journal.Journal
+	backend string
+	gateway string
+}
+
+// nonceClient is implemented by backends that need a per-mapping nonce to
+// refresh or remove mappings (PCP).  The nonces are journaled, so that the
+// mappings can be managed by later runs.
+type nonceClient interface {
+	MappingNonce(protocol base.Protocol, internalPort int) []byte
+	SetMappingNonce(protocol base.Protocol, internalPort int, nonce []byte) error
+}
+
+// NewJournaled behaves like New, but returns a client that records the port
+// mappings that it creates and removes in j.
+func NewJournaled(protocol string, opts *base.Options, j *journal.Journal) (*JournaledClient, error) {
+	return NewJournaledContext(context.Background(), protocol, opts, j)
+}
+
+// NewJournaledContext behaves like NewJournaled, but aborts the discovery
+// process when ctx is canceled or expires.
+func NewJournaledContext(ctx context.Context, protocol string, opts *base.Options, j *journal.Journal) (*JournaledClient, error) {
+	c, err := NewContext(ctx, protocol, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mappings are keyed by the default gateway, so that mappings created
+	// on other networks are left alone, and by the backend actually in use
+	// rather than the one requested, as PCP falls back to NAT-PMP.
+	var gateway string
+	if gwAddr, err := natpmp.LookupGateway(opts); err == nil {
+		gateway = gwAddr.String()
+	}
+	jc := &JournaledClient{Client: c, opts: opts, journal: j, backend: c.Router().Backend, gateway: gateway}
+	if nc, ok := c.(nonceClient); ok {
+		for _, e := range jc.JournaledPortMappings() {
+			if e.Nonce == nil {
+				continue
+			}
+			if err = nc.SetMappingNonce(e.Protocol, e.InternalPort, e.Nonce); err != nil {
+				jc.logf(base.LevelWarn, base.OpDiscover, "ignoring journaled nonce: %s\n", err)
+			}
+		}
+	}
+	return jc, nil
+}
+
+// AddPortMapping adds a new port forwarding entry, and records it in the
+// journal.
+func (c *JournaledClient) AddPortMapping(description string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	return c.AddPortMappingContext(context.Background(), description, protocol, internalPort, externalPort, duration)
+}
+
+// AddPortMappingContext adds a new port forwarding entry, and records it in
+// the journal.
+func (c *JournaledClient) AddPortMappingContext(ctx context.Context, description string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	m, err := c.Client.AddPortMappingContext(ctx, description, protocol, internalPort, externalPort, duration)
+	if err != nil {
+		return nil, err
+	}
+	e := journal.Entry{
+		Backend:      c.backend,
+		Gateway:      c.gateway,
+		Protocol:     m.Protocol,
+		Description:  m.Description,
+		InternalIP:   m.InternalIP,
+		InternalPort: m.InternalPort,
+		ExternalPort: m.ExternalPort,
+		Lifetime:     m.LeaseDuration,
+		Created:      time.Now(),
+	}
+	if nc, ok := c.Client.(nonceClient); ok {
+		e.Nonce = nc.MappingNonce(m.Protocol, m.InternalPort)
+	}
+	if err = c.journal.Record(e); err != nil {
+		c.logf(base.LevelWarn, "AddPortMapping", "failed to record mapping in journal: %s\n", err)
+	}
+	return m, nil
+}
+
+// DeletePortMapping removes an existing port forwarding entry, and removes it
+// from the journal.
+func (c *JournaledClient) DeletePortMapping(protocol base.Protocol, internalPort, externalPort int) error {
+	return c.DeletePortMappingContext(context.Background(), protocol, internalPort, externalPort)
+}
+
+// DeletePortMappingContext removes an existing port forwarding entry, and
+// removes it from the journal.
+func (c *JournaledClient) DeletePortMappingContext(ctx context.Context, protocol base.Protocol, internalPort, externalPort int) error {
+	if err := c.Client.DeletePortMappingContext(ctx, protocol, internalPort, externalPort); err != nil {
+		return err
+	}
+	if err := c.journal.Remove(c.backend, c.gateway, protocol, internalPort, externalPort); err != nil {
+		c.logf(base.LevelWarn, "DeletePortMapping", "failed to remove mapping from journal: %s\n", err)
+	}
+	return nil
+}
+
+// GetListOfPortMappings queries the router for the list of port forwarding
+// entries.  If the backend does not support listing entries, the journaled
+// entries are returned, with expired entries marked as disabled.
+func (c *JournaledClient) GetListOfPortMappings() ([]base.PortMapping, error) {
+	return c.GetListOfPortMappingsContext(context.Background())
+}
+
+// GetListOfPortMappingsContext queries the router for the list of port
+// forwarding entries, falling back to the journal.
+func (c *JournaledClient) GetListOfPortMappingsContext(ctx context.Context) ([]base.PortMapping, error) {
+	ents, err := c.Client.GetListOfPortMappingsContext(ctx)
+	if !isUnsupported(err) {
+		return ents, err
+	}
+
+	c.logf(base.LevelDebug, "GetListOfPortMappings", "listing port mappings from journal: %s\n", c.journal.Path())
+	now := time.Now()
+	if err = c.journal.Expire(now); err != nil {
+		c.logf(base.LevelWarn, "GetListOfPortMappings", "failed to update journal: %s\n", err)
+	}
+	jEnts := c.journal.Entries(c.backend, c.gateway)
+	ents = make([]base.PortMapping, 0, len(jEnts))
+	for _, e := range jEnts {
+		ents = append(ents, e.PortMapping(now))
+	}
+	return ents, nil
+}
+
+// GetPortMapping queries the router for the port forwarding entry for the
+// given protocol and external port.  If the backend does not support queries,
+// the journaled entry is returned, marked as disabled if it has expired.
+func (c *JournaledClient) GetPortMapping(protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	return c.GetPortMappingContext(context.Background(), protocol, externalPort)
+}
+
+// GetPortMappingContext queries the router for the port forwarding entry for
+// the given protocol and external port, falling back to the journal.
+func (c *JournaledClient) GetPortMappingContext(ctx context.Context, protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	m, err := c.Client.GetPortMappingContext(ctx, protocol, externalPort)
+	if !isUnsupported(err) {
+		return m, err
+	}
+
+	c.logf(base.LevelDebug, "GetPortMapping", "looking up port mapping in journal: %s\n", c.journal.Path())
+	now := time.Now()
+	if err = c.journal.Expire(now); err != nil {
+		c.logf(base.LevelWarn, "GetPortMapping", "failed to update journal: %s\n", err)
+	}
+	for _, e := range c.journal.Entries(c.backend, c.gateway) {
+		if e.Protocol == protocol && e.ExternalPort == externalPort {
+			m := e.PortMapping(now)
+			return &m, nil
+		}
+	}
+	return nil, &base.Error{Protocol: c.backend, Category: base.CategoryNotFound, Err: fmt.Errorf("no journaled mapping for external port %d %s", externalPort, protocol)}
+}
+
+// isUnsupported returns true iff err indicates that the backend or the router
+// does not support the operation, and the journal should be used instead.
+func isUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, base.CategoryUnsupported)
+}
+
+// JournaledPortMappings returns the journaled port mappings that were created
+// with the same backend and gateway as the client.  Removing these with
+// DeletePortMapping leaves mappings that were created by others untouched.
+func (c *JournaledClient) JournaledPortMappings() []journal.Entry {
+	return c.journal.Entries(c.backend, c.gateway)
+}
+
+// logf logs a message about op, attributed to the backend.
+func (c *JournaledClient) logf(level base.Level, op, f string, a ...interface{}) {
+	base.Logf(c.opts, level, c.backend, op, f, a...)
+}
+
+var _ base.Client = (*JournaledClient)(nil)
@@ -8,10 +8,13 @@
 package natclient
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"git.torproject.org/tor-fw-helper.git/natclient/base"
 	"git.torproject.org/tor-fw-helper.git/natclient/natpmp"
+	"git.torproject.org/tor-fw-helper.git/natclient/pcp"
 	"git.torproject.org/tor-fw-helper.git/natclient/upnp"
 )
 
@@ -30,44 +33,136 @@ func registerFactory(f base.ClientFactory) {
 
 // New attempts to initialize a port forwarding mechanism that is compatible
 // with the local network.  If the protocol is not specified, the first
-// compatible backend will be chosen.  Currently supported protocols are "UPnP"
-// and "NAT-PMP".
-func New(protocol string, verbose bool) (base.Client, error) {
+// compatible backend will be chosen.  Currently supported protocols are
+// "UPnP", "NAT-PMP", and "PCP".  The opts are passed to each backend that is
+// tried, and may be nil.
+func New(protocol string, opts *base.Options) (base.Client, error) {
+	return NewContext(context.Background(), protocol, opts)
+}
+
+// NewContext behaves like New, but aborts the discovery process when ctx is
+// canceled or expires.
+func NewContext(ctx context.Context, protocol string, opts *base.Options) (base.Client, error) {
 	if protocol != "" {
 		f := factories[protocol]
 		if f == nil {
 			return nil, fmt.Errorf("unknown protocol '%s'", protocol)
 		}
-		return invokeFactory(f, verbose)
+		c, err := invokeFactory(ctx, f, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// The backend can differ from the one requested (Eg: PCP falls
+		// back to NAT-PMP).
+		base.Logf(opts, base.LevelInfo, "", base.OpDiscover, "using backend: %s\n", c.Router().Backend)
+		return c, nil
+	}
+	return probeFactories(ctx, opts)
+}
+
+type probeResult struct {
+	c   base.Client
+	err error
+}
+
+func probeFactories(ctx context.Context, opts *base.Options) (base.Client, error) {
+	// Discovery takes several seconds for each backend that has nothing to
+	// talk to (Eg: the SSDP retry loop on networks without UPnP), so all of
+	// the backends are probed at once.  The results are examined in
+	// registration order, so the highest priority backend that works is used
+	// even if a lower priority one answers first.  Backends that worked on
+	// a previous run (per the discovery cache) take priority, so that a
+	// cached NAT-PMP router does not have to wait for SSDP to time out.
+	names := probeOrder(opts)
+	probeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan probeResult, len(names))
+	for i, name := range names {
+		results[i] = make(chan probeResult, 1)
+		go func(f base.ClientFactory, ch chan<- probeResult) {
+			c, err := invokeFactory(probeCtx, f, opts)
+			ch <- probeResult{c, err}
+		}(factories[name], results[i])
+	}
+
+	winner := -1
+	var c base.Client
+	var failures []string
+	for i, ch := range results {
+		r := <-ch
+		if r.c != nil && r.err == nil {
+			winner, c = i, r.c
+			break
+		}
+		failures = append(failures, fmt.Sprintf("%s - %s", names[i], r.err))
+	}
+
+	// Abort the probes that are still running, and wait for them to finish
+	// so that nothing is left behind, closing any that also succeeded.
+	cancel()
+	for i := winner + 1; winner >= 0 && i < len(results); i++ {
+		if r := <-results[i]; r.c != nil && r.err == nil {
+			base.Logf(opts, base.LevelDebug, "", base.OpDiscover, "discarding backend: %s\n", names[i])
+			r.c.Close()
+		}
+	}
+
+	if winner < 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Each backend's failure is only logged (at LevelInfo) as it
+		// happens, since one failing is normal as long as another works.
+		base.Logf(opts, base.LevelError, "", base.OpDiscover, "no backend succeeded: %s\n", strings.Join(failures, ", "))
+		return nil, fmt.Errorf("failed to initialize/discover a port forwarding mechanism")
+	}
+	base.Logf(opts, base.LevelInfo, "", base.OpDiscover, "using backend: %s\n", c.Router().Backend)
+	return c, nil
+}
+
+// probeOrder returns the names of the backends in the order that their
+// results should be examined.
+func probeOrder(opts *base.Options) []string {
+	if opts == nil || opts.Cache == nil {
+		return factoryNames
+	}
+	names := make([]string, 0, len(factoryNames))
+	for _, name := range factoryNames {
+		if opts.Cache.Lookup(name) != nil {
+			names = append(names, name)
+		}
 	}
 	for _, name := range factoryNames {
-		f := factories[name]
-		c, err := invokeFactory(f, verbose)
-		if c != nil && err == nil {
-			return c, nil
+		if opts.Cache.Lookup(name) == nil {
+			names = append(names, name)
 		}
 	}
-	return nil, fmt.Errorf("failed to initialize/discover a port forwarding mechanism")
+	return names
 }
 
-func invokeFactory(f base.ClientFactory, verbose bool) (base.Client, error) {
+func invokeFactory(ctx context.Context, f base.ClientFactory, opts *base.Options) (base.Client, error) {
 	name := f.Name()
-	if verbose {
-		base.Vlogf("attempting backend: %s\n", name)
-	}
-	c, err := f.New(verbose)
+	base.Logf(opts, base.LevelDebug, "", base.OpDiscover, "attempting backend: %s\n", name)
+	c, err := f.NewContext(ctx, opts)
 	if err != nil {
-		base.Vlogf("failed to initialize: %s - %s\n", name, err)
+		if ctx.Err() != nil {
+			// Canceled, either by the caller, or because a higher priority
+			// backend was found, which is not a failure worth reporting.
+			base.Logf(opts, base.LevelDebug, "", base.OpDiscover, "abandoned backend: %s\n", name)
+			return nil, err
+		}
+		base.Logf(opts, base.LevelInfo, "", base.OpDiscover, "failed to initialize: %s - %s\n", name, err)
 		return nil, err
 	}
-	if verbose {
-		base.Vlogf("using backend: %s\n", name)
-	}
 	return c, nil
 }
 
 func init() {
-	factoryNames = make([]string, 0, 2)
+	factoryNames = make([]string, 0, 3)
 	registerFactory(&upnp.ClientFactory{})
 	registerFactory(&natpmp.ClientFactory{})
+	registerFactory(&pcp.ClientFactory{})
 }
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package natpmp
+
+import (
+	"fmt"
+	"net"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// RFC 6886 Section 3.2.1: When the external address changes (or the gateway
+// reboots), the gateway multicasts a series of External Address responses to
+// 224.0.0.1:5350.
+var announceAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 1), Port: 5350}
+
+func (c *Client) cachedExtAddr() net.IP {
+	c.addrLock.Lock()
+	defer c.addrLock.Unlock()
+	return c.extAddr
+}
+
+func (c *Client) setCachedExtAddr(extAddr net.IP) (changed bool) {
+	c.addrLock.Lock()
+	defer c.addrLock.Unlock()
+	changed = !extAddr.Equal(c.extAddr)
+	c.extAddr = extAddr
+	return
+}
+
+// ListenForAnnouncements starts listening for external address announcements
+// from the gateway.  Each time the announced address differs from the cached
+// one, the cache is updated and the new address is sent on the returned
+// channel.  Only the most recent change is buffered if the receiver is slow.
+// The channel is closed when the Client is closed.
+func (c *Client) ListenForAnnouncements() (<-chan net.IP, error) {
+	if c.annConn != nil {
+		return nil, fmt.Errorf("already listening for announcements")
+	}
+
+	var err error
+	c.annConn, err = net.ListenMulticastUDP("udp4", c.iface, announceAddr)
+	if err != nil {
+		c.logf(base.LevelWarn, "ListenForAnnouncements", "failed to listen for announcements: %s\n", err)
+		return nil, err
+	}
+	c.logf(base.LevelInfo, "ListenForAnnouncements", "listening for announcements on %s\n", announceAddr)
+
+	ch := make(chan net.IP, 1)
+	go c.announceWorker(c.annConn, ch)
+	return ch, nil
+}
+
+func (c *Client) announceWorker(conn *net.UDPConn, ch chan net.IP) {
+	defer close(ch)
+
+	rawBuf := make([]byte, maxLength)
+	for {
+		n, addr, err := conn.ReadFromUDP(rawBuf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			// Closed (or something horrible happened).
+			return
+		}
+
+		// Anyone can send multicast traffic, so only believe the gateway.
+		if !addr.IP.Equal(c.gwAddr) {
+			continue
+		}
+		resp, err := decodeExternalAddressResp(rawBuf[:n])
+		if err != nil {
+			c.logf(base.LevelWarn, "ListenForAnnouncements", "invalid announcement: %s\n", err)
+			continue
+		}
+		if !c.setCachedExtAddr(resp.extAddr) {
+			continue
+		}
+		c.logf(base.LevelInfo, "ListenForAnnouncements", "external address changed: %s\n", resp.extAddr)
+
+		// Replace any change that has not been received yet, only the
+		// latest address is interesting.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- resp.extAddr
+	}
+}
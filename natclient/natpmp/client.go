@@ -8,8 +8,10 @@
 package natpmp
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"syscall"
 
 	"git.torproject.org/tor-fw-helper.git/natclient/base"
@@ -18,140 +20,316 @@ import (
 const (
 	methodName = "NAT-PMP"
 
-	natpmpPort   = 5351
+	natpmpPort = 5351
 )
 
-type ClientFactory struct{}
+// ClientFactory is a NAT-PMP ClientFactory.  The zero value talks to the
+// default gateway.
+type ClientFactory struct {
+	// GatewayAddr, if set, is the "host:port" of the NAT-PMP server to use
+	// instead of the default gateway (Eg: a natpmptest.Server).
+	GatewayAddr string
+}
 
 func (f *ClientFactory) Name() string {
 	return methodName
 }
 
-func (f *ClientFactory) New(verbose bool) (base.Client, error) {
-	var err error
+func (f *ClientFactory) gatewayAddr(iface *net.Interface, srcAddr net.IP) (*net.UDPAddr, error) {
+	if f.GatewayAddr != "" {
+		return net.ResolveUDPAddr("udp4", f.GatewayAddr)
+	}
+	gwAddr, err := getGateway(iface, srcAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: gwAddr, Port: natpmpPort}, nil
+}
+
+func (f *ClientFactory) New(opts *base.Options) (base.Client, error) {
+	return f.NewContext(context.Background(), opts)
+}
 
-	c := &Client{verbose: verbose}
-	c.gwAddr, err = getGateway()
+func (f *ClientFactory) NewContext(ctx context.Context, opts *base.Options) (base.Client, error) {
+	c := &Client{}
+	c.setOptions(opts)
+	iface, srcAddr, err := c.opts.LocalInterface()
+	if err != nil {
+		return nil, err
+	}
+	c.iface = iface
+	addr, err := f.gatewayAddr(iface, srcAddr)
 	if err != nil {
 		return nil, err
 	}
-	c.Vlogf("gwAddr is %s\n", c.gwAddr)
+	c.gwAddr = addr.IP
+	c.logf(base.LevelInfo, base.OpDiscover, "gwAddr is %s\n", c.gwAddr)
 
 	// Initialize the UDP socket here.
-	addr := &net.UDPAddr{IP: c.gwAddr, Port: natpmpPort}
-	c.conn, err = net.DialUDP("udp4", nil, addr)
+	var localAddr *net.UDPAddr
+	if srcAddr != nil {
+		localAddr = &net.UDPAddr{IP: srcAddr}
+	}
+	c.conn, err = net.DialUDP("udp4", localAddr, addr)
 	if err != nil {
-		c.Vlogf("failed to connect to router: %s\n", err)
+		c.logf(base.LevelWarn, base.OpDiscover, "failed to connect to router: %s\n", err)
 		return nil, err
 	}
 	tmp := c.conn.LocalAddr().(*net.UDPAddr)
 	c.internalAddr = tmp.IP
-	c.Vlogf("local IP is %s\n", c.internalAddr)
+	c.logf(base.LevelInfo, base.OpDiscover, "local IP is %s\n", c.internalAddr)
 
 	// Fetch the external address as a test of the router.
-	c.extAddr, err = c.GetExternalIPAddress()
-	if err != nil {
+	if _, err = c.GetExternalIPAddressContext(ctx); err != nil {
 		c.conn.Close()
+		if c.opts.Cache != nil && ctx.Err() == nil {
+			c.opts.Cache.Remove(methodName)
+		}
 		return nil, err
 	}
+	if c.opts.Cache != nil {
+		e := &base.CacheEntry{Backend: methodName, LocalAddr: c.internalAddr}
+		if err = c.opts.Cache.Store(e); err != nil {
+			c.logf(base.LevelWarn, base.OpDiscover, "failed to update the discovery cache: %s\n", err)
+		}
+	}
 	return c, nil
 }
 
 // Client is a NAT-PMP client instance.
 type Client struct {
-	verbose      bool
+	opts         base.Options
 	conn         *net.UDPConn
 	internalAddr net.IP
 	gwAddr       net.IP
-	extAddr      net.IP
+	iface        *net.Interface // Only set when pinned via the options.
+
+	// extAddr is protected by addrLock, as it is updated by the
+	// announcement listener.
+	addrLock sync.Mutex
+	extAddr  net.IP
+
+	annConn *net.UDPConn
 }
 
-// AddPortMapping adds a new TCP/IP port mapping.  The internal IP address of
-// the client is used as the destination.  A 0 duration will request a 7200
-// second lease.
-func (c *Client) AddPortMapping(description string, internalPort, externalPort, duration int) error {
+// AddPortMapping adds a new port mapping for the given protocol.  The internal
+// IP address of the client is used as the destination.  A 0 duration will
+// request a 7200 second lease.
+func (c *Client) AddPortMapping(description string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	return c.AddPortMappingContext(context.Background(), description, protocol, internalPort, externalPort, duration)
+}
+
+// AddPortMappingContext adds a new port mapping for the given protocol.
+func (c *Client) AddPortMappingContext(ctx context.Context, description string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	if description == "" {
+		description = c.opts.Description
+	}
 	if duration == 0 {
 		duration = defaultMappingDuration
 	}
 
-	c.Vlogf("AddPortMapping: %s:%d <-> 0.0.0.0:%d (%d sec)\n", c.internalAddr, internalPort, externalPort, duration)
+	c.logf(base.LevelDebug, "AddPortMapping", "AddPortMapping: %s:%d <-> 0.0.0.0:%d %s (%d sec)\n", c.internalAddr, internalPort, externalPort, protocol, duration)
 
-	req, err := newRequestMappingReq(internalPort, externalPort, duration)
+	req, err := newRequestMappingReq(protocol, internalPort, externalPort, duration)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	r, err := c.issueRequest(req)
+	r, err := c.issueRequest(ctx, req)
 	if err != nil {
-		c.Vlogf("failed to create Request Mapping request: %s", err)
-		return err
+		c.logf(base.LevelWarn, "AddPortMapping", "failed to create Request Mapping request: %s", err)
+		return nil, err
 	}
 	if resp, ok := r.(*requestMappingResp); ok {
-		// Check that resp.mappedPort = externalPort.
-		if int(resp.mappedPort) == externalPort {
-			return nil
+		// Check that resp.mappedPort = externalPort, or is an acceptable
+		// alternative.
+		if int(resp.mappedPort) == externalPort || c.opts.AcceptsAlternatePort(int(resp.mappedPort)) {
+			if int(resp.mappedPort) != externalPort {
+				c.logf(base.LevelInfo, "AddPortMapping", "router mapped external port %d in place of %d\n", resp.mappedPort, externalPort)
+			}
+			c.logf(base.LevelInfo, "AddPortMapping", "router granted a %d sec lease\n", resp.mappingLifetime)
+			m := &base.PortMapping{
+				Description:   description,
+				InternalIP:    c.internalAddr,
+				InternalPort:  int(resp.internalPort),
+				ExternalPort:  int(resp.mappedPort),
+				Protocol:      protocol,
+				Enabled:       true,
+				LeaseDuration: int(resp.mappingLifetime),
+			}
+			return m, nil
 		}
 
 		// There was a conflict, and the router picked a different port than
 		// requested.  Undo the mapping that isn't exactly what we wanted.
-		c.DeletePortMapping(int(resp.internalPort), int(resp.mappedPort))
+		c.DeletePortMappingContext(ctx, protocol, int(resp.internalPort), int(resp.mappedPort))
 
-		c.Vlogf("router mapped a different external port than requested: %d\n", resp.mappedPort)
-		return fmt.Errorf("router mapped a different external port than requested")
+		c.logf(base.LevelInfo, "AddPortMapping", "router mapped a different external port than requested: %d\n", resp.mappedPort)
+		return nil, &base.Error{Protocol: methodName, Category: base.CategoryConflict, Err: fmt.Errorf("router mapped a different external port than requested")}
 	}
-	return fmt.Errorf("invalid response received to AddPortMapping")
+	return nil, fmt.Errorf("invalid response received to AddPortMapping")
+}
+
+// DeletePortMapping removes an existing port forwarding entry for the given
+// protocol between clientIP:internalPort and 0.0.0.0:externalPort.
+func (c *Client) DeletePortMapping(protocol base.Protocol, internalPort, externalPort int) error {
+	return c.DeletePortMappingContext(context.Background(), protocol, internalPort, externalPort)
 }
 
-// DeletePortMapping removes an existing TCP/IP port forwarding entry
-// between clientIP:internalPort and 0.0.0.0:externalPort.
-func (c *Client) DeletePortMapping(internalPort, externalPort int) error {
-	req, err := newRequestMappingReq(internalPort, 0, 0)
+// DeletePortMappingContext removes an existing port forwarding entry.
+func (c *Client) DeletePortMappingContext(ctx context.Context, protocol base.Protocol, internalPort, externalPort int) error {
+	req, err := newRequestMappingReq(protocol, internalPort, 0, 0)
 	if err != nil {
 		return err
 	}
-	_, err = c.issueRequest(req)
+	_, err = c.issueRequest(ctx, req)
 	return err
 }
 
 // GetExternalIPAddress queries the router's external IP address.
 func (c *Client) GetExternalIPAddress() (net.IP, error) {
+	return c.GetExternalIPAddressContext(context.Background())
+}
+
+// GetExternalIPAddressContext queries the router's external IP address.
+func (c *Client) GetExternalIPAddressContext(ctx context.Context) (net.IP, error) {
 	// This is cached during startup since it doubles as the "does the router
 	// actually support this?" check.
-	if c.extAddr != nil {
-		c.Vlogf("using cached external address: %s\n", c.extAddr)
-		return c.extAddr, nil
+	if extAddr := c.cachedExtAddr(); extAddr != nil {
+		c.logf(base.LevelDebug, "GetExternalIPAddress", "using cached external address: %s\n", extAddr)
+		return extAddr, nil
 	}
 
 	// First time we're querying the external IP, must be when we try to probe
 	// for the presence of a device.
-	c.Vlogf("querying external address\n")
+	c.logf(base.LevelDebug, "GetExternalIPAddress", "querying external address\n")
 
 	req := newExternalAddressReq()
-	r, err := c.issueRequest(req)
+	r, err := c.issueRequest(ctx, req)
 	if err != nil {
-		c.Vlogf("failed to query external address: %s\n", err)
+		c.logf(base.LevelWarn, "GetExternalIPAddress", "failed to query external address: %s\n", err)
 		return nil, err
 	}
 	if resp, ok := r.(*externalAddressResp); ok {
-		c.extAddr = resp.extAddr
+		c.setCachedExtAddr(resp.extAddr)
 		return resp.extAddr, nil
 	}
 	return nil, fmt.Errorf("invalid response received to GetExternalIPAddress")
 }
 
-func (c *Client) Vlogf(f string, a ...interface{}) {
-	if c.verbose {
-		base.Vlogf(methodName+": "+f, a...)
+func (c *Client) setOptions(opts *base.Options) {
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Retries <= 0 {
+		c.opts.Retries = maxRetries
+	}
+	if c.opts.RetryTimeout <= 0 {
+		c.opts.RetryTimeout = initialTimeoutDuration
 	}
 }
 
+// Router returns a description of the gateway.
+func (c *Client) Router() *base.Router {
+	return &base.Router{
+		Backend:   methodName,
+		Address:   c.gwAddr.String(),
+		LocalAddr: c.internalAddr,
+	}
+}
+
+func (c *Client) Vlogf(f string, a ...interface{}) {
+	c.logf(base.LevelDebug, "", f, a...)
+}
+
+// logf logs a message about op to the Logger in the options.
+func (c *Client) logf(level base.Level, op, f string, a ...interface{}) {
+	base.Logf(&c.opts, level, methodName, op, f, a...)
+}
+
+// OpenIPv6Pinhole opens an inbound IPv6 firewall pinhole.  This is not
+// supported by this backend.
+func (c *Client) OpenIPv6Pinhole(protocol base.Protocol, internalPort, duration int) (*base.Pinhole, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// OpenIPv6PinholeContext opens an inbound IPv6 firewall pinhole.  This is not
+// supported by this backend.
+func (c *Client) OpenIPv6PinholeContext(ctx context.Context, protocol base.Protocol, internalPort, duration int) (*base.Pinhole, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// RenewIPv6Pinhole extends the lease of an IPv6 firewall pinhole.  This is
+// not supported by this backend.
+func (c *Client) RenewIPv6Pinhole(uniqueID, duration int) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+// RenewIPv6PinholeContext extends the lease of an IPv6 firewall pinhole.
+// This is not supported by this backend.
+func (c *Client) RenewIPv6PinholeContext(ctx context.Context, uniqueID, duration int) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+// CloseIPv6Pinhole closes an IPv6 firewall pinhole.  This is not supported by
+// this backend.
+func (c *Client) CloseIPv6Pinhole(uniqueID int) error {
+	return syscall.ENOTSUP
+}
+
+// CloseIPv6PinholeContext closes an IPv6 firewall pinhole.  This is not
+// supported by this backend.
+func (c *Client) CloseIPv6PinholeContext(ctx context.Context, uniqueID int) error {
+	return syscall.ENOTSUP
+}
+
 // GetListOfPortMappings queries the router for the list of port forwarding
 // entries.
-func (c *Client) GetListOfPortMappings() ([]string, error) {
+func (c *Client) GetListOfPortMappings() ([]base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// GetListOfPortMappingsContext queries the router for the list of port
+// forwarding entries.  This is not supported by this backend.
+func (c *Client) GetListOfPortMappingsContext(ctx context.Context) ([]base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// GetPortMapping queries the router for the port forwarding entry for the
+// given protocol and external port.
+func (c *Client) GetPortMapping(protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// GetPortMappingContext queries the router for the port forwarding entry for
+// the given protocol and external port.  This is not supported by this
+// backend, as the protocol has no way to query a mapping without altering
+// it (A request with a zero lifetime deletes the mapping).
+func (c *Client) GetPortMappingContext(ctx context.Context, protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
 	return nil, syscall.ENOTSUP
 }
 
 func (c *Client) Close() {
 	c.conn.Close()
+	if c.annConn != nil {
+		c.annConn.Close()
+	}
+}
+
+// GetGateway returns the IPv4 address of the default gateway, which is where
+// the NAT-PMP (and PCP) server is expected to be.
+func GetGateway() (net.IP, error) {
+	return getGateway(nil, nil)
+}
+
+// LookupGateway behaves like GetGateway, but only considers the default route
+// out of the interface selected by opts.Interface and opts.SourceAddress, if
+// any.
+func LookupGateway(opts *base.Options) (net.IP, error) {
+	iface, srcAddr, err := opts.LocalInterface()
+	if err != nil {
+		return nil, err
+	}
+	return getGateway(iface, srcAddr)
 }
 
 var _ base.ClientFactory = (*ClientFactory)(nil)
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package natpmp
+
+import (
+	"errors"
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/natpmp/natpmptest"
+)
+
+// newTestClient starts a fake gateway, and creates a client for it.
+// Behaviors must be scripted after this returns, as creating the client
+// issues a request.
+func newTestClient(t *testing.T, opts *base.Options) (*natpmptest.Server, *Client) {
+	t.Helper()
+	s, err := natpmptest.New(nil)
+	if err != nil {
+		t.Fatalf("natpmptest.New() failed: %s", err)
+	}
+	f := &ClientFactory{GatewayAddr: s.Addr()}
+	c, err := f.New(opts)
+	if err != nil {
+		s.Close()
+		t.Fatalf("New() failed: %s", err)
+	}
+	return s, c.(*Client)
+}
+
+// checkMapping checks that m and the gateway's mapping table both hold
+// exactly the requested mapping.
+func checkMapping(t *testing.T, s *natpmptest.Server, m *base.PortMapping, protocol base.Protocol, internalPort, externalPort int) {
+	t.Helper()
+	if m.Protocol != protocol || m.InternalPort != internalPort || m.ExternalPort != externalPort || m.LeaseDuration <= 0 {
+		t.Errorf("AddPortMapping() returned %+v", m)
+	}
+	ms := s.Mappings()
+	if len(ms) != 1 {
+		t.Fatalf("gateway has %d mappings, want 1", len(ms))
+	}
+	if ms[0].Protocol != protocol || ms[0].InternalPort != internalPort || ms[0].ExternalPort != externalPort {
+		t.Errorf("gateway has mapping %+v", ms[0])
+	}
+}
+
+func TestAddPortMapping(t *testing.T) {
+	s, c := newTestClient(t, nil)
+	defer s.Close()
+	defer c.Close()
+
+	m, err := c.AddPortMapping("", base.UDP, 9001, 9002, 3600)
+	if err != nil {
+		t.Fatalf("AddPortMapping() failed: %s", err)
+	}
+	checkMapping(t, s, m, base.UDP, 9001, 9002)
+
+	if err = c.DeletePortMapping(base.UDP, 9001, 9002); err != nil {
+		t.Fatalf("DeletePortMapping() failed: %s", err)
+	}
+	if ms := s.Mappings(); len(ms) != 0 {
+		t.Errorf("gateway has mappings %+v after DeletePortMapping()", ms)
+	}
+}
+
+func TestDroppedRequest(t *testing.T) {
+	s, c := newTestClient(t, nil)
+	defer s.Close()
+	defer c.Close()
+
+	// The client retransmits when the request (or response) is lost.
+	s.Script(natpmptest.Behavior{Drop: true}, natpmptest.Behavior{Drop: true})
+	before := s.Requests()
+	m, err := c.AddPortMapping("", base.TCP, 9001, 9001, 3600)
+	if err != nil {
+		t.Fatalf("AddPortMapping() failed: %s", err)
+	}
+	checkMapping(t, s, m, base.TCP, 9001, 9001)
+	if n := s.Requests() - before; n != 3 {
+		t.Errorf("AddPortMapping() sent %d requests, want 3", n)
+	}
+
+	// Running out of retries is a failure.
+	s.Script(natpmptest.Behavior{Drop: true}, natpmptest.Behavior{Drop: true}, natpmptest.Behavior{Drop: true})
+	if _, err = c.AddPortMapping("", base.UDP, 9001, 9001, 3600); err == nil {
+		t.Errorf("AddPortMapping() succeeded with every request dropped")
+	}
+}
+
+func TestDiscardedResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		b    natpmptest.Behavior
+	}{
+		{"stale", natpmptest.Behavior{Stale: true}},
+		{"wrong opcode", natpmptest.Behavior{WrongOpcode: true}},
+		{"truncated header", natpmptest.Behavior{Truncate: 2}},
+		{"truncated body", natpmptest.Behavior{Truncate: 10}},
+	} {
+		s, c := newTestClient(t, nil)
+
+		// Responses that do not match the request are discarded, and
+		// the client keeps waiting for (or retries to get) one that does.
+		s.Script(tc.b)
+		m, err := c.AddPortMapping("", base.TCP, 9001, 9001, 3600)
+		if err != nil {
+			t.Errorf("%s: AddPortMapping() failed: %s", tc.name, err)
+		} else {
+			checkMapping(t, s, m, base.TCP, 9001, 9001)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestResultCode(t *testing.T) {
+	s, c := newTestClient(t, nil)
+	defer s.Close()
+	defer c.Close()
+
+	s.Script(natpmptest.Behavior{ResultCode: natpmptest.ResNotAuthorized})
+	_, err := c.AddPortMapping("", base.TCP, 9001, 9001, 3600)
+	if err == nil {
+		t.Fatalf("AddPortMapping() succeeded despite NOT_AUTHORIZED")
+	}
+	if !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("AddPortMapping() error %q is not ErrNotAuthorized", err)
+	}
+	if !errors.Is(err, base.CategoryUnauthorized) {
+		t.Errorf("AddPortMapping() error %q is in category %s, want %s", err, base.CategoryOf(err), base.CategoryUnauthorized)
+	}
+	if errors.Is(err, ErrOutOfResources) {
+		t.Errorf("AddPortMapping() error %q is ErrOutOfResources", err)
+	}
+	if ms := s.Mappings(); len(ms) != 0 {
+		t.Errorf("gateway has mappings %+v after a refusal", ms)
+	}
+}
+
+func TestReassignedPort(t *testing.T) {
+	s, c := newTestClient(t, nil)
+	defer s.Close()
+	defer c.Close()
+
+	// A different external port is a conflict, and the mapping that the
+	// gateway created is removed.
+	s.Script(natpmptest.Behavior{ReassignPort: 4000})
+	_, err := c.AddPortMapping("", base.TCP, 9001, 9001, 3600)
+	if err == nil {
+		t.Fatalf("AddPortMapping() succeeded with a reassigned port")
+	}
+	if !errors.Is(err, base.CategoryConflict) {
+		t.Errorf("AddPortMapping() error %q is in category %s, want %s", err, base.CategoryOf(err), base.CategoryConflict)
+	}
+	if ms := s.Mappings(); len(ms) != 0 {
+		t.Errorf("gateway has mappings %+v after a conflict", ms)
+	}
+}
+
+func TestAlternatePort(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts base.Options
+		ok   bool
+	}{
+		{"any port", base.Options{AlternatePort: true}, true},
+		{"in range", base.Options{AlternatePort: true, AlternatePortRange: base.PortRange{Min: 4000, Max: 4010}}, true},
+		{"out of range", base.Options{AlternatePort: true, AlternatePortRange: base.PortRange{Min: 20000, Max: 20010}}, false},
+	} {
+		opts := tc.opts
+		s, c := newTestClient(t, &opts)
+
+		s.Script(natpmptest.Behavior{ReassignPort: 4000})
+		m, err := c.AddPortMapping("", base.TCP, 9001, 9001, 3600)
+		switch {
+		case tc.ok && err != nil:
+			t.Errorf("%s: AddPortMapping() failed: %s", tc.name, err)
+		case tc.ok:
+			checkMapping(t, s, m, base.TCP, 9001, 4000)
+		case !errors.Is(err, base.CategoryConflict):
+			t.Errorf("%s: AddPortMapping() error %v is not a conflict", tc.name, err)
+		case len(s.Mappings()) != 0:
+			t.Errorf("%s: gateway has mappings %+v after a conflict", tc.name, s.Mappings())
+		}
+		c.Close()
+		s.Close()
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package natpmp
+
+import (
+	"errors"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// Non-zero result codes are returned as *base.Error.
+
+type resultInfo struct {
+	name     string // From RFC 6886 Section 3.5.
+	msg      string
+	category base.Category
+}
+
+var results = map[int]resultInfo{
+	resUnsupportedVersion: {"Unsupported Version", "unsupported NAT-PMP version", base.CategoryUnsupported},
+	resNotAuthorized:      {"Not Authorized/Refused", "not authorized/refused", base.CategoryUnauthorized},
+	resNetworkFailure:     {"Network Failure", "network failure", base.CategoryTransient},
+	resOutOfResources:     {"Out of resources", "out of resources", base.CategoryResource},
+	resUnsupportedOpcode:  {"Unsupported opcode", "unsupported opcode", base.CategoryUnsupported},
+}
+
+func newError(code int) *base.Error {
+	info, ok := results[code]
+	if !ok {
+		info = resultInfo{"", "unknown failure", base.CategoryUnknown}
+	}
+	return &base.Error{Protocol: methodName, Code: code, Name: info.name, Category: info.category, Err: errors.New(info.msg)}
+}
+
+// Sentinels for the NAT-PMP result codes, for use with errors.Is.
+var (
+	ErrUnsupportedVersion = newError(resUnsupportedVersion)
+	ErrNotAuthorized      = newError(resNotAuthorized)
+	ErrNetworkFailure     = newError(resNetworkFailure)
+	ErrOutOfResources     = newError(resOutOfResources)
+	ErrUnsupportedOpcode  = newError(resUnsupportedOpcode)
+)
+
+func resultCodeToError(code uint16) error {
+	if code == resSuccess {
+		return nil
+	}
+	return newError(int(code))
+}
+
+// isResultError returns true iff err is a result code from the router, as
+// opposed to a malformed or stale response.
+func isResultError(err error) bool {
+	var e *base.Error
+	return errors.As(err, &e)
+}
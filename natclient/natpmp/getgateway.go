@@ -11,6 +11,6 @@ import (
 	"runtime"
 )
 
-func getGateway() (net.IP, error) {
+func getGateway(iface *net.Interface, srcAddr net.IP) (net.IP, error) {
 	return nil, fmt.Errorf("getGateway not implemented on: %s", runtime.GOOS)
 }
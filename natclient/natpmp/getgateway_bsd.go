@@ -17,7 +17,7 @@ const (
 
 var defaultNet = net.IPv4(0, 0, 0, 0)
 
-func getGateway() (net.IP, error) {
+func getGateway(iface *net.Interface, srcAddr net.IP) (net.IP, error) {
 	// Ok, so the BSD version of the go runtime routing table interaction code
 	// is a bit more limited than the Linux version, since again, getting the
 	// message metadata is a huge pain.  This should work on all the BSDs
@@ -31,6 +31,12 @@ func getGateway() (net.IP, error) {
 		return nil, err
 	}
 	for _, msg := range msgs {
+		if iface != nil {
+			// Only consider routes that go out of the interface.
+			if rtMsg, ok := msg.(*syscall.RouteMessage); !ok || int(rtMsg.Header.Index) != iface.Index {
+				continue
+			}
+		}
 		sas, err := syscall.ParseRoutingSockaddr(msg)
 		if err != nil {
 			continue
@@ -57,5 +63,8 @@ func getGateway() (net.IP, error) {
 			return gwAddr, nil
 		}
 	}
+	if iface != nil {
+		return nil, fmt.Errorf("failed to find default gateway on %s", iface.Name)
+	}
 	return nil, fmt.Errorf("failed to find default gateway")
 }
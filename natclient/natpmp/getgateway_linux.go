@@ -6,6 +6,7 @@
 package natpmp
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"syscall"
@@ -16,6 +17,7 @@ type routeEntry struct {
 	SrcNet net.IPNet
 	DstNet net.IPNet
 	GwAddr net.IP
+	OutIf  int
 }
 
 func parseRTMNewRoute(m *syscall.NetlinkMessage) (*routeEntry, error) {
@@ -46,11 +48,14 @@ func parseRTMNewRoute(m *syscall.NetlinkMessage) (*routeEntry, error) {
 		return nil, err
 	}
 	for _, a := range attrs {
-		// Attr.Len is full of lies (not neccecarily 32 bits for AF_INET
-		// addresses), but if the kernel is returning messages with the
-		// incorrect address length when the family in the header is
-		// AF_INET, there are bigger problems.
-		v := a.Value[:a.Attr.Len]
+		// Every attribute that we care about is at least 32 bits (an
+		// AF_INET address, or an interface index).  If the kernel is
+		// returning shorter ones when the family in the header is AF_INET,
+		// there are bigger problems, but it is no reason to crash.
+		v := a.Value
+		if len(v) < 4 {
+			continue
+		}
 		switch a.Attr.Type {
 		case syscall.RTA_DST:
 			// Route destination address.
@@ -63,6 +68,9 @@ func parseRTMNewRoute(m *syscall.NetlinkMessage) (*routeEntry, error) {
 		case syscall.RTA_GATEWAY:
 			// The gateway of the route.
 			e.GwAddr = net.IPv4(v[0], v[1], v[2], v[3])
+		case syscall.RTA_OIF:
+			// The index of the outgoing interface, in host byte order.
+			e.OutIf = int(int32(binary.NativeEndian.Uint32(v)))
 		default:
 			// Ignore RTA_<bleah> when it doesn't help us get what we want,
 			// not an error since the attributes include things like the
@@ -72,10 +80,11 @@ func parseRTMNewRoute(m *syscall.NetlinkMessage) (*routeEntry, error) {
 	return e, nil
 }
 
-func getGateway() (net.IP, error) {
+func getGateway(iface *net.Interface, srcAddr net.IP) (net.IP, error) {
 	// Yay, syscall has support for netlink(7) sockets.  Query the routing
 	// table, and find the default route, it'll be the RTM_NEWROUTE message
-	// without a destination address (ie: 0.0.0.0) and a gateway set.
+	// without a destination address (ie: 0.0.0.0) and a gateway set.  If an
+	// interface was specified, the route must also go out of it.
 	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
 	if err != nil {
 		return nil, err
@@ -106,9 +115,12 @@ msgLoop:
 	// do this as we go instead of waiting till the entire table has been
 	// parsed, but that doesn't save much time, and this is easier to debug.
 	for _, e := range rtTable {
-		if e.DstNet.IP == nil && e.GwAddr != nil {
+		if e.DstNet.IP == nil && e.GwAddr != nil && (iface == nil || e.OutIf == iface.Index) {
 			return e.GwAddr, nil
 		}
 	}
+	if iface != nil {
+		return nil, fmt.Errorf("failed to find default gateway on %s", iface.Name)
+	}
 	return nil, fmt.Errorf("failed to find default gateway")
 }
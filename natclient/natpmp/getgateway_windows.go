@@ -4,6 +4,7 @@
 package natpmp
 
 import (
+	"fmt"
 	"net"
 	"syscall"
 	"unsafe"
@@ -31,7 +32,7 @@ type mibIPForwardRow struct {
 	dwForwardMetric5   uint32
 }
 
-func getGateway() (net.IP, error) {
+func getGateway(iface *net.Interface, srcAddr net.IP) (net.IP, error) {
 	// Load the iphlpapi.dll helper library and find the symbol for
 	// GetBestRoute().
 	//
@@ -44,12 +45,21 @@ func getGateway() (net.IP, error) {
 	}
 
 	var dwDestAddr, dwSourceAddr uintptr // 0.0.0.0
+	if src := srcAddr.To4(); src != nil {
+		// Restrict the search to routes that can be used with the source
+		// address, in network byte order (little endian host).
+		dwSourceAddr = uintptr(src[0]) | uintptr(src[1])<<8 | uintptr(src[2])<<16 | uintptr(src[3])<<24
+	}
 	row := mibIPForwardRow{}
 	r0, _, _ := syscall.Syscall(procGetBestRoute.Addr(), 3, dwDestAddr, dwSourceAddr, uintptr(unsafe.Pointer(&row)))
 	if r0 != 0 { // r0 != NO_ERROR
 		return nil, syscall.Errno(r0)
 	}
 
+	if iface != nil && int(row.dwForwardIfIndex) != iface.Index {
+		return nil, fmt.Errorf("failed to find default gateway on %s", iface.Name)
+	}
+
 	// Ok, row should have what windows thinks is the best route to "0.0.0.0"
 	// now, which will be the default gateway, per the documentation this is in
 	// network byte order.  Assume host byte order is little endian because
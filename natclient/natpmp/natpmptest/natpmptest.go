@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+// Package natpmptest implements an in-process fake NAT-PMP (RFC 6886) gateway
+// suitable for exercising the natpmp package without a router.  The server
+// keeps a real mapping table and epoch, and can be scripted to misbehave in
+// the various ways that real gateways (and networks) do.
+//
+// To point a client at the fake gateway:
+//
+//	s, err := natpmptest.New(nil)
+//	...
+//	defer s.Close()
+//	f := &natpmp.ClientFactory{GatewayAddr: s.Addr()}
+//	c, err := f.New(nil)
+package natpmptest
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	version = 0
+
+	opExternalAddress   = 0
+	opRequestMappingUDP = 1
+	opRequestMappingTCP = 2
+	opRespOffset        = 128
+
+	// Result codes, for use with Behavior.ResultCode.
+	ResSuccess            = 0
+	ResUnsupportedVersion = 1
+	ResNotAuthorized      = 2
+	ResNetworkFailure     = 3
+	ResOutOfResources     = 4
+	ResUnsupportedOpcode  = 5
+
+	maxLength                 = 1100
+	hdrLength                 = 4
+	externalAddressReqLength  = 2
+	externalAddressRespLength = hdrLength + 8
+	requestMappingReqLength   = hdrLength + 8
+	requestMappingRespLength  = hdrLength + 12
+	unsupportedRespLength     = hdrLength + 4
+)
+
+// Config is the configuration of a fake NAT-PMP gateway.
+type Config struct {
+	// ExternalIP is the address returned in External Address responses.
+	ExternalIP net.IP
+
+	// MaxLifetime, if non-zero, caps the lifetime of granted mappings.
+	MaxLifetime int
+}
+
+// Behavior overrides how the server handles a single request.  The zero value
+// handles the request normally.
+type Behavior struct {
+	// Drop discards the request without processing it.
+	Drop bool
+
+	// ResultCode, if non-zero, is returned instead of processing the
+	// request.
+	ResultCode uint16
+
+	// WrongOpcode sends the response with the opcode of a different
+	// request type.
+	WrongOpcode bool
+
+	// Truncate, if non-zero, truncates the response to this many bytes.
+	Truncate int
+
+	// ReassignPort, if non-zero, is the external port that a new mapping is
+	// assigned instead of the suggested one.
+	ReassignPort int
+
+	// Stale precedes the response with a Request Mapping response for a
+	// different internal port, as if a response to an earlier request had
+	// been delayed in the network.
+	Stale bool
+}
+
+// Mapping is an entry in the fake gateway's mapping table.
+type Mapping struct {
+	Client       net.IP
+	Protocol     base.Protocol
+	InternalPort int
+	ExternalPort int
+
+	// Lifetime is the lifetime that was granted in seconds.
+	Lifetime int
+
+	expiresAt time.Time
+}
+
+func (m *Mapping) remaining(now time.Time) uint32 {
+	left := m.expiresAt.Sub(now) / time.Second
+	if left < 1 {
+		left = 1
+	}
+	return uint32(left)
+}
+
+// Server is a fake NAT-PMP gateway.
+type Server struct {
+	cfg  Config
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+
+	lock       sync.Mutex
+	epochStart time.Time
+	extIP      net.IP
+	mappings   []Mapping
+	script     []Behavior
+	requests   int
+}
+
+// New starts a fake NAT-PMP gateway with the given configuration, with a nil
+// cfg being equivalent to the zero value.
+func New(cfg *Config) (*Server, error) {
+	s := &Server{epochStart: time.Now()}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	s.extIP = s.cfg.ExternalIP
+	if s.extIP == nil {
+		s.extIP = net.IPv4(192, 0, 2, 1) // TEST-NET-1
+	}
+
+	var err error
+	if s.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.worker()
+	return s, nil
+}
+
+// Addr returns the "host:port" of the server, for use as
+// natpmp.ClientFactory.GatewayAddr.
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Script queues behaviors that are applied to the subsequent requests, one
+// per request, in order.  Once the queue is exhausted, requests are handled
+// normally.
+func (s *Server) Script(b ...Behavior) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.script = append(s.script, b...)
+}
+
+// Requests returns the number of requests received, including dropped ones.
+func (s *Server) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+// SetExternalIP changes the address returned in External Address responses.
+func (s *Server) SetExternalIP(ip net.IP) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.extIP = ip
+}
+
+// Reboot simulates the gateway rebooting, which resets the epoch and clears
+// the mapping table.
+func (s *Server) Reboot() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.epochStart = time.Now()
+	s.mappings = nil
+}
+
+// Mappings returns a copy of the current mapping table.
+func (s *Server) Mappings() []Mapping {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expireLocked(time.Now())
+	return append([]Mapping(nil), s.mappings...)
+}
+
+// AddMapping adds an entry to the mapping table directly, as if another host
+// on the network had created it.
+func (s *Server) AddMapping(m Mapping) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m.expiresAt = time.Now().Add(time.Duration(m.Lifetime) * time.Second)
+	s.mappings = append(s.mappings, m)
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.conn.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) worker() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxLength)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			// Closed.
+			return
+		}
+		for _, resp := range s.handle(addr.IP, buf[:n]) {
+			s.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func (s *Server) handle(client net.IP, req []byte) [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests++
+	var b Behavior
+	if len(s.script) > 0 {
+		b = s.script[0]
+		s.script = s.script[1:]
+	}
+	if b.Drop {
+		return nil
+	}
+
+	// RFC 6886 Section 3.5: Malformed requests that are too short to
+	// contain the version and opcode are silently dropped.
+	if len(req) < 2 {
+		return nil
+	}
+	now := time.Now()
+	s.expireLocked(now)
+
+	op := req[1]
+	var resp []byte
+	switch {
+	case req[0] != version:
+		resp = s.errorResp(op, ResUnsupportedVersion)
+	case op >= opRespOffset:
+		// Responses (Eg: our own announcements) are ignored.
+		return nil
+	case b.ResultCode != ResSuccess:
+		resp = s.errorResp(op, b.ResultCode)
+	case op == opExternalAddress:
+		if len(req) != externalAddressReqLength {
+			return nil
+		}
+		resp = s.externalAddressResp(now)
+	case op == opRequestMappingUDP || op == opRequestMappingTCP:
+		if len(req) != requestMappingReqLength {
+			return nil
+		}
+		resp = s.requestMappingResp(client, req, now, b.ReassignPort)
+	default:
+		resp = s.errorResp(op, ResUnsupportedOpcode)
+	}
+
+	if b.WrongOpcode {
+		resp[1] = opRespOffset + (op+1)%(opRequestMappingTCP+1)
+	}
+	if b.Truncate > 0 && b.Truncate < len(resp) {
+		resp = resp[:b.Truncate]
+	}
+	if b.Stale && (op == opRequestMappingUDP || op == opRequestMappingTCP) && len(req) >= 6 {
+		stale := make([]byte, requestMappingRespLength)
+		stale[1] = op + opRespOffset
+		binary.BigEndian.PutUint32(stale[4:8], s.epochLocked(now))
+		binary.BigEndian.PutUint16(stale[8:10], binary.BigEndian.Uint16(req[4:6])+1)
+		return [][]byte{stale, resp}
+	}
+	return [][]byte{resp}
+}
+
+func (s *Server) epochLocked(now time.Time) uint32 {
+	return uint32(now.Sub(s.epochStart) / time.Second)
+}
+
+func (s *Server) errorResp(op uint8, code uint16) []byte {
+	// Error responses to unsupported versions and opcodes are just the
+	// header and epoch, anything else is the full length response with the
+	// rest zeroed.
+	var raw []byte
+	switch {
+	case code == ResUnsupportedVersion || code == ResUnsupportedOpcode:
+		raw = make([]byte, unsupportedRespLength)
+	case op == opExternalAddress:
+		raw = make([]byte, externalAddressRespLength)
+	default:
+		raw = make([]byte, requestMappingRespLength)
+	}
+	raw[0] = version
+	raw[1] = op | opRespOffset
+	binary.BigEndian.PutUint16(raw[2:4], code)
+	binary.BigEndian.PutUint32(raw[4:8], s.epochLocked(time.Now()))
+	return raw
+}
+
+func (s *Server) externalAddressResp(now time.Time) []byte {
+	raw := make([]byte, externalAddressRespLength)
+	raw[0] = version
+	raw[1] = opExternalAddress + opRespOffset
+	binary.BigEndian.PutUint32(raw[4:8], s.epochLocked(now))
+	copy(raw[8:12], s.extIP.To4())
+	return raw
+}
+
+func (s *Server) requestMappingResp(client net.IP, req []byte, now time.Time, reassignPort int) []byte {
+	protocol := base.TCP
+	if req[1] == opRequestMappingUDP {
+		protocol = base.UDP
+	}
+	internalPort := int(binary.BigEndian.Uint16(req[4:6]))
+	externalPort := int(binary.BigEndian.Uint16(req[6:8]))
+	lifetime := int(binary.BigEndian.Uint32(req[8:12]))
+
+	raw := make([]byte, requestMappingRespLength)
+	raw[0] = version
+	raw[1] = req[1] + opRespOffset
+	binary.BigEndian.PutUint32(raw[4:8], s.epochLocked(now))
+	binary.BigEndian.PutUint16(raw[8:10], uint16(internalPort))
+
+	if lifetime == 0 {
+		// RFC 6886 Section 3.4: A lifetime of 0 destroys the mapping, or
+		// all of the client's mappings for the protocol if the internal
+		// port is 0.
+		s.deleteLocked(client, protocol, internalPort)
+		return raw
+	}
+	if s.cfg.MaxLifetime > 0 && lifetime > s.cfg.MaxLifetime {
+		lifetime = s.cfg.MaxLifetime
+	}
+
+	// Requests for an existing mapping refresh it, and return the port that
+	// was originally assigned.
+	m := s.findLocked(client, protocol, internalPort)
+	if m == nil {
+		switch {
+		case reassignPort != 0:
+			externalPort = reassignPort
+		case externalPort == 0 || s.portInUseLocked(protocol, externalPort):
+			externalPort = s.freePortLocked(protocol, internalPort)
+		}
+		if externalPort == 0 {
+			return s.errorResp(req[1], ResOutOfResources)
+		}
+		s.mappings = append(s.mappings, Mapping{
+			Client:       client,
+			Protocol:     protocol,
+			InternalPort: internalPort,
+			ExternalPort: externalPort,
+		})
+		m = &s.mappings[len(s.mappings)-1]
+	}
+	m.Lifetime = lifetime
+	m.expiresAt = now.Add(time.Duration(lifetime) * time.Second)
+
+	binary.BigEndian.PutUint16(raw[10:12], uint16(m.ExternalPort))
+	binary.BigEndian.PutUint32(raw[12:16], uint32(lifetime))
+	return raw
+}
+
+func (s *Server) expireLocked(now time.Time) {
+	live := s.mappings[:0]
+	for _, m := range s.mappings {
+		if now.Before(m.expiresAt) {
+			live = append(live, m)
+		}
+	}
+	s.mappings = live
+}
+
+func (s *Server) findLocked(client net.IP, protocol base.Protocol, internalPort int) *Mapping {
+	for i := range s.mappings {
+		m := &s.mappings[i]
+		if m.Client.Equal(client) && m.Protocol == protocol && m.InternalPort == internalPort {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Server) deleteLocked(client net.IP, protocol base.Protocol, internalPort int) {
+	live := s.mappings[:0]
+	for _, m := range s.mappings {
+		if m.Client.Equal(client) && m.Protocol == protocol && (internalPort == 0 || m.InternalPort == internalPort) {
+			continue
+		}
+		live = append(live, m)
+	}
+	s.mappings = live
+}
+
+func (s *Server) portInUseLocked(protocol base.Protocol, externalPort int) bool {
+	for _, m := range s.mappings {
+		if m.Protocol == protocol && m.ExternalPort == externalPort {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) freePortLocked(protocol base.Protocol, hint int) int {
+	// Pick the closest port above the hint that is free, wrapping around to
+	// the unprivileged range.
+	port := hint
+	for i := 0; i < 65535; i++ {
+		port++
+		if port > 65535 {
+			port = 1024
+		}
+		if !s.portInUseLocked(protocol, port) {
+			return port
+		}
+	}
+	return 0
+}
@@ -6,12 +6,15 @@
 package natpmp
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"net"
 	"syscall"
 	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
 )
 
 const (
@@ -68,6 +71,7 @@ type requestMappingResp struct {
 type externalAddressReq struct{}
 
 type requestMappingReq struct {
+	opcode          uint8
 	internalPort    uint16
 	externalPort    uint16
 	mappingLifetime uint32
@@ -132,7 +136,17 @@ func decodeExternalAddressResp(raw []byte) (*externalAddressResp, error) {
 	return p, nil
 }
 
-func newRequestMappingReq(internal, external, duration int) (*requestMappingReq, error) {
+func newRequestMappingReq(protocol base.Protocol, internal, external, duration int) (*requestMappingReq, error) {
+	var opcode uint8
+	switch protocol {
+	case base.TCP:
+		opcode = opRequestMappingTCP
+	case base.UDP:
+		opcode = opRequestMappingUDP
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
 	// 0 is allowed for all of the values when doing removal.
 	if internal < 0 || internal > math.MaxUint16 {
 		return nil, syscall.ERANGE
@@ -144,11 +158,11 @@ func newRequestMappingReq(internal, external, duration int) (*requestMappingReq,
 		return nil, syscall.ERANGE
 	}
 
-	return &requestMappingReq{internalPort: uint16(internal), externalPort: uint16(external), mappingLifetime: uint32(duration)}, nil
+	return &requestMappingReq{opcode: opcode, internalPort: uint16(internal), externalPort: uint16(external), mappingLifetime: uint32(duration)}, nil
 }
 
 func (r *requestMappingReq) op() uint8 {
-	return opRequestMappingTCP
+	return r.opcode
 }
 
 func (r *requestMappingReq) encode() []byte {
@@ -190,6 +204,14 @@ func decodeRequestMappingResp(req *requestMappingReq, raw []byte) (*requestMappi
 		return nil, fmt.Errorf("not a Request Mapping Response: %d", h.op)
 	}
 	if h.resultCode != resSuccess {
+		// Failure responses may carry the internal port, which is the only
+		// way to tell if they are for this request.  Some routers zero it.
+		if len(raw) >= 10 {
+			port := binary.BigEndian.Uint16(raw[8:10])
+			if port != 0 && port != req.internalPort {
+				return nil, fmt.Errorf("stale Request Mapping Response: %d", port)
+			}
+		}
 		return nil, resultCodeToError(h.resultCode)
 	}
 	if len(raw) != requestMappingRespLength {
@@ -207,38 +229,24 @@ func decodeRequestMappingResp(req *requestMappingReq, raw []byte) (*requestMappi
 	return p, nil
 }
 
-func resultCodeToError(code uint16) error {
-	switch code {
-	case resSuccess:
-		return nil
-	case resUnsupportedVersion:
-		return fmt.Errorf("unsupported NAT-PMP version")
-	case resNotAuthorized:
-		return fmt.Errorf("not authorized/refused")
-	case resNetworkFailure:
-		return fmt.Errorf("network failure")
-	case resOutOfResources:
-		return fmt.Errorf("out of resources")
-	case resUnsupportedOpcode:
-		return fmt.Errorf("unsupported opcode")
-	default:
-		return fmt.Errorf("unknown failure")
-	}
-}
-
-func (c *Client) issueRequest(req packetReq) (interface{}, error) {
+func (c *Client) issueRequest(ctx context.Context, req packetReq) (interface{}, error) {
 	defer c.conn.SetDeadline(time.Time{})
+	stop := base.WatchContext(ctx, c.conn)
+	defer stop()
 
 	rawReq := req.encode()
 	timeoutAt := time.Now()
 	rawRespBuf := make([]byte, maxLength)
-	for i := 0; i < maxRetries; i++ {
-		now := time.Now()
-		if timeoutAt.After(now) {
-			time.Sleep(timeoutAt.Sub(now))
+	for i := 0; i < c.opts.Retries; i++ {
+		if err := base.Sleep(ctx, time.Until(timeoutAt)); err != nil {
+			return nil, err
+		}
+		timeoutAt = time.Now().Add(c.opts.RetryTimeout << uint(i))
+		if err := c.conn.SetDeadline(base.ContextDeadline(ctx, timeoutAt)); err != nil {
+			return nil, err
 		}
-		timeoutAt = time.Now().Add(initialTimeoutDuration << uint(i))
-		if err := c.conn.SetDeadline(timeoutAt); err != nil {
+		if err := ctx.Err(); err != nil {
+			// Canceled before the new deadline was set.
 			return nil, err
 		}
 
@@ -268,15 +276,18 @@ func (c *Client) issueRequest(req packetReq) (interface{}, error) {
 			switch rawRespBuf[1] {
 			case opExternalAddress + opRespOffset:
 				return decodeExternalAddressResp(rawRespBuf[:n])
-			case opRequestMappingTCP + opRespOffset:
+			case opRequestMappingUDP + opRespOffset, opRequestMappingTCP + opRespOffset:
 				// Be tolerant of errors when decoding this response type as
 				// it is possible though extremely unlikely to get stale
-				// responses.
+				// responses, but a failure result code is an answer.
 				mReq := req.(*requestMappingReq)
 				resp, err := decodeRequestMappingResp(mReq, rawRespBuf[:n])
 				if err == nil {
 					return resp, nil
 				}
+				if isResultError(err) {
+					return nil, err
+				}
 			default:
 				// That's odd, we send a request for an opcode that we don't
 				// know how to handle responses for.
@@ -284,6 +295,9 @@ func (c *Client) issueRequest(req packetReq) (interface{}, error) {
 			}
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return nil, syscall.ETIMEDOUT
 }
 
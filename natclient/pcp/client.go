@@ -0,0 +1,410 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+// Package pcp implements a PCP (RFC 6887) client suitable for NAT traversal.
+// Routers that only speak NAT-PMP are handled by transparently falling back to
+// the natpmp package.
+package pcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/natpmp"
+)
+
+const (
+	methodName = "PCP"
+
+	pcpPort = 5351
+
+	// probePort is the internal port used for the short lived mapping that
+	// is used to discover the external address (UDP discard), when it was
+	// not learned from a previous MAP response.
+	probePort     = 9
+	probeDuration = 120
+
+	// probeDeleteTimeout bounds the removal of the probe mapping, which is
+	// done even if the caller's context is done, so that it is not left
+	// behind on the router.
+	probeDeleteTimeout = 5 * time.Second
+)
+
+// ClientFactory is a PCP ClientFactory.  The zero value talks to the default
+// gateway.
+type ClientFactory struct {
+	// GatewayAddr, if set, is the "host:port" of the PCP server to use
+	// instead of the default gateway.  It is also used when falling back to
+	// NAT-PMP (Eg: with a natpmptest.Server).
+	GatewayAddr string
+}
+
+func (f *ClientFactory) gatewayAddr(opts *base.Options) (*net.UDPAddr, error) {
+	if f.GatewayAddr != "" {
+		return net.ResolveUDPAddr("udp4", f.GatewayAddr)
+	}
+	gwAddr, err := natpmp.LookupGateway(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: gwAddr, Port: pcpPort}, nil
+}
+
+func (f *ClientFactory) Name() string {
+	return methodName
+}
+
+func (f *ClientFactory) New(opts *base.Options) (base.Client, error) {
+	return f.NewContext(context.Background(), opts)
+}
+
+func (f *ClientFactory) NewContext(ctx context.Context, opts *base.Options) (base.Client, error) {
+	c := &Client{nonces: make(map[mappingKey][nonceLength]byte)}
+	c.setOptions(opts)
+	_, srcAddr, err := c.opts.LocalInterface()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := f.gatewayAddr(&c.opts)
+	if err != nil {
+		return nil, err
+	}
+	c.gwAddr = addr.IP
+	c.logf(base.LevelInfo, base.OpDiscover, "gwAddr is %s\n", c.gwAddr)
+
+	// Initialize the UDP socket here.
+	var localAddr *net.UDPAddr
+	if srcAddr != nil {
+		localAddr = &net.UDPAddr{IP: srcAddr}
+	}
+	c.conn, err = net.DialUDP("udp4", localAddr, addr)
+	if err != nil {
+		c.logf(base.LevelWarn, base.OpDiscover, "failed to connect to router: %s\n", err)
+		return nil, err
+	}
+	tmp := c.conn.LocalAddr().(*net.UDPAddr)
+	c.internalAddr = tmp.IP
+	c.logf(base.LevelInfo, base.OpDiscover, "local IP is %s\n", c.internalAddr)
+
+	// Check that the router actually supports PCP.  This is done with an
+	// ANNOUNCE and not a MAP, so that discovery does not create a mapping
+	// on the router.
+	if err = c.announce(ctx); err != nil {
+		c.conn.Close()
+		if c.opts.Cache != nil && ctx.Err() == nil {
+			c.opts.Cache.Remove(methodName)
+		}
+		if errors.Is(err, ErrUnsupportedVersion) {
+			// RFC 6887 Section 9: Fall back to NAT-PMP if the router
+			// indicates that it only speaks version 0.
+			c.logf(base.LevelInfo, base.OpDiscover, "router does not support PCP version %d, falling back to NAT-PMP\n", version)
+			return (&natpmp.ClientFactory{GatewayAddr: f.GatewayAddr}).NewContext(ctx, opts)
+		}
+		return nil, err
+	}
+	if c.opts.Cache != nil {
+		e := &base.CacheEntry{Backend: methodName, LocalAddr: c.internalAddr}
+		if err = c.opts.Cache.Store(e); err != nil {
+			c.logf(base.LevelWarn, base.OpDiscover, "failed to update the discovery cache: %s\n", err)
+		}
+	}
+	return c, nil
+}
+
+// Client is a PCP client instance.
+type Client struct {
+	opts         base.Options
+	conn         *net.UDPConn
+	internalAddr net.IP
+	gwAddr       net.IP
+	extAddr      net.IP
+
+	// nonces are the mapping nonces, indexed by protocol and internal port.
+	// The same nonce must be used to refresh or delete a mapping.
+	nonces map[mappingKey][nonceLength]byte
+}
+
+type mappingKey struct {
+	protocol     base.Protocol
+	internalPort int
+}
+
+func (c *Client) nonceFor(k mappingKey) ([nonceLength]byte, error) {
+	if n, ok := c.nonces[k]; ok {
+		return n, nil
+	}
+	n, err := newNonce()
+	if err != nil {
+		return n, err
+	}
+	c.nonces[k] = n
+	return n, nil
+}
+
+// MappingNonce returns the nonce of the mapping for the given protocol and
+// internal port, or nil if there is none.
+func (c *Client) MappingNonce(protocol base.Protocol, internalPort int) []byte {
+	n, ok := c.nonces[mappingKey{protocol, internalPort}]
+	if !ok {
+		return nil
+	}
+	return n[:]
+}
+
+// SetMappingNonce sets the nonce that is used for the mapping for the given
+// protocol and internal port, so that a mapping that was created by another
+// Client (Eg: a previous run of the helper) can be refreshed or removed.
+func (c *Client) SetMappingNonce(protocol base.Protocol, internalPort int, nonce []byte) error {
+	var n [nonceLength]byte
+	if len(nonce) != nonceLength {
+		return fmt.Errorf("invalid nonce length: %d", len(nonce))
+	}
+	copy(n[:], nonce)
+	c.nonces[mappingKey{protocol, internalPort}] = n
+	return nil
+}
+
+func (c *Client) requestMapping(ctx context.Context, protocol base.Protocol, internalPort, externalPort, duration int) (*mapResp, error) {
+	nonce, err := c.nonceFor(mappingKey{protocol, internalPort})
+	if err != nil {
+		return nil, err
+	}
+	req, err := newMapReq(c.internalAddr, nonce, protocol, internalPort, externalPort, duration)
+	if err != nil {
+		return nil, err
+	}
+	var resp *mapResp
+	err = c.issueRequest(ctx, req.encode(), func(raw []byte) (err error) {
+		resp, err = decodeMapResp(req, raw)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every MAP response carries the external address, so there is no need
+	// to ask for it separately once a mapping has been made.
+	if !resp.externalAddr.IsUnspecified() {
+		c.extAddr = resp.externalAddr
+	}
+	return resp, nil
+}
+
+// announce checks that the router speaks PCP, without creating any state on
+// it, with an ANNOUNCE request (RFC 6887 Section 14.1).
+func (c *Client) announce(ctx context.Context) error {
+	err := c.issueRequest(ctx, encodeAnnounceReq(c.internalAddr), decodeAnnounceResp)
+	if errors.Is(err, errUnsuppOpcode) {
+		// ANNOUNCE is mandatory, but the router clearly speaks PCP, which
+		// is all that this is trying to find out.
+		c.logf(base.LevelDebug, base.OpDiscover, "router does not support ANNOUNCE\n")
+		return nil
+	}
+	return err
+}
+
+// AddPortMapping adds a new port mapping for the given protocol.  The internal
+// IP address of the client is used as the destination.  A 0 duration will
+// request a 7200 second lease.
+func (c *Client) AddPortMapping(description string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	return c.AddPortMappingContext(context.Background(), description, protocol, internalPort, externalPort, duration)
+}
+
+// AddPortMappingContext adds a new port mapping for the given protocol.
+func (c *Client) AddPortMappingContext(ctx context.Context, description string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	if description == "" {
+		description = c.opts.Description
+	}
+	if duration == 0 {
+		duration = defaultMappingDuration
+	}
+
+	c.logf(base.LevelDebug, "AddPortMapping", "AddPortMapping: %s:%d <-> 0.0.0.0:%d %s (%d sec)\n", c.internalAddr, internalPort, externalPort, protocol, duration)
+
+	resp, err := c.requestMapping(ctx, protocol, internalPort, externalPort, duration)
+	if err != nil {
+		c.logf(base.LevelWarn, "AddPortMapping", "failed to create MAP request: %s\n", err)
+		return nil, err
+	}
+	// Check that resp.externalPort = externalPort, or is an acceptable
+	// alternative.
+	if int(resp.externalPort) == externalPort || c.opts.AcceptsAlternatePort(int(resp.externalPort)) {
+		if int(resp.externalPort) != externalPort {
+			c.logf(base.LevelInfo, "AddPortMapping", "router mapped external port %d in place of %d\n", resp.externalPort, externalPort)
+		}
+		c.logf(base.LevelInfo, "AddPortMapping", "router granted a %d sec lease\n", resp.lifetime)
+		m := &base.PortMapping{
+			Description:   description,
+			InternalIP:    c.internalAddr,
+			InternalPort:  int(resp.internalPort),
+			ExternalPort:  int(resp.externalPort),
+			Protocol:      protocol,
+			Enabled:       true,
+			LeaseDuration: int(resp.lifetime),
+		}
+		return m, nil
+	}
+
+	// There was a conflict, and the router picked a different port than
+	// requested.  Undo the mapping that isn't exactly what we wanted.
+	c.DeletePortMappingContext(ctx, protocol, internalPort, int(resp.externalPort))
+
+	c.logf(base.LevelInfo, "AddPortMapping", "router mapped a different external port than requested: %d\n", resp.externalPort)
+	return nil, &base.Error{Protocol: methodName, Category: base.CategoryConflict, Err: fmt.Errorf("router mapped a different external port than requested")}
+}
+
+// DeletePortMapping removes an existing port forwarding entry for the given
+// protocol between clientIP:internalPort and 0.0.0.0:externalPort.  Only
+// mappings that were created by this Client (or whose nonce was set with
+// SetMappingNonce) can be removed, as the router requires the mapping nonce
+// to match.
+func (c *Client) DeletePortMapping(protocol base.Protocol, internalPort, externalPort int) error {
+	return c.DeletePortMappingContext(context.Background(), protocol, internalPort, externalPort)
+}
+
+// DeletePortMappingContext removes an existing port forwarding entry.
+func (c *Client) DeletePortMappingContext(ctx context.Context, protocol base.Protocol, internalPort, externalPort int) error {
+	c.logf(base.LevelDebug, "DeletePortMapping", "DeletePortMapping: %s:%d <-> 0.0.0.0:%d %s\n", c.internalAddr, internalPort, externalPort, protocol)
+
+	_, err := c.requestMapping(ctx, protocol, internalPort, 0, 0)
+	if err == nil {
+		delete(c.nonces, mappingKey{protocol, internalPort})
+	}
+	return err
+}
+
+// GetExternalIPAddress queries the router's external IP address.  PCP does not
+// have a dedicated opcode for this, so the address is learned from the
+// responses to port mapping requests.  If none have been made yet, a short
+// lived mapping is created and immediately deleted.
+func (c *Client) GetExternalIPAddress() (net.IP, error) {
+	return c.GetExternalIPAddressContext(context.Background())
+}
+
+// GetExternalIPAddressContext queries the router's external IP address.
+func (c *Client) GetExternalIPAddressContext(ctx context.Context) (net.IP, error) {
+	if c.extAddr != nil {
+		c.logf(base.LevelDebug, "GetExternalIPAddress", "using cached external address: %s\n", c.extAddr)
+		return c.extAddr, nil
+	}
+
+	c.logf(base.LevelDebug, "GetExternalIPAddress", "querying external address\n")
+
+	resp, err := c.requestMapping(ctx, base.UDP, probePort, 0, probeDuration)
+	if err != nil {
+		c.logf(base.LevelWarn, "GetExternalIPAddress", "failed to query external address: %s\n", err)
+		return nil, err
+	}
+	delCtx, cancel := context.WithTimeout(context.Background(), probeDeleteTimeout)
+	defer cancel()
+	if err = c.DeletePortMappingContext(delCtx, base.UDP, probePort, int(resp.externalPort)); err != nil {
+		c.logf(base.LevelWarn, "GetExternalIPAddress", "failed to remove probe mapping: %s\n", err)
+	}
+	return resp.externalAddr, nil
+}
+
+func (c *Client) setOptions(opts *base.Options) {
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Retries <= 0 {
+		c.opts.Retries = maxRetries
+	}
+	if c.opts.RetryTimeout <= 0 {
+		c.opts.RetryTimeout = initialTimeoutDuration
+	}
+}
+
+// Router returns a description of the gateway.
+func (c *Client) Router() *base.Router {
+	return &base.Router{
+		Backend:   methodName,
+		Address:   c.gwAddr.String(),
+		LocalAddr: c.internalAddr,
+	}
+}
+
+func (c *Client) Vlogf(f string, a ...interface{}) {
+	c.logf(base.LevelDebug, "", f, a...)
+}
+
+// logf logs a message about op to the Logger in the options.
+func (c *Client) logf(level base.Level, op, f string, a ...interface{}) {
+	base.Logf(&c.opts, level, methodName, op, f, a...)
+}
+
+// OpenIPv6Pinhole opens an inbound IPv6 firewall pinhole.  This is not
+// supported by this backend.
+func (c *Client) OpenIPv6Pinhole(protocol base.Protocol, internalPort, duration int) (*base.Pinhole, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// OpenIPv6PinholeContext opens an inbound IPv6 firewall pinhole.  This is not
+// supported by this backend.
+func (c *Client) OpenIPv6PinholeContext(ctx context.Context, protocol base.Protocol, internalPort, duration int) (*base.Pinhole, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// RenewIPv6Pinhole extends the lease of an IPv6 firewall pinhole.  This is
+// not supported by this backend.
+func (c *Client) RenewIPv6Pinhole(uniqueID, duration int) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+// RenewIPv6PinholeContext extends the lease of an IPv6 firewall pinhole.
+// This is not supported by this backend.
+func (c *Client) RenewIPv6PinholeContext(ctx context.Context, uniqueID, duration int) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+// CloseIPv6Pinhole closes an IPv6 firewall pinhole.  This is not supported by
+// this backend.
+func (c *Client) CloseIPv6Pinhole(uniqueID int) error {
+	return syscall.ENOTSUP
+}
+
+// CloseIPv6PinholeContext closes an IPv6 firewall pinhole.  This is not
+// supported by this backend.
+func (c *Client) CloseIPv6PinholeContext(ctx context.Context, uniqueID int) error {
+	return syscall.ENOTSUP
+}
+
+// GetListOfPortMappings queries the router for the list of port forwarding
+// entries.
+func (c *Client) GetListOfPortMappings() ([]base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// GetListOfPortMappingsContext queries the router for the list of port
+// forwarding entries.  This is not supported by this backend.
+func (c *Client) GetListOfPortMappingsContext(ctx context.Context) ([]base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// GetPortMapping queries the router for the port forwarding entry for the
+// given protocol and external port.
+func (c *Client) GetPortMapping(protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// GetPortMappingContext queries the router for the port forwarding entry for
+// the given protocol and external port.  This is not supported by this
+// backend, since a MAP request refreshes (or with a zero lifetime, deletes)
+// the mapping that it asks about.
+func (c *Client) GetPortMappingContext(ctx context.Context, protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+var _ base.ClientFactory = (*ClientFactory)(nil)
+var _ base.Client = (*Client)(nil)
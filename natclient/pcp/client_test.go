@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package pcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/natpmp/natpmptest"
+)
+
+// testServer is a minimal PCP server, that answers ANNOUNCE requests, and
+// grants every MAP request exactly as asked.
+type testServer struct {
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+
+	lock sync.Mutex
+	reqs []mapReq
+	ops  []uint8
+}
+
+var testExtIP = net.IPv4(198, 51, 100, 1)
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	s := &testServer{conn: conn}
+	s.wg.Add(1)
+	go s.worker()
+	return s
+}
+
+func (s *testServer) worker() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxLength)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		raw := buf[:n]
+		if n < hdrLength {
+			continue
+		}
+		s.lock.Lock()
+		s.ops = append(s.ops, raw[1])
+		s.lock.Unlock()
+
+		switch {
+		case raw[1] == opAnnounce:
+			resp := make([]byte, hdrLength)
+			resp[0] = version
+			resp[1] = opAnnounce | opRespFlag
+			s.conn.WriteToUDP(resp, addr)
+		case raw[1] == opMap && n == mapReqLength:
+			req := &mapReq{protocol: raw[36]}
+			copy(req.nonce[:], raw[24:36])
+			req.lifetime = binary.BigEndian.Uint32(raw[4:8])
+			req.internalPort = binary.BigEndian.Uint16(raw[40:42])
+			req.externalPort = binary.BigEndian.Uint16(raw[42:44])
+			if req.externalPort == 0 {
+				req.externalPort = req.internalPort
+			}
+			s.lock.Lock()
+			s.reqs = append(s.reqs, *req)
+			s.lock.Unlock()
+			s.conn.WriteToUDP(mapRespFor(req, resSuccess), addr)
+		}
+	}
+}
+
+func (s *testServer) mapRequests() []mapReq {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]mapReq(nil), s.reqs...)
+}
+
+func (s *testServer) opcodes() []uint8 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]uint8(nil), s.ops...)
+}
+
+func (s *testServer) Close() {
+	s.conn.Close()
+	s.wg.Wait()
+}
+
+func TestDiscovery(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	f := &ClientFactory{GatewayAddr: s.conn.LocalAddr().String()}
+	c, err := f.New(nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	defer c.Close()
+	if r := c.Router(); r.Backend != methodName {
+		t.Errorf("Router().Backend = %s", r.Backend)
+	}
+
+	// Discovery must not create a mapping on the router.
+	if ops := s.opcodes(); len(ops) != 1 || ops[0] != opAnnounce {
+		t.Errorf("discovery sent opcodes %v, want just ANNOUNCE", ops)
+	}
+
+	// The external address is learned from the MAP response.
+	if _, err = c.AddPortMapping("", base.TCP, 9001, 9001, 3600); err != nil {
+		t.Fatalf("AddPortMapping() failed: %s", err)
+	}
+	ip, err := c.GetExternalIPAddress()
+	if err != nil {
+		t.Fatalf("GetExternalIPAddress() failed: %s", err)
+	}
+	if !ip.Equal(testExtIP) {
+		t.Errorf("GetExternalIPAddress() = %s, want %s", ip, testExtIP)
+	}
+	if reqs := s.mapRequests(); len(reqs) != 1 {
+		t.Errorf("router got %d MAP requests, want 1", len(reqs))
+	}
+}
+
+func TestGetExternalIPAddressProbe(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	f := &ClientFactory{GatewayAddr: s.conn.LocalAddr().String()}
+	c, err := f.New(nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	defer c.Close()
+
+	// Without a previous mapping, a short lived one is made, and removed.
+	for i := 0; i < 2; i++ {
+		ip, err := c.GetExternalIPAddress()
+		if err != nil {
+			t.Fatalf("GetExternalIPAddress() failed: %s", err)
+		}
+		if !ip.Equal(testExtIP) {
+			t.Errorf("GetExternalIPAddress() = %s, want %s", ip, testExtIP)
+		}
+	}
+	reqs := s.mapRequests()
+	if len(reqs) != 2 || reqs[0].lifetime == 0 || reqs[1].lifetime != 0 || reqs[0].internalPort != reqs[1].internalPort {
+		t.Errorf("router got MAP requests %+v, want one create and one delete", reqs)
+	}
+}
+
+func TestUnsupportedVersionFallback(t *testing.T) {
+	s, err := natpmptest.New(nil)
+	if err != nil {
+		t.Fatalf("natpmptest.New() failed: %s", err)
+	}
+	defer s.Close()
+
+	// RFC 6887 Section 9: A NAT-PMP only router answers with UNSUPP_VERSION,
+	// and NAT-PMP is used instead.
+	f := &ClientFactory{GatewayAddr: s.Addr()}
+	c, err := f.New(nil)
+	if err != nil {
+		t.Fatalf("New() failed: %s", err)
+	}
+	defer c.Close()
+	if r := c.Router(); r.Backend != "NAT-PMP" {
+		t.Fatalf("Router().Backend = %s, want NAT-PMP", r.Backend)
+	}
+	if _, err = c.AddPortMapping("", base.UDP, 9001, 9001, 3600); err != nil {
+		t.Fatalf("AddPortMapping() failed: %s", err)
+	}
+	if ms := s.Mappings(); len(ms) != 1 || ms[0].InternalPort != 9001 {
+		t.Errorf("gateway has mappings %+v", ms)
+	}
+}
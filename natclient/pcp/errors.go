@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package pcp
+
+import (
+	"errors"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// Non-zero result codes are returned as *base.Error.
+
+type resultInfo struct {
+	name     string // From RFC 6887 Section 7.4.
+	msg      string
+	category base.Category
+}
+
+var results = map[int]resultInfo{
+	resUnsuppVersion:         {"UNSUPP_VERSION", "unsupported PCP version", base.CategoryUnsupported},
+	resNotAuthorized:         {"NOT_AUTHORIZED", "not authorized/refused", base.CategoryUnauthorized},
+	resMalformedRequest:      {"MALFORMED_REQUEST", "malformed request", base.CategoryUnknown},
+	resUnsuppOpcode:          {"UNSUPP_OPCODE", "unsupported opcode", base.CategoryUnsupported},
+	resUnsuppOption:          {"UNSUPP_OPTION", "unsupported option", base.CategoryUnsupported},
+	resMalformedOption:       {"MALFORMED_OPTION", "malformed option", base.CategoryUnknown},
+	resNetworkFailure:        {"NETWORK_FAILURE", "network failure", base.CategoryTransient},
+	resNoResources:           {"NO_RESOURCES", "out of resources", base.CategoryResource},
+	resUnsuppProtocol:        {"UNSUPP_PROTOCOL", "unsupported protocol", base.CategoryUnsupported},
+	resUserExQuota:           {"USER_EX_QUOTA", "user exceeded quota", base.CategoryResource},
+	resCannotProvideExternal: {"CANNOT_PROVIDE_EXTERNAL", "cannot provide external address/port", base.CategoryConflict},
+	resAddressMismatch:       {"ADDRESS_MISMATCH", "client address mismatch", base.CategoryUnknown},
+	resExcessiveRemotePeers:  {"EXCESSIVE_REMOTE_PEERS", "excessive remote peers", base.CategoryResource},
+}
+
+func newError(code int) *base.Error {
+	info, ok := results[code]
+	if !ok {
+		info = resultInfo{"", "unknown failure", base.CategoryUnknown}
+	}
+	return &base.Error{Protocol: methodName, Code: code, Name: info.name, Category: info.category, Err: errors.New(info.msg)}
+}
+
+// Sentinels for the more interesting PCP result codes, for use with
+// errors.Is.  ErrUnsupportedVersion is also returned when a NAT-PMP only
+// router responds.
+var (
+	ErrUnsupportedVersion    = newError(resUnsuppVersion)
+	ErrNotAuthorized         = newError(resNotAuthorized)
+	ErrNetworkFailure        = newError(resNetworkFailure)
+	ErrNoResources           = newError(resNoResources)
+	ErrUnsuppProtocol        = newError(resUnsuppProtocol)
+	ErrUserExQuota           = newError(resUserExQuota)
+	ErrCannotProvideExternal = newError(resCannotProvideExternal)
+
+	errUnsuppOpcode = newError(resUnsuppOpcode)
+)
+
+func resultCodeToError(code uint8) error {
+	switch code {
+	case resSuccess:
+		return nil
+	case resUnsuppVersion:
+		return ErrUnsupportedVersion
+	}
+	return newError(int(code))
+}
+
+func isStale(err error) bool {
+	// Errors that do not originate from the router's result code, and that
+	// indicate that the response was for some other request.
+	if err == nil {
+		return false
+	}
+	var e *base.Error
+	return !errors.As(err, &e)
+}
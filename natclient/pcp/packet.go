@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package pcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"syscall"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	version       = 2
+	natpmpVersion = 0
+
+	opAnnounce = 0
+	opMap      = 1
+	opRespFlag = 0x80
+
+	protoTCP = 6
+	protoUDP = 17
+
+	resSuccess               = 0
+	resUnsuppVersion         = 1
+	resNotAuthorized         = 2
+	resMalformedRequest      = 3
+	resUnsuppOpcode          = 4
+	resUnsuppOption          = 5
+	resMalformedOption       = 6
+	resNetworkFailure        = 7
+	resNoResources           = 8
+	resUnsuppProtocol        = 9
+	resUserExQuota           = 10
+	resCannotProvideExternal = 11
+	resAddressMismatch       = 12
+	resExcessiveRemotePeers  = 13
+
+	maxLength       = 1100
+	hdrLength       = 24
+	nonceLength     = 12
+	mapOpLength     = 36
+	mapReqLength    = hdrLength + mapOpLength
+	mapRespLength   = hdrLength + mapOpLength
+	natpmpHdrLength = 4
+
+	defaultMappingDuration = 7200
+	initialTimeoutDuration = 250 * time.Millisecond
+	maxRetries             = 3 // Spec says retransmit forever, but too long
+)
+
+type mapReq struct {
+	lifetime     uint32
+	clientAddr   net.IP
+	nonce        [nonceLength]byte
+	protocol     uint8
+	internalPort uint16
+	externalPort uint16
+	externalAddr net.IP
+}
+
+type mapResp struct {
+	resultCode   uint8
+	lifetime     uint32
+	epochTime    uint32
+	protocol     uint8
+	internalPort uint16
+	externalPort uint16
+	externalAddr net.IP
+}
+
+func newNonce() (nonce [nonceLength]byte, err error) {
+	_, err = rand.Read(nonce[:])
+	return
+}
+
+func newMapReq(clientAddr net.IP, nonce [nonceLength]byte, protocol base.Protocol, internal, external, duration int) (*mapReq, error) {
+	var proto uint8
+	switch protocol {
+	case base.TCP:
+		proto = protoTCP
+	case base.UDP:
+		proto = protoUDP
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+
+	// 0 is allowed for the external port and duration when doing removal.
+	if internal <= 0 || internal > math.MaxUint16 {
+		return nil, syscall.ERANGE
+	}
+	if external < 0 || external > math.MaxUint16 {
+		return nil, syscall.ERANGE
+	}
+	if duration < 0 || int64(duration) > math.MaxUint32 {
+		return nil, syscall.ERANGE
+	}
+
+	r := &mapReq{
+		lifetime:     uint32(duration),
+		clientAddr:   clientAddr,
+		nonce:        nonce,
+		protocol:     proto,
+		internalPort: uint16(internal),
+		externalPort: uint16(external),
+		externalAddr: net.IPv4zero,
+	}
+	return r, nil
+}
+
+func (r *mapReq) encode() []byte {
+	//   0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |  Version = 2  |R|   Opcode    |         Reserved              |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                 Requested Lifetime (32 bits)                  |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                                                               |
+	// |            PCP Client's IP Address (128 bits)                 |
+	// |                                                               |
+	// |                                                               |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                                                               |
+	// |                 Mapping Nonce (96 bits)                       |
+	// |                                                               |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |   Protocol    |          Reserved (24 bits)                   |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |        Internal Port          |    Suggested External Port    |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                                                               |
+	// |           Suggested External IP Address (128 bits)            |
+	// |                                                               |
+	// |                                                               |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	raw := make([]byte, mapReqLength)
+	raw[0] = version
+	raw[1] = opMap
+	binary.BigEndian.PutUint32(raw[4:8], r.lifetime)
+	copy(raw[8:24], r.clientAddr.To16())
+	copy(raw[24:36], r.nonce[:])
+	raw[36] = r.protocol
+	binary.BigEndian.PutUint16(raw[40:42], r.internalPort)
+	binary.BigEndian.PutUint16(raw[42:44], r.externalPort)
+	copy(raw[44:60], r.externalAddr.To16())
+	return raw
+}
+
+func encodeAnnounceReq(clientAddr net.IP) []byte {
+	// An ANNOUNCE request is just the common request header, with a 0
+	// lifetime (RFC 6887 Section 14.1).
+	raw := make([]byte, hdrLength)
+	raw[0] = version
+	raw[1] = opAnnounce
+	copy(raw[8:24], clientAddr.To16())
+	return raw
+}
+
+// decodeHdr validates the common response header, and returns the result
+// code.
+func decodeHdr(raw []byte, opcode uint8) (uint8, error) {
+	if len(raw) < natpmpHdrLength {
+		return 0, fmt.Errorf("packet too short to contain header: %d", len(raw))
+	}
+	if raw[0] == natpmpVersion {
+		// RFC 6887 Section 9: A NAT-PMP only server will respond with a
+		// NAT-PMP UNSUPP_VERSION response.
+		return 0, ErrUnsupportedVersion
+	}
+	if len(raw) < hdrLength {
+		return 0, fmt.Errorf("packet too short to contain header: %d", len(raw))
+	}
+	if raw[1] != opcode|opRespFlag {
+		return 0, fmt.Errorf("unexpected opcode: %d", raw[1])
+	}
+	if raw[3] == resUnsuppVersion {
+		// The server's highest supported version is in the version field.
+		return 0, ErrUnsupportedVersion
+	}
+	if raw[0] != version {
+		return 0, fmt.Errorf("unexpected PCP version: %d", raw[0])
+	}
+	return raw[3], nil
+}
+
+func decodeAnnounceResp(raw []byte) error {
+	resultCode, err := decodeHdr(raw, opAnnounce)
+	if err != nil {
+		return err
+	}
+	return resultCodeToError(resultCode)
+}
+
+func decodeMapResp(req *mapReq, raw []byte) (*mapResp, error) {
+	//   0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |  Version = 2  |R|   Opcode    |   Reserved    |  Result Code  |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                      Lifetime (32 bits)                       |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                     Epoch Time (32 bits)                      |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |                                                               |
+	// |                      Reserved (96 bits)                       |
+	// |                                                               |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// :                                                               :
+	// :             (MAP opcode-specific response data)               :
+	// :                                                               :
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	resultCode, err := decodeHdr(raw, opMap)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < mapRespLength {
+		return nil, fmt.Errorf("invalid packet length: %d", len(raw))
+	}
+
+	// Validate that the response corresponds to the request before looking
+	// at the result code, so that stale responses can be discarded.
+	if !bytes.Equal(raw[24:36], req.nonce[:]) {
+		return nil, fmt.Errorf("stale MAP Response: nonce mismatch")
+	}
+	p := &mapResp{}
+	p.resultCode = resultCode
+	p.lifetime = binary.BigEndian.Uint32(raw[4:8])
+	p.epochTime = binary.BigEndian.Uint32(raw[8:12])
+	p.protocol = raw[36]
+	p.internalPort = binary.BigEndian.Uint16(raw[40:42])
+	p.externalPort = binary.BigEndian.Uint16(raw[42:44])
+	p.externalAddr = net.IP(append([]byte{}, raw[44:60]...))
+	if v4 := p.externalAddr.To4(); v4 != nil {
+		// IPv4 addresses are sent IPv4-mapped.
+		p.externalAddr = v4
+	}
+	if req.protocol != p.protocol || req.internalPort != p.internalPort {
+		return nil, fmt.Errorf("stale MAP Response: %d/%d", p.protocol, p.internalPort)
+	}
+	if p.resultCode != resSuccess {
+		return nil, resultCodeToError(p.resultCode)
+	}
+	return p, nil
+}
+
+// issueRequest sends rawReq, retransmitting as needed, until decode accepts a
+// response or fails with a result code.
+func (c *Client) issueRequest(ctx context.Context, rawReq []byte, decode func(raw []byte) error) error {
+	defer c.conn.SetDeadline(time.Time{})
+	stop := base.WatchContext(ctx, c.conn)
+	defer stop()
+
+	timeoutAt := time.Now()
+	rawRespBuf := make([]byte, maxLength)
+	for i := 0; i < c.opts.Retries; i++ {
+		if err := base.Sleep(ctx, time.Until(timeoutAt)); err != nil {
+			return err
+		}
+		timeoutAt = time.Now().Add(c.opts.RetryTimeout << uint(i))
+		if err := c.conn.SetDeadline(base.ContextDeadline(ctx, timeoutAt)); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			// Canceled before the new deadline was set.
+			return err
+		}
+
+		if _, err := c.conn.Write(rawReq); err != nil {
+			if nerr, ok := err.(net.Error); ok {
+				if nerr.Temporary() || nerr.Timeout() {
+					continue
+				}
+			}
+			return err
+		}
+
+		for {
+			n, err := c.conn.Read(rawRespBuf)
+			if err != nil {
+				break
+			}
+
+			// Be tolerant of errors when decoding the response as it is
+			// possible to get stale responses, or responses to other
+			// requests.
+			err = decode(rawRespBuf[:n])
+			if isStale(err) {
+				continue
+			}
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return syscall.ETIMEDOUT
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package pcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+var testNonce = [nonceLength]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+func newTestMapReq(t *testing.T) *mapReq {
+	t.Helper()
+	req, err := newMapReq(net.IPv4(192, 168, 1, 2), testNonce, base.TCP, 9001, 9002, 3600)
+	if err != nil {
+		t.Fatalf("newMapReq() failed: %s", err)
+	}
+	return req
+}
+
+// mapRespFor builds the MAP response that a router would send to req.
+func mapRespFor(req *mapReq, resultCode uint8) []byte {
+	raw := make([]byte, mapRespLength)
+	raw[0] = version
+	raw[1] = opMap | opRespFlag
+	raw[3] = resultCode
+	binary.BigEndian.PutUint32(raw[4:8], req.lifetime)
+	binary.BigEndian.PutUint32(raw[8:12], 1234)
+	copy(raw[24:36], req.nonce[:])
+	raw[36] = req.protocol
+	binary.BigEndian.PutUint16(raw[40:42], req.internalPort)
+	binary.BigEndian.PutUint16(raw[42:44], req.externalPort)
+	copy(raw[44:60], net.IPv4(198, 51, 100, 1).To16())
+	return raw
+}
+
+func TestMapReqEncode(t *testing.T) {
+	raw := newTestMapReq(t).encode()
+	if len(raw) != mapReqLength {
+		t.Fatalf("encode() returned %d bytes, want %d", len(raw), mapReqLength)
+	}
+	if raw[0] != version || raw[1] != opMap {
+		t.Errorf("encode() header is %d/%d", raw[0], raw[1])
+	}
+	if lifetime := binary.BigEndian.Uint32(raw[4:8]); lifetime != 3600 {
+		t.Errorf("encode() lifetime is %d", lifetime)
+	}
+	if ip := net.IP(raw[8:24]); !ip.Equal(net.IPv4(192, 168, 1, 2)) || ip.To4() == nil {
+		t.Errorf("encode() client address is %s, want it IPv4-mapped", ip)
+	}
+	if !bytes.Equal(raw[24:36], testNonce[:]) {
+		t.Errorf("encode() nonce is %x", raw[24:36])
+	}
+	if raw[36] != protoTCP {
+		t.Errorf("encode() protocol is %d", raw[36])
+	}
+	if in, ext := binary.BigEndian.Uint16(raw[40:42]), binary.BigEndian.Uint16(raw[42:44]); in != 9001 || ext != 9002 {
+		t.Errorf("encode() ports are %d/%d", in, ext)
+	}
+	if ip := net.IP(raw[44:60]); !ip.Equal(net.IPv4zero) {
+		t.Errorf("encode() suggested external address is %s", ip)
+	}
+}
+
+func TestNewMapReqInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name                         string
+		internal, external, duration int
+	}{
+		{"internal port 0", 0, 9001, 3600},
+		{"internal port too large", 65536, 9001, 3600},
+		{"external port negative", 9001, -1, 3600},
+		{"external port too large", 9001, 65536, 3600},
+		{"negative duration", 9001, 9001, -1},
+	} {
+		if _, err := newMapReq(net.IPv4(192, 168, 1, 2), testNonce, base.UDP, tc.internal, tc.external, tc.duration); err != syscall.ERANGE {
+			t.Errorf("%s: newMapReq() error %v is not ERANGE", tc.name, err)
+		}
+	}
+	if _, err := newMapReq(net.IPv4(192, 168, 1, 2), testNonce, base.Protocol(2), 9001, 9001, 3600); err == nil {
+		t.Errorf("newMapReq() succeeded for %s", base.Protocol(2))
+	}
+}
+
+func TestDecodeMapResp(t *testing.T) {
+	req := newTestMapReq(t)
+	resp, err := decodeMapResp(req, mapRespFor(req, resSuccess))
+	if err != nil {
+		t.Fatalf("decodeMapResp() failed: %s", err)
+	}
+	if resp.lifetime != 3600 || resp.epochTime != 1234 || resp.protocol != protoTCP ||
+		resp.internalPort != 9001 || resp.externalPort != 9002 {
+		t.Errorf("decodeMapResp() returned %+v", resp)
+	}
+	if !resp.externalAddr.Equal(net.IPv4(198, 51, 100, 1)) || len(resp.externalAddr) != net.IPv4len {
+		t.Errorf("decodeMapResp() external address is %#v", resp.externalAddr)
+	}
+}
+
+func TestDecodeMapRespStale(t *testing.T) {
+	// Responses that are not for the request must be discarded (isStale),
+	// and not treated as the router's answer.
+	for _, tc := range []struct {
+		name   string
+		mangle func(raw []byte) []byte
+	}{
+		{"nonce mismatch", func(raw []byte) []byte { raw[24]++; return raw }},
+		{"internal port mismatch", func(raw []byte) []byte { raw[41]++; return raw }},
+		{"protocol mismatch", func(raw []byte) []byte { raw[36] = protoUDP; return raw }},
+		{"ANNOUNCE response", func(raw []byte) []byte { raw[1] = opAnnounce | opRespFlag; return raw }},
+		{"request", func(raw []byte) []byte { raw[1] = opMap; return raw }},
+		{"unknown version", func(raw []byte) []byte { raw[0] = version + 1; return raw }},
+		{"truncated header", func(raw []byte) []byte { return raw[:hdrLength-1] }},
+		{"truncated body", func(raw []byte) []byte { return raw[:mapRespLength-1] }},
+		{"nonce mismatch with an error", func(raw []byte) []byte { raw[3] = resNotAuthorized; raw[24]++; return raw }},
+	} {
+		req := newTestMapReq(t)
+		_, err := decodeMapResp(req, tc.mangle(mapRespFor(req, resSuccess)))
+		if !isStale(err) {
+			t.Errorf("%s: decodeMapResp() error %v is not stale", tc.name, err)
+		}
+	}
+}
+
+func TestDecodeMapRespResultCode(t *testing.T) {
+	for _, tc := range []struct {
+		code     uint8
+		sentinel error
+		category base.Category
+	}{
+		{resNotAuthorized, ErrNotAuthorized, base.CategoryUnauthorized},
+		{resNoResources, ErrNoResources, base.CategoryResource},
+		{resUserExQuota, ErrUserExQuota, base.CategoryResource},
+		{resCannotProvideExternal, ErrCannotProvideExternal, base.CategoryConflict},
+		{resNetworkFailure, ErrNetworkFailure, base.CategoryTransient},
+		{200, nil, base.CategoryUnknown},
+	} {
+		req := newTestMapReq(t)
+		_, err := decodeMapResp(req, mapRespFor(req, tc.code))
+		var e *base.Error
+		if !errors.As(err, &e) || e.Code != int(tc.code) {
+			t.Errorf("result %d: decodeMapResp() error %v does not carry the code", tc.code, err)
+			continue
+		}
+		if isStale(err) {
+			t.Errorf("result %d: decodeMapResp() error %v is stale", tc.code, err)
+		}
+		if tc.sentinel != nil && !errors.Is(err, tc.sentinel) {
+			t.Errorf("result %d: decodeMapResp() error %v is not %v", tc.code, err, tc.sentinel)
+		}
+		if !errors.Is(err, tc.category) {
+			t.Errorf("result %d: decodeMapResp() error %v is in category %s, want %s", tc.code, err, base.CategoryOf(err), tc.category)
+		}
+	}
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	req := newTestMapReq(t)
+
+	// RFC 6887 Section 9: A NAT-PMP only router answers with a NAT-PMP
+	// UNSUPP_VERSION response, a PCP router that only speaks an older
+	// version with a PCP one.
+	for _, op := range []uint8{opMap, opAnnounce} {
+		natpmpResp := []byte{natpmpVersion, op | opRespFlag, 0, resUnsuppVersion, 0, 0, 0, 0}
+		pcpResp := mapRespFor(req, resUnsuppVersion)
+		pcpResp[0] = 1
+		pcpResp[1] = op | opRespFlag
+		for _, raw := range [][]byte{natpmpResp, pcpResp} {
+			var err error
+			if op == opMap {
+				_, err = decodeMapResp(req, raw)
+			} else {
+				err = decodeAnnounceResp(raw)
+			}
+			if !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("opcode %d: decoding %x returned %v, not ErrUnsupportedVersion", op, raw, err)
+			}
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	raw := encodeAnnounceReq(net.IPv4(192, 168, 1, 2))
+	if len(raw) != hdrLength || raw[0] != version || raw[1] != opAnnounce {
+		t.Fatalf("encodeAnnounceReq() returned %x", raw)
+	}
+	if lifetime := binary.BigEndian.Uint32(raw[4:8]); lifetime != 0 {
+		t.Errorf("encodeAnnounceReq() lifetime is %d", lifetime)
+	}
+
+	resp := make([]byte, hdrLength)
+	resp[0] = version
+	resp[1] = opAnnounce | opRespFlag
+	if err := decodeAnnounceResp(resp); err != nil {
+		t.Errorf("decodeAnnounceResp() failed: %s", err)
+	}
+	resp[1] = opMap | opRespFlag
+	if err := decodeAnnounceResp(resp); !isStale(err) {
+		t.Errorf("decodeAnnounceResp() error %v for a MAP response is not stale", err)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// The discovery cache holds the control points and the local address from a
+// previous run, which allows skipping SSDP and the device description
+// download entirely.  Routers tend to keep their URLs across reboots, but
+// not always (miniupnpd picks a random port on startup), so the cached
+// control point is validated with a GetExternalIPAddress before it is used.
+
+func (cp *controlPoint) toCache() *base.CachedService {
+	s := &base.CachedService{
+		ServiceType: cp.urn.String(),
+		ControlURL:  cp.url.String(),
+	}
+	if cp.scpdURL != nil {
+		s.SCPDURL = cp.scpdURL.String()
+	}
+	if cp.eventURL != nil {
+		s.EventSubURL = cp.eventURL.String()
+	}
+	return s
+}
+
+func controlPointFromCache(s *base.CachedService) (*controlPoint, error) {
+	if s == nil {
+		return nil, fmt.Errorf("no cached service")
+	}
+
+	// The URLs were absolute when they were cached, so there is no need
+	// for a base.
+	return newControlPoint(nil, &upnpService{
+		ServiceType: s.ServiceType,
+		ControlURL:  s.ControlURL,
+		SCPDURL:     s.SCPDURL,
+		EventSubURL: s.EventSubURL,
+	})
+}
+
+func (c *Client) loadCached(ctx context.Context) error {
+	e := c.opts.Cache.Lookup(methodName)
+	if e == nil {
+		return fmt.Errorf("no cached entry")
+	}
+	if c.srcAddr != nil && !c.srcAddr.Equal(e.LocalAddr) {
+		return fmt.Errorf("cached entry is for a different source address")
+	}
+	ctrl, err := controlPointFromCache(e.Service)
+	if err != nil {
+		return err
+	}
+	var fwCtrl *controlPoint
+	if e.FirewallService != nil {
+		if fwCtrl, err = controlPointFromCache(e.FirewallService); err != nil {
+			return err
+		}
+	}
+
+	// Validate the control point, and figure out the local address while
+	// at it, since it may have changed if the address was not pinned.
+	var localAddr net.Addr
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr()
+		},
+	}
+	c.ctrl = ctrl
+	if _, err = c.GetExternalIPAddressContext(httptrace.WithClientTrace(ctx, trace)); err != nil {
+		c.ctrl = nil
+		return err
+	}
+	tcpAddr, ok := localAddr.(*net.TCPAddr)
+	if !ok {
+		c.ctrl = nil
+		return fmt.Errorf("failed to determine local address")
+	}
+
+	c.fwCtrl = fwCtrl
+	c.udn = e.UDN
+	c.manufacturer, c.modelName = e.Manufacturer, e.ModelName
+	c.leasePolicy = leasePolicyFromString(e.LeasePolicy)
+	c.internalAddr = tcpAddr.IP
+	c.logf(base.LevelInfo, base.OpDiscover, "using cached %s at %s\n", c.ctrl.urn.kindType, c.ctrl.url)
+	c.logf(base.LevelInfo, base.OpDiscover, "local IP is %s\n", c.internalAddr)
+
+	// The service descriptions are not cached, since they are cheap to
+	// fetch, and are frequently changed by firmware upgrades.
+	c.fetchServiceDescription(ctx, c.ctrl)
+	if c.fwCtrl != nil {
+		c.fetchServiceDescription(ctx, c.fwCtrl)
+	}
+	return ctx.Err()
+}
+
+func (c *Client) storeCached() {
+	e := &base.CacheEntry{
+		Backend:      methodName,
+		Service:      c.ctrl.toCache(),
+		UDN:          c.udn,
+		Manufacturer: c.manufacturer,
+		ModelName:    c.modelName,
+		LocalAddr:    c.internalAddr,
+	}
+	if c.fwCtrl != nil {
+		e.FirewallService = c.fwCtrl.toCache()
+	}
+	if c.leasePolicy != LeasePolicyAny {
+		e.LeasePolicy = c.leasePolicy.String()
+	}
+	if err := c.opts.Cache.Store(e); err != nil {
+		c.logf(base.LevelWarn, base.OpDiscover, "failed to update the discovery cache: %s\n", err)
+	}
+}
@@ -7,6 +7,7 @@
 package upnp
 
 import (
+	"context"
 	"net"
 
 	"git.torproject.org/tor-fw-helper.git/natclient/base"
@@ -14,45 +15,121 @@ import (
 
 const (
 	methodName = "UPnP"
-
-	// userAgent = "BeOS/5.0 UPnP/1.1 Helper/1.0"
-	userAgent    = "" // Standardized, but optional.
-	outgoingPort = 0
 )
 
-type ClientFactory struct{}
+// ClientFactory is a UPnP ClientFactory.  The zero value discovers devices via
+// the standard SSDP multicast group.
+type ClientFactory struct {
+	// SSDPAddr, if set, is the "host:port" that M-SEARCH requests are sent
+	// to instead of the SSDP multicast group (Eg: a upnptest.IGD).
+	SSDPAddr string
+}
 
 func (f *ClientFactory) Name() string {
 	return methodName
 }
 
-func (f *ClientFactory) New(verbose bool) (base.Client, error) {
+func (f *ClientFactory) ssdpAddr() string {
+	if f.SSDPAddr != "" {
+		return f.SSDPAddr
+	}
+	return mSearchHost
+}
+
+func (f *ClientFactory) New(opts *base.Options) (base.Client, error) {
+	return f.NewContext(context.Background(), opts)
+}
+
+func (f *ClientFactory) NewContext(ctx context.Context, opts *base.Options) (base.Client, error) {
 	var err error
 
-	c := &Client{verbose: verbose}
-	c.ctrl, c.internalAddr, err = c.discover()
+	c := &Client{}
+	if opts != nil {
+		c.opts = *opts
+	}
+	// The User-Agent is standardized (Eg: "BeOS/5.0 UPnP/1.1 Helper/1.0"),
+	// but optional, and the outgoing port is random by default, so only the
+	// rest need defaults.
+	if c.opts.SSDPMX <= 0 {
+		c.opts.SSDPMX = mSearchMx
+	}
+	if c.opts.Retries <= 0 {
+		c.opts.Retries = maxRetries
+	}
+	if c.opts.RequestTimeout <= 0 {
+		c.opts.RequestTimeout = httpRequestTimeout
+	}
+	if _, c.srcAddr, err = c.opts.LocalInterface(); err != nil {
+		return nil, err
+	}
+	if c.srcAddr != nil {
+		c.logf(base.LevelInfo, base.OpDiscover, "using source address %s\n", c.srcAddr)
+	}
+	if c.opts.Cache != nil {
+		err = c.loadCached(ctx)
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		c.logf(base.LevelInfo, base.OpDiscover, "not using the discovery cache: %s\n", err)
+		c.opts.Cache.Remove(methodName)
+	}
+	c.ctrl, c.fwCtrl, c.internalAddr, err = c.discover(ctx, f.ssdpAddr())
 	if err != nil {
 		return nil, err
 	}
+	if c.opts.Cache != nil {
+		c.storeCached()
+	}
 
 	return c, nil
 }
 
 // Client is UPnP client instance.
 type Client struct {
-	verbose      bool
+	opts         base.Options
+	srcAddr      net.IP // Only set when pinned via the options.
+	udn          string // The InternetGatewayDevice's UDN.
+	manufacturer string
+	modelName    string
 	ctrl         *controlPoint
+	fwCtrl       *controlPoint
 	internalAddr net.IP
+	leasePolicy  LeasePolicy
+	sub          *subscription
 }
 
-func (c *Client) Vlogf(f string, a ...interface{}) {
-	if c.verbose {
-		base.Vlogf(methodName+": "+f, a...)
+// Router returns a description of the InternetGatewayDevice and the WAN
+// connection service that is in use.
+func (c *Client) Router() *base.Router {
+	return &base.Router{
+		Backend:      methodName,
+		Address:      c.ctrl.url.Hostname(),
+		LocalAddr:    c.internalAddr,
+		ControlURL:   c.ctrl.url.String(),
+		ServiceType:  c.ctrl.urn.String(),
+		UDN:          c.udn,
+		Manufacturer: c.manufacturer,
+		ModelName:    c.modelName,
 	}
 }
 
+func (c *Client) Vlogf(f string, a ...interface{}) {
+	c.logf(base.LevelDebug, "", f, a...)
+}
+
+// logf logs a message about op to the Logger in the options.
+func (c *Client) logf(level base.Level, op, f string, a ...interface{}) {
+	base.Logf(&c.opts, level, methodName, op, f, a...)
+}
+
 func (c *Client) Close() {
-	// No state to clean up.
+	if c.sub != nil {
+		c.sub.close()
+		c.sub = nil
+	}
 }
 
 var _ base.ClientFactory = (*ClientFactory)(nil)
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// SOAP faults carrying a UPnP error code are returned as *base.Error, with the
+// fault as the underlying error.  The codes in the 7xx range are defined per
+// service, and overlap (Eg: 704 is NoSuchEntry for WANIPv6FirewallControl, and
+// ConnectionSetupFailed for WANIPConnection), so they are looked up by the
+// kind of service that returned the fault.
+
+type upnpErrorInfo struct {
+	name     string
+	category base.Category
+}
+
+// upnpErrors are the codes that are common to all services.
+var upnpErrors = map[int]upnpErrorInfo{
+	// UPnP Device Architecture.
+	401: {"InvalidAction", base.CategoryUnsupported},
+	402: {"InvalidArgs", base.CategoryUnknown},
+	501: {"ActionFailed", base.CategoryTransient},
+	600: {"ArgumentValueInvalid", base.CategoryUnknown},
+	601: {"ArgumentValueOutOfRange", base.CategoryUnknown},
+	602: {"OptionalActionNotImplemented", base.CategoryUnsupported},
+	603: {"OutOfMemory", base.CategoryResource},
+	604: {"HumanInterventionRequired", base.CategoryUnauthorized},
+	605: {"StringArgumentTooLong", base.CategoryUnknown},
+	606: {"ActionNotAuthorized", base.CategoryUnauthorized},
+}
+
+// firewallErrors are the WANIPv6FirewallControl specific codes.
+var firewallErrors = map[int]upnpErrorInfo{
+	701: {"PinholeSpaceExhausted", base.CategoryResource},
+	702: {"FirewallDisabled", base.CategoryUnauthorized},
+	703: {"InboundPinholeNotAllowed", base.CategoryUnauthorized},
+	704: {"NoSuchEntry", base.CategoryNotFound},
+	705: {"ProtocolNotSupported", base.CategoryUnsupported},
+	706: {"InternalPortWildcardingNotAllowed", base.CategoryUnsupported},
+	707: {"ProtocolWildcardingNotAllowed", base.CategoryUnsupported},
+	708: {"WildCardNotPermittedInSrcIP", base.CategoryUnsupported},
+	709: {"NoTrafficReceived", base.CategoryUnknown},
+}
+
+// connectionErrors are the WANIPConnection/WANPPPConnection specific codes.
+var connectionErrors = map[int]upnpErrorInfo{
+	703: {"InactiveConnectionStateRequired", base.CategoryUnknown},
+	704: {"ConnectionSetupFailed", base.CategoryTransient},
+	705: {"ConnectionSetupInProgress", base.CategoryTransient},
+	706: {"ConnectionNotConfigured", base.CategoryUnknown},
+	707: {"DisconnectInProgress", base.CategoryTransient},
+	708: {"InvalidLayer2Address", base.CategoryUnknown},
+	709: {"InternetAccessDisabled", base.CategoryUnauthorized},
+	710: {"InvalidConnectionType", base.CategoryUnsupported},
+	711: {"ConnectionAlreadyTerminated", base.CategoryUnknown},
+	713: {"SpecifiedArrayIndexInvalid", base.CategoryNotFound},
+	714: {"NoSuchEntryInArray", base.CategoryNotFound},
+	715: {"WildCardNotPermittedInSrcIP", base.CategoryUnsupported},
+	716: {"WildCardNotPermittedInExtPort", base.CategoryUnsupported},
+	718: {"ConflictInMappingEntry", base.CategoryConflict},
+	724: {"SamePortValuesRequired", base.CategoryUnsupported},
+	725: {"OnlyPermanentLeasesSupported", base.CategoryUnsupported},
+	726: {"RemoteHostOnlySupportsWildcard", base.CategoryUnsupported},
+	727: {"ExternalPortOnlySupportsWildcard", base.CategoryUnsupported},
+	728: {"NoPortMapsAvailable", base.CategoryResource},
+	729: {"ConflictWithOtherMechanisms", base.CategoryConflict},
+	730: {"PortMappingNotFound", base.CategoryNotFound},
+	731: {"ReadOnly", base.CategoryUnauthorized},
+	732: {"WildCardNotPermittedInIntPort", base.CategoryUnsupported},
+	733: {"InconsistentParameters", base.CategoryUnknown},
+}
+
+// newError returns the error for a code returned by a service of the given
+// kind (Eg: "WANIPConnection").
+func newError(kindType string, code int) *base.Error {
+	info, ok := upnpErrors[code]
+	if !ok {
+		switch kindType {
+		case wanIPConnection, wanPPPConnection:
+			info = connectionErrors[code]
+		case wanIPv6FirewallControl:
+			info = firewallErrors[code]
+		}
+	}
+	return &base.Error{Protocol: methodName, Code: code, Name: info.name, Category: info.category}
+}
+
+// Sentinels for the more interesting UPnP error codes, for use with
+// errors.Is.
+var (
+	ErrInvalidArgs                  = newError("", 402)
+	ErrActionNotAuthorized          = newError("", 606)
+	ErrSpecifiedArrayIndexInvalid   = newError(wanIPConnection, 713)
+	ErrNoSuchEntryInArray           = newError(wanIPConnection, 714)
+	ErrConflictInMappingEntry       = newError(wanIPConnection, 718)
+	ErrSamePortValuesRequired       = newError(wanIPConnection, 724)
+	ErrOnlyPermanentLeasesSupported = newError(wanIPConnection, 725)
+	ErrNoPortMapsAvailable          = newError(wanIPConnection, 728)
+	ErrConflictWithOtherMechanisms  = newError(wanIPConnection, 729)
+	ErrPortMappingNotFound          = newError(wanIPConnection, 730)
+)
+
+// toError converts a SOAP fault returned by a service of the given kind to a
+// *base.Error.
+func (f *soapFault) toError(kindType string) *base.Error {
+	e := newError(kindType, f.errorCode())
+	if e.Name == "" && f.Detail != nil && f.Detail.UPnPError != nil {
+		e.Name = f.Detail.UPnPError.ErrorDescription
+	}
+	e.Err = f
+	return e
+}
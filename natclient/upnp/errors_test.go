@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+func TestNewError(t *testing.T) {
+	for _, tc := range []struct {
+		kindType string
+		code     int
+		name     string
+		category base.Category
+	}{
+		{wanIPConnection, 401, "InvalidAction", base.CategoryUnsupported},
+		{wanIPv6FirewallControl, 401, "InvalidAction", base.CategoryUnsupported},
+		{wanIPConnection, 704, "ConnectionSetupFailed", base.CategoryTransient},
+		{wanPPPConnection, 709, "InternetAccessDisabled", base.CategoryUnauthorized},
+		{wanIPv6FirewallControl, 704, "NoSuchEntry", base.CategoryNotFound},
+		{wanIPv6FirewallControl, 709, "NoTrafficReceived", base.CategoryUnknown},
+		{wanIPConnection, 718, "ConflictInMappingEntry", base.CategoryConflict},
+		{wanIPv6FirewallControl, 718, "", base.CategoryUnknown},
+		{layer3Forwarding, 704, "", base.CategoryUnknown},
+	} {
+		e := newError(tc.kindType, tc.code)
+		if e.Code != tc.code || e.Name != tc.name || e.Category != tc.category {
+			t.Errorf("newError(%s, %d) = %d %q %s, want %q %s", tc.kindType, tc.code, e.Code, e.Name, e.Category, tc.name, tc.category)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// GENA (General Event Notification Architecture) is how UPnP devices notify
+// control points of changes to evented state variables.  The control point
+// SUBSCRIBEs to a service's eventSubURL, providing a callback URL, and the
+// device sends NOTIFY requests to the callback URL as the variables change.
+// Subscriptions time out, and must be periodically renewed.
+
+const (
+	genaNT             = "upnp:event"
+	genaNTS            = "upnp:propchange"
+	genaCallbackPath   = "/notify"
+	genaTimeout        = 1800 * time.Second
+	genaMinRenewal     = 30 * time.Second
+	genaRetryInterval  = 60 * time.Second
+	genaRequestTimeout = 10 * time.Second
+	genaEventBacklog   = 16
+)
+
+// Event is a state change notification from the router.
+type Event interface {
+	isEvent()
+}
+
+// ExternalIPAddressEvent is sent when the router's external address changes.
+type ExternalIPAddressEvent struct {
+	IP net.IP
+}
+
+// ConnectionStatusEvent is sent when the status of the router's upstream
+// connection changes (Eg: "Connected", "Disconnected").
+type ConnectionStatusEvent struct {
+	Status string
+}
+
+// PortMappingNumberOfEntriesEvent is sent when the number of port mapping
+// entries changes.
+type PortMappingNumberOfEntriesEvent struct {
+	Entries int
+}
+
+func (ExternalIPAddressEvent) isEvent()          {}
+func (ConnectionStatusEvent) isEvent()           {}
+func (PortMappingNumberOfEntriesEvent) isEvent() {}
+
+type genaPropertySet struct {
+	Properties []struct {
+		Variables []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"property"`
+}
+
+type subscription struct {
+	c        *Client
+	cp       *controlPoint
+	listener net.Listener
+	server   *http.Server
+	callback string
+	events   chan Event
+
+	lock        sync.Mutex
+	sid         string
+	timeout     time.Duration
+	subscribing bool
+
+	closeChan chan struct{}
+	wg        sync.WaitGroup
+}
+
+// Subscribe subscribes to WANIPConnection/WANPPPConnection events, and returns
+// a channel over which state changes are delivered.  The first set of events
+// reflects the router's state at the time of subscription.  A small HTTP
+// server is run on the client's LAN address to receive the notifications, and
+// the subscription is renewed automatically till the Client is closed, at
+// which point the channel is closed.  Events that arrive while the channel's
+// backlog is full are dropped.
+func (c *Client) Subscribe() (<-chan Event, error) {
+	return c.SubscribeContext(context.Background())
+}
+
+// SubscribeContext behaves like Subscribe, but aborts the initial SUBSCRIBE
+// request when ctx is canceled or expires.  The renewals are unaffected by
+// ctx.
+func (c *Client) SubscribeContext(ctx context.Context) (<-chan Event, error) {
+	if c.sub != nil {
+		return nil, fmt.Errorf("gena: already subscribed")
+	}
+	if c.ctrl.eventURL == nil {
+		return nil, fmt.Errorf("gena: service does not support eventing")
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(c.internalAddr.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	s := &subscription{
+		c:         c,
+		cp:        c.ctrl,
+		listener:  l,
+		callback:  "<http://" + l.Addr().String() + genaCallbackPath + ">",
+		events:    make(chan Event, genaEventBacklog),
+		closeChan: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(genaCallbackPath, s.onNotify)
+	s.server = &http.Server{Handler: mux}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.server.Serve(l)
+	}()
+
+	if err = s.subscribe(ctx); err != nil {
+		s.server.Close()
+		s.wg.Wait()
+		return nil, err
+	}
+	c.sub = s
+	s.wg.Add(1)
+	go s.renewWorker()
+
+	return s.events, nil
+}
+
+func (s *subscription) issueRequest(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", s.c.opts.UserAgent)
+	resp, err := s.c.newHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gena: %s failed with status: %s", req.Method, resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *subscription) subscribe(ctx context.Context) error {
+	//  SUBSCRIBE publisher path HTTP/1.1
+	//  HOST: publisher host:publisher port
+	//  USER-AGENT: OS/version UPnP/1.1 product/version
+	//  CALLBACK: <delivery URL>
+	//  NT: upnp:event
+	//  TIMEOUT: Second-requested subscription duration
+	s.c.logf(base.LevelDebug, "Subscribe", "gena: subscribing to %s\n", s.cp.eventURL)
+	req, err := http.NewRequestWithContext(ctx, "SUBSCRIBE", s.cp.eventURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("CALLBACK", s.callback)
+	req.Header.Set("NT", genaNT)
+	req.Header.Set("TIMEOUT", "Second-"+strconv.Itoa(int(genaTimeout/time.Second)))
+
+	// Some devices send the initial NOTIFY before responding to the
+	// SUBSCRIBE, at which point the SID is not known yet, so accept any SID
+	// till the response is received.
+	s.lock.Lock()
+	s.subscribing = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.subscribing = false
+		s.lock.Unlock()
+	}()
+
+	resp, err := s.issueRequest(req)
+	if err != nil {
+		return err
+	}
+	sid := resp.Header.Get("SID")
+	if sid == "" {
+		return fmt.Errorf("gena: SUBSCRIBE response missing SID")
+	}
+	timeout := parseTimeout(resp.Header.Get("TIMEOUT"))
+	s.c.logf(base.LevelInfo, "Subscribe", "gena: subscribed, SID: %s (%v)\n", sid, timeout)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sid = sid
+	s.timeout = timeout
+	return nil
+}
+
+func (s *subscription) renew() error {
+	//  SUBSCRIBE publisher path HTTP/1.1
+	//  HOST: publisher host:publisher port
+	//  SID: uuid:subscription UUID
+	//  TIMEOUT: Second-requested subscription duration
+	s.lock.Lock()
+	sid := s.sid
+	s.lock.Unlock()
+
+	s.c.logf(base.LevelDebug, "Subscribe", "gena: renewing SID: %s\n", sid)
+	req, err := http.NewRequest("SUBSCRIBE", s.cp.eventURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("SID", sid)
+	req.Header.Set("TIMEOUT", "Second-"+strconv.Itoa(int(genaTimeout/time.Second)))
+	resp, err := s.issueRequest(req)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.timeout = parseTimeout(resp.Header.Get("TIMEOUT"))
+	return nil
+}
+
+func (s *subscription) unsubscribe() error {
+	//  UNSUBSCRIBE publisher path HTTP/1.1
+	//  HOST: publisher host:publisher port
+	//  SID: uuid:subscription UUID
+	s.lock.Lock()
+	sid := s.sid
+	s.lock.Unlock()
+
+	s.c.logf(base.LevelDebug, "Subscribe", "gena: unsubscribing SID: %s\n", sid)
+	req, err := http.NewRequest("UNSUBSCRIBE", s.cp.eventURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("SID", sid)
+	_, err = s.issueRequest(req)
+	return err
+}
+
+func (s *subscription) renewWorker() {
+	defer s.wg.Done()
+
+	for {
+		// Renew at half the timeout, so that a failed renewal can be retried
+		// (or the subscription re-established) before it lapses.
+		s.lock.Lock()
+		interval := s.timeout / 2
+		s.lock.Unlock()
+		if interval == 0 {
+			// "infinite" subscriptions never need to be renewed.
+			return
+		}
+		if interval < genaMinRenewal {
+			interval = genaMinRenewal
+		}
+
+		for {
+			select {
+			case <-s.closeChan:
+				return
+			case <-time.After(interval):
+			}
+			err := s.renew()
+			if err == nil {
+				break
+			}
+
+			// Renewal failed (the router probably forgot about us, 412
+			// Precondition Failed), so try to subscribe from scratch.
+			s.c.logf(base.LevelWarn, "Subscribe", "gena: renewal failed: %s\n", err)
+			if err = s.subscribe(context.Background()); err == nil {
+				break
+			}
+			s.c.logf(base.LevelWarn, "Subscribe", "gena: re-subscribe failed: %s\n", err)
+			interval = genaRetryInterval
+		}
+	}
+}
+
+func (s *subscription) onNotify(w http.ResponseWriter, r *http.Request) {
+	//  NOTIFY delivery path HTTP/1.1
+	//  HOST: delivery host:delivery port
+	//  CONTENT-TYPE: text/xml; charset="utf-8"
+	//  NT: upnp:event
+	//  NTS: upnp:propchange
+	//  SID: uuid:subscription-UUID
+	//  SEQ: event key
+	if r.Method != "NOTIFY" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("NT") != genaNT || r.Header.Get("NTS") != genaNTS {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	sidOk := s.subscribing || r.Header.Get("SID") == s.sid
+	s.lock.Unlock()
+	if !sidOk {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ps := &genaPropertySet{}
+	if err = xml.Unmarshal(body, ps); err != nil {
+		s.c.logf(base.LevelWarn, "Subscribe", "gena: malformed NOTIFY body: %s\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	for _, p := range ps.Properties {
+		for _, v := range p.Variables {
+			ev := toEvent(v.XMLName.Local, strings.TrimSpace(v.Value))
+			if ev == nil {
+				continue
+			}
+			s.c.logf(base.LevelDebug, "Subscribe", "gena: %s = %s\n", v.XMLName.Local, v.Value)
+
+			// Blocking here would stall the router's NOTIFY (and with it,
+			// possibly every other subscriber), so events are dropped if
+			// the consumer falls behind.
+			select {
+			case s.events <- ev:
+			default:
+				s.c.logf(base.LevelWarn, "Subscribe", "gena: event backlog full, dropping %s\n", v.XMLName.Local)
+			}
+		}
+	}
+}
+
+func (s *subscription) close() {
+	close(s.closeChan)
+	if err := s.unsubscribe(); err != nil {
+		s.c.logf(base.LevelWarn, "Subscribe", "gena: unsubscribe failed: %s\n", err)
+	}
+
+	// Shutdown waits for in-flight NOTIFY handlers to return, which never
+	// block on the events channel, so that it is safe to close it.
+	ctx, cancel := context.WithTimeout(context.Background(), genaRequestTimeout)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+	}
+	s.wg.Wait()
+	close(s.events)
+}
+
+func toEvent(name, value string) Event {
+	switch name {
+	case "ExternalIPAddress":
+		return ExternalIPAddressEvent{IP: net.ParseIP(value)}
+	case "ConnectionStatus":
+		return ConnectionStatusEvent{Status: value}
+	case "PortMappingNumberOfEntries":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil
+		}
+		return PortMappingNumberOfEntriesEvent{Entries: n}
+	default:
+		return nil
+	}
+}
+
+func parseTimeout(s string) time.Duration {
+	// "Second-1800" or "infinite" (UPnP 1.0 only).  Treat garbage as the
+	// requested timeout.
+	if strings.EqualFold(s, "infinite") {
+		return 0
+	}
+	if len(s) > 7 && strings.EqualFold(s[:7], "Second-") {
+		if n, err := strconv.Atoi(s[7:]); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return genaTimeout
+}
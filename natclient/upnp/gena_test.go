@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/upnp/upnptest"
+)
+
+const testEventWait = 5 * time.Second
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatalf("events channel closed")
+		}
+		return ev
+	case <-time.After(testEventWait):
+		t.Fatalf("timed out waiting for an event")
+	}
+	return nil
+}
+
+// sendNotify sends a NOTIFY to the subscription's callback, as if from the
+// router, and returns the status.
+func sendNotify(t *testing.T, callback, nts, sid, body string) int {
+	t.Helper()
+	req, err := http.NewRequest("NOTIFY", callback, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.NewRequest() failed: %s", err)
+	}
+	req.Header.Set("NT", genaNT)
+	req.Header.Set("NTS", nts)
+	req.Header.Set("SID", sid)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("NOTIFY failed: %s", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSubscribe(t *testing.T) {
+	igd, c := newTestClient(t, &upnptest.Config{EventTimeout: 300}, nil)
+	defer igd.Close()
+
+	events, err := c.SubscribeContext(context.Background())
+	if err != nil {
+		c.Close()
+		t.Fatalf("SubscribeContext() failed: %s", err)
+	}
+	if _, err = c.Subscribe(); err == nil {
+		t.Errorf("Subscribe() succeeded while already subscribed")
+	}
+
+	reqs := igd.EventRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("router got %d event requests, want 1", len(reqs))
+	}
+	h := reqs[0].Header
+	if reqs[0].Method != "SUBSCRIBE" || h.Get("NT") != genaNT || h.Get("TIMEOUT") != "Second-1800" || h.Get("SID") != "" {
+		t.Errorf("SUBSCRIBE request has headers %v", h)
+	}
+	callback := h.Get("CALLBACK")
+	if !strings.HasPrefix(callback, "<http://127.0.0.1:") || !strings.HasSuffix(callback, genaCallbackPath+">") {
+		t.Errorf("SUBSCRIBE request has CALLBACK %s", callback)
+	}
+	subs := igd.Subscriptions()
+	if len(subs) != 1 {
+		t.Fatalf("router has %d subscriptions, want 1", len(subs))
+	}
+	if c.sub.sid != subs[0].SID || c.sub.timeout != 300*time.Second {
+		t.Errorf("subscribed with SID %s (%v), router granted %s (%d sec)", c.sub.sid, c.sub.timeout, subs[0].SID, subs[0].Timeout)
+	}
+
+	// The initial event carries the current state, and later ones the
+	// changes.
+	if ev, ok := nextEvent(t, events).(ExternalIPAddressEvent); !ok || !ev.IP.Equal(igd.ExternalIP()) {
+		t.Errorf("initial event %#v, want the external address", ev)
+	}
+	if ev := nextEvent(t, events); ev != (ConnectionStatusEvent{Status: upnptest.StatusConnected}) {
+		t.Errorf("initial event %#v, want the connection status", ev)
+	}
+	if ev := nextEvent(t, events); ev != (PortMappingNumberOfEntriesEvent{Entries: 0}) {
+		t.Errorf("initial event %#v, want the number of entries", ev)
+	}
+	newIP := net.IPv4(198, 51, 100, 1)
+	igd.SetExternalIP(newIP)
+	if ev, ok := nextEvent(t, events).(ExternalIPAddressEvent); !ok || !ev.IP.Equal(newIP) {
+		t.Errorf("event %#v, want the new external address", ev)
+	}
+	igd.SetConnectionStatus(0, upnptest.StatusDisconnected)
+	if ev := nextEvent(t, events); ev != (ConnectionStatusEvent{Status: upnptest.StatusDisconnected}) {
+		t.Errorf("event %#v, want the new connection status", ev)
+	}
+
+	// Renewals only carry the SID and TIMEOUT.
+	if err = c.sub.renew(); err != nil {
+		t.Errorf("renew() failed: %s", err)
+	}
+	reqs = igd.EventRequests()
+	if h = reqs[len(reqs)-1].Header; h.Get("SID") != subs[0].SID || h.Get("TIMEOUT") != "Second-1800" || h.Get("CALLBACK") != "" || h.Get("NT") != "" {
+		t.Errorf("renewal SUBSCRIBE request has headers %v", h)
+	}
+	if subs = igd.Subscriptions(); len(subs) != 1 || subs[0].Renewals != 1 {
+		t.Errorf("router has subscriptions %+v after renew()", subs)
+	}
+
+	// Closing the client unsubscribes, and closes the channel.
+	c.Close()
+	reqs = igd.EventRequests()
+	if r := reqs[len(reqs)-1]; r.Method != "UNSUBSCRIBE" || r.Header.Get("SID") != subs[0].SID {
+		t.Errorf("last event request is %s with headers %v, want UNSUBSCRIBE", r.Method, r.Header)
+	}
+	if subs = igd.Subscriptions(); len(subs) != 0 {
+		t.Errorf("router has subscriptions %+v after Close()", subs)
+	}
+	for range events {
+	}
+}
+
+func TestNotify(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	events, err := c.Subscribe()
+	if err != nil {
+		t.Fatalf("Subscribe() failed: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		nextEvent(t, events)
+	}
+	sub := igd.Subscriptions()[0]
+
+	// Unknown variables, and values that do not parse, are ignored.
+	const body = `<?xml version="1.0"?>
+<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">
+<e:property><PortMappingNumberOfEntries>bogus</PortMappingNumberOfEntries></e:property>
+<e:property><Uptime>42</Uptime></e:property>
+<e:property><PortMappingNumberOfEntries> 2 </PortMappingNumberOfEntries></e:property>
+</e:propertyset>`
+	for _, tc := range []struct {
+		name   string
+		nts    string
+		sid    string
+		body   string
+		status int
+	}{
+		{"other SID", genaNTS, "uuid:someone-else", body, http.StatusPreconditionFailed},
+		{"bad NTS", "ssdp:alive", sub.SID, body, http.StatusBadRequest},
+		{"malformed body", genaNTS, sub.SID, "<e:propertyset", http.StatusBadRequest},
+		{"valid", genaNTS, sub.SID, body, http.StatusOK},
+	} {
+		if status := sendNotify(t, sub.Callback, tc.nts, tc.sid, tc.body); status != tc.status {
+			t.Errorf("%s: NOTIFY got status %d, want %d", tc.name, status, tc.status)
+		}
+	}
+
+	// Only the valid NOTIFY results in an event.
+	if ev := nextEvent(t, events); ev != (PortMappingNumberOfEntriesEvent{Entries: 2}) {
+		t.Errorf("event %#v, want 2 entries", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event %#v", ev)
+	default:
+	}
+}
+
+func TestSubscribeContextCanceled(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.SubscribeContext(ctx); err == nil {
+		t.Fatalf("SubscribeContext() succeeded with a canceled context")
+	}
+	if c.sub != nil {
+		t.Errorf("subscription was kept after a failure")
+	}
+	if subs := igd.Subscriptions(); len(subs) != 0 {
+		t.Errorf("router has subscriptions %+v", subs)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want time.Duration
+	}{
+		{"Second-300", 300 * time.Second},
+		{"second-60", 60 * time.Second},
+		{"infinite", 0},
+		{"INFINITE", 0},
+		{"Second-0", genaTimeout},
+		{"Second--5", genaTimeout},
+		{"Second-", genaTimeout},
+		{"300", genaTimeout},
+		{"", genaTimeout},
+	} {
+		if got := parseTimeout(tc.s); got != tc.want {
+			t.Errorf("parseTimeout(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
@@ -10,11 +10,14 @@ package httpu
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"math"
 	"net"
 	"net/http"
 	"syscall"
 	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
 )
 
 const (
@@ -24,6 +27,10 @@ const (
 // Client is a HTTP(M)U client instance.
 type Client struct {
 	localAddr *net.UDPAddr
+
+	// mcastIf is set if multicast requests must go out of the interface
+	// with localAddr instead of following the multicast route.
+	mcastIf bool
 }
 
 // New creates a new HTTP(M)U client instance that will bind to
@@ -37,9 +44,31 @@ func New(localPort int) (*Client, error) {
 	return &Client{localAddr: localAddr}, nil
 }
 
+// SetInterfaceAddr binds the client to the local IPv4 address ip instead of
+// "0.0.0.0", and sends multicast requests out of the interface that has it.
+func (c *Client) SetInterfaceAddr(ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return syscall.EAFNOSUPPORT
+	}
+	c.localAddr.IP = ip4
+	c.mcastIf = true
+	return nil
+}
+
 // Do issues a HTTP(M)U request, and returns the response(s).  This method is
 // not threadsafe.
 func (c *Client) Do(r *http.Request, timeout time.Duration, retries int) ([]*http.Response, error) {
+	return c.DoContext(context.Background(), r, timeout, retries)
+}
+
+// DoContext behaves like Do, but returns early with the context's error if ctx
+// is canceled or expires before any responses are received.  Responses that
+// arrive before then are returned as usual.
+func (c *Client) DoContext(ctx context.Context, r *http.Request, timeout time.Duration, retries int) ([]*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	addr, err := net.ResolveUDPAddr("udp4", r.Host)
 	if err != nil {
 		return nil, err
@@ -49,6 +78,13 @@ func (c *Client) Do(r *http.Request, timeout time.Duration, retries int) ([]*htt
 		return nil, err
 	}
 	defer conn.Close()
+	if c.mcastIf && addr.IP.IsMulticast() {
+		if err := setMulticastInterface(conn, c.localAddr.IP); err != nil {
+			return nil, err
+		}
+	}
+	stop := base.WatchContext(ctx, conn)
+	defer stop()
 	if c.localAddr.Port == 0 {
 		// If the local port is set to "any", query the port that was actually
 		// used so that it can be preserved across invocations.
@@ -67,12 +103,15 @@ func (c *Client) Do(r *http.Request, timeout time.Duration, retries int) ([]*htt
 	for i := 0; i < retries; i++ {
 		// Ensure that the full timeout interval passes between requests to
 		// avoid spamming the network.
-		now := time.Now()
-		if timeoutAt.After(now) {
-			time.Sleep(timeoutAt.Sub(now))
+		if err := base.Sleep(ctx, time.Until(timeoutAt)); err != nil {
+			return nil, err
 		}
 		timeoutAt = time.Now().Add(timeout)
-		if err := conn.SetDeadline(timeoutAt); err != nil {
+		if err := conn.SetDeadline(base.ContextDeadline(ctx, timeoutAt)); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			// Canceled before the new deadline was set.
 			return nil, err
 		}
 
@@ -111,6 +150,9 @@ func (c *Client) Do(r *http.Request, timeout time.Duration, retries int) ([]*htt
 		if len(respList) > 0 {
 			return respList, nil
 		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 	}
 	return nil, syscall.ETIMEDOUT
 }
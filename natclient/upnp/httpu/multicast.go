@@ -0,0 +1,17 @@
+// Copyright (c) 2014, The Tor Project, Inc.
+// See LICENSE for licensing information
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package httpu
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	return fmt.Errorf("setMulticastInterface not implemented on: %s", runtime.GOOS)
+}
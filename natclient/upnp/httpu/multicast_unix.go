@@ -0,0 +1,32 @@
+// Copyright (c) 2014, The Tor Project, Inc.
+// See LICENSE for licensing information
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package httpu
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface sets IP_MULTICAST_IF on conn, so that multicast
+// datagrams are sent out of the interface with the address ip, rather than the
+// one the multicast route points at.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
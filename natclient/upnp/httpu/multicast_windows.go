@@ -0,0 +1,32 @@
+// Copyright (c) 2014, The Tor Project, Inc.
+// See LICENSE for licensing information
+
+package httpu
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// setMulticastInterface sets IP_MULTICAST_IF on conn, so that multicast
+// datagrams are sent out of the interface with the address ip, rather than the
+// one the multicast route points at.
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// Winsock takes an IN_ADDR in network byte order.
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.Setsockopt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, (*byte)(unsafe.Pointer(&addr[0])), int32(len(addr)))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
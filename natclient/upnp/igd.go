@@ -8,7 +8,9 @@ package upnp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -16,9 +18,21 @@ import (
 	"net/http"
 	"strconv"
 	"syscall"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
 )
 
-const maxMappingDuration = 604800
+const (
+	maxMappingDuration = 604800
+
+	// listPageSize is the number of entries requested in each IGD2
+	// GetListOfPortMappings call.
+	listPageSize = 1000
+
+	// maxPortSearch is the number of alternate external ports that are tried
+	// when the requested one is taken, and the router can not pick one.
+	maxPortSearch = 16
+)
 
 // The people who made this abomination of a protocol used SOAP.  Presumably
 // the "right" way to do this is to use an existing SOAP client, but Go does
@@ -31,9 +45,17 @@ type soapEnvelope struct {
 }
 
 type soapBody struct {
-	Fault                              *soapFault             `xml:"Fault"`
-	GetExternalIPAddressResponse       *getExtIPResponse      `xml:"GetExternalIPAddressResponse"`
-	GetGenericPortMappingEntryResponse *getGenPMapEntResponse `xml:"GetGenericPortMappingEntryResponse"`
+	Fault                               *soapFault              `xml:"Fault"`
+	GetExternalIPAddressResponse        *getExtIPResponse       `xml:"GetExternalIPAddressResponse"`
+	GetGenericPortMappingEntryResponse  *getGenPMapEntResponse  `xml:"GetGenericPortMappingEntryResponse"`
+	GetSpecificPortMappingEntryResponse *getSpecPMapEntResponse `xml:"GetSpecificPortMappingEntryResponse"`
+	GetListOfPortMappingsResponse       *getListOfPMapResponse  `xml:"GetListOfPortMappingsResponse"`
+	AddAnyPortMappingResponse           *addAnyPMapResponse     `xml:"AddAnyPortMappingResponse"`
+	GetFirewallStatusResponse           *getFwStatusResponse    `xml:"GetFirewallStatusResponse"`
+	GetOutboundPinholeTimeoutResponse   *getOutPhTimeResponse   `xml:"GetOutboundPinholeTimeoutResponse"`
+	AddPinholeResponse                  *addPinholeResponse     `xml:"AddPinholeResponse"`
+	GetDefaultConnectionServiceResponse *getDefConnSvcResponse  `xml:"GetDefaultConnectionServiceResponse"`
+	GetStatusInfoResponse               *getStatusInfoResponse  `xml:"GetStatusInfoResponse"`
 }
 
 type soapFault struct {
@@ -66,14 +88,95 @@ type getGenPMapEntResponse struct {
 	LeaseDuration          int    `xml:"NewLeaseDuration"`
 }
 
+type addAnyPMapResponse struct {
+	ReservedPort int `xml:"NewReservedPort"`
+}
+
+type getSpecPMapEntResponse struct {
+	InternalPort           int    `xml:"NewInternalPort"`
+	InternalClient         string `xml:"NewInternalClient"`
+	Enabled                int    `xml:"NewEnabled"`
+	PortMappingDescription string `xml:"NewPortMappingDescription"`
+	LeaseDuration          int    `xml:"NewLeaseDuration"`
+}
+
+type getListOfPMapResponse struct {
+	PortListing string `xml:"NewPortListing"`
+}
+
+// portMappingList is the PortListing document returned by IGD2's
+// GetListOfPortMappings, which is XML embedded as a string in the SOAP
+// response.
+type portMappingList struct {
+	Entries []portMappingListEntry `xml:"PortMappingEntry"`
+}
+
+type portMappingListEntry struct {
+	RemoteHost     string `xml:"NewRemoteHost"`
+	ExternalPort   int    `xml:"NewExternalPort"`
+	Protocol       string `xml:"NewProtocol"`
+	InternalPort   int    `xml:"NewInternalPort"`
+	InternalClient string `xml:"NewInternalClient"`
+	Enabled        int    `xml:"NewEnabled"`
+	Description    string `xml:"NewDescription"`
+	LeaseTime      int    `xml:"NewLeaseTime"`
+}
+
+func (r *portMappingListEntry) toPortMapping() (*base.PortMapping, error) {
+	// The entries are identical to GetGenericPortMappingEntry responses,
+	// other than the names of a few of the elements.
+	g := &getGenPMapEntResponse{
+		RemoteHost:             r.RemoteHost,
+		ExternalPort:           r.ExternalPort,
+		Protocol:               r.Protocol,
+		InternalPort:           r.InternalPort,
+		InternalClient:         r.InternalClient,
+		Enabled:                r.Enabled,
+		PortMappingDescription: r.Description,
+		LeaseDuration:          r.LeaseTime,
+	}
+	return g.toPortMapping()
+}
+
+func (r *getGenPMapEntResponse) toPortMapping() (*base.PortMapping, error) {
+	protocol, err := base.ParseProtocol(r.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	m := &base.PortMapping{
+		Description:   r.PortMappingDescription,
+		InternalIP:    net.ParseIP(r.InternalClient),
+		InternalPort:  r.InternalPort,
+		RemoteHost:    net.ParseIP(r.RemoteHost), // "" (wildcard) -> nil
+		ExternalPort:  r.ExternalPort,
+		Protocol:      protocol,
+		Enabled:       r.Enabled != 0,
+		LeaseDuration: r.LeaseDuration,
+	}
+	return m, nil
+}
+
+// errorCode returns the UPnP error code associated with the fault, or 0 if
+// there is none.
+func (f *soapFault) errorCode() int {
+	if f.Detail != nil && f.Detail.UPnPError != nil {
+		return f.Detail.UPnPError.ErrorCode
+	}
+	return 0
+}
+
+func (f *soapFault) Error() string {
+	return "soap: " + f.String()
+}
+
 func (f *soapFault) String() string {
-	if f.Detail.UPnPError != nil {
+	if f.Detail != nil && f.Detail.UPnPError != nil {
 		return fmt.Sprintf("upnp error: %d - %s", f.Detail.UPnPError.ErrorCode, f.Detail.UPnPError.ErrorDescription)
 	}
 	return fmt.Sprintf("fault: %s - %s", f.FaultCode, f.FaultString)
 }
 
-func (c *Client) issueSoapRequest(actionName, argsXML string) (*soapBody, error) {
+func (c *Client) issueSoapRequest(ctx context.Context, cp *controlPoint, actionName, argsXML string) (*soapBody, error) {
 	// Apparently a lot of routers puke horribly on XML that's well-formed but
 	// not exactly what they expect, so requests are crafted by hand.  At a
 	// future time when more than 2 requests need to be supported, revisit.
@@ -83,31 +186,34 @@ func (c *Client) issueSoapRequest(actionName, argsXML string) (*soapBody, error)
 		"<s:Body>"
 	const footer = "</s:Body></s:Envelope>"
 
-	actionOpen := "<u:" + actionName + " xmlns:u=\"" + c.ctrl.urn.String() + "\">"
+	actionOpen := "<u:" + actionName + " xmlns:u=\"" + cp.urn.String() + "\">"
 	actionClose := "</u:" + actionName + ">"
 	body := []byte(header + actionOpen + argsXML + actionClose + footer)
-	soapAction := "\"" + c.ctrl.urn.String() + "#" + actionName + "\""
+	soapAction := "\"" + cp.urn.String() + "#" + actionName + "\""
+
+	// Don't bother sending actions that the service is known not to
+	// support.
+	if !cp.supports(actionName) {
+		return nil, &actionNotSupportedError{cp.urn.kindType, actionName}
+	}
 
-	c.Vlogf("soap: issuing %s\n", actionName)
+	c.logf(base.LevelDebug, actionName, "soap: issuing %s\n", actionName)
 
 	// miniupnpd (used by a lot of routers) can't handle chunked transfer
 	// encoding at all and just passes the raw body to it's XML parser.  This
 	// is all sorts of garbage and violates RFC 2616.
 	reqBuf := bytes.NewBuffer(body)
-	req, err := http.NewRequest("POST", c.ctrl.url.String(), bufio.NewReader(reqBuf))
+	req, err := http.NewRequestWithContext(ctx, "POST", cp.url.String(), bufio.NewReader(reqBuf))
 	if err != nil {
 		return nil, err
 	}
 	req.ContentLength = int64(len(body))
 	req.TransferEncoding = []string{"identity"}
 	req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", c.opts.UserAgent)
 	req.Header.Set("SOAPAction", soapAction)
 
-	httpTransport := &http.Transport{DisableKeepAlives: true, DisableCompression: true}
-	httpClient := &http.Client{Transport: httpTransport}
-
-	resp, err := httpClient.Do(req)
+	resp, err := c.newHTTPClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +227,7 @@ func (c *Client) issueSoapRequest(actionName, argsXML string) (*soapBody, error)
 		return nil, err
 	}
 	if respEnvelope.Body.Fault != nil {
-		return nil, fmt.Errorf("soap: %s", respEnvelope.Body.Fault)
+		return nil, respEnvelope.Body.Fault.toError(cp.urn.kindType)
 	}
 	if resp.StatusCode != http.StatusOK {
 		// Yes, this is at the end because the SOAP Fault gives more useful
@@ -133,8 +239,12 @@ func (c *Client) issueSoapRequest(actionName, argsXML string) (*soapBody, error)
 
 // GetExternalIPAddress queries the router's external IP address.
 func (c *Client) GetExternalIPAddress() (net.IP, error) {
+	return c.GetExternalIPAddressContext(context.Background())
+}
 
-	respBody, err := c.issueSoapRequest("GetExternalIPAddress", "")
+// GetExternalIPAddressContext queries the router's external IP address.
+func (c *Client) GetExternalIPAddressContext(ctx context.Context) (net.IP, error) {
+	respBody, err := c.issueSoapRequest(ctx, c.ctrl, "GetExternalIPAddress", "")
 	if err != nil {
 		return nil, err
 	}
@@ -150,87 +260,304 @@ func (c *Client) GetExternalIPAddress() (net.IP, error) {
 
 // GetListOfPortMappings queries the router for the list of port forwarding
 // entries.
-func (c *Client) GetListOfPortMappings() ([]string, error) {
-	// Sad panda, GetListOfPortMappings requires IGD2 or later, so emulate it
-	// with GetGenericPortMappingEntry.  Theoretically if the number of entries
+func (c *Client) GetListOfPortMappings() ([]base.PortMapping, error) {
+	return c.GetListOfPortMappingsContext(context.Background())
+}
+
+// GetListOfPortMappingsContext queries the router for the list of port
+// forwarding entries.
+func (c *Client) GetListOfPortMappingsContext(ctx context.Context) ([]base.PortMapping, error) {
+	// GetListOfPortMappings is optional, so only use it when it is
+	// advertised, or when the service description is unknown and the
+	// service claims to be IGD2.
+	if c.ctrl.advertises("GetListOfPortMappings") || (c.ctrl.desc == nil && c.ctrl.urn.version >= 2) {
+		resps, err := c.getListOfPortMappings(ctx)
+		if err == nil {
+			return resps, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		c.logf(base.LevelWarn, "GetListOfPortMappings", "igd: GetListOfPortMappings failed, falling back: %s\n", err)
+	}
+	if !c.ctrl.supports("GetGenericPortMappingEntry") {
+		return nil, syscall.ENOTSUP
+	}
+	return c.getGenericPortMappingEntries(ctx)
+}
+
+func (c *Client) getListOfPortMappings(ctx context.Context) ([]base.PortMapping, error) {
+	// IGD2 can return the entire list of mappings in a single request per
+	// protocol, though large tables need to be paged through.
+	var resps []base.PortMapping
+	for _, protocol := range []base.Protocol{base.TCP, base.UDP} {
+		for startPort := 0; startPort <= math.MaxUint16; {
+			argsXML := "<NewStartPort>" + strconv.FormatUint(uint64(startPort), 10) + "</NewStartPort>" +
+				"<NewEndPort>" + strconv.FormatUint(math.MaxUint16, 10) + "</NewEndPort>" +
+				"<NewProtocol>" + protocol.String() + "</NewProtocol>" +
+				"<NewManage>1</NewManage>" +
+				"<NewNumberOfPorts>" + strconv.FormatUint(listPageSize, 10) + "</NewNumberOfPorts>"
+			respBody, err := c.issueSoapRequest(ctx, c.ctrl, "GetListOfPortMappings", argsXML)
+			if err != nil {
+				if errors.Is(err, ErrPortMappingNotFound) {
+					// No (more) entries in the requested range.
+					break
+				}
+				return nil, err
+			}
+			if respBody.GetListOfPortMappingsResponse == nil {
+				return nil, fmt.Errorf("igd: GetListOfPortMappings() failed")
+			}
+			l := &portMappingList{}
+			if err = xml.Unmarshal([]byte(respBody.GetListOfPortMappingsResponse.PortListing), l); err != nil {
+				return nil, err
+			}
+			lastPort := startPort
+			for _, r := range l.Entries {
+				m, err := r.toPortMapping()
+				if err != nil {
+					c.logf(base.LevelWarn, "GetListOfPortMappings", "igd: skipping entry: %s\n", err)
+					continue
+				}
+				c.logf(base.LevelDebug, "GetListOfPortMappings", "'%s' %s:%d <-> :%d %s (%d sec)\n", m.Description, m.InternalIP, m.InternalPort, m.ExternalPort, m.Protocol, m.LeaseDuration)
+				resps = append(resps, *m)
+				if r.ExternalPort > lastPort {
+					lastPort = r.ExternalPort
+				}
+			}
+			if len(l.Entries) < listPageSize {
+				break
+			}
+			startPort = lastPort + 1
+		}
+	}
+	return resps, nil
+}
+
+func (c *Client) getGenericPortMappingEntries(ctx context.Context) ([]base.PortMapping, error) {
+	// IGD1 does not have GetListOfPortMappings, so emulate it with
+	// GetGenericPortMappingEntry.  Theoretically if the number of entries
 	// changes during this process we would need to start over from the
 	// begining, but we don't monitor events so we can't tell.
 
-	var resps []string
+	var resps []base.PortMapping
 	for idx := 0; idx < math.MaxUint16; idx++ {
 		argsXML := "<NewPortMappingIndex>" + strconv.FormatUint(uint64(idx), 10) + "</NewPortMappingIndex>"
-		respBody, err := c.issueSoapRequest("GetGenericPortMappingEntry", argsXML)
+		respBody, err := c.issueSoapRequest(ctx, c.ctrl, "GetGenericPortMappingEntry", argsXML)
 		if err != nil {
+			if ctx.Err() != nil {
+				// The list is incomplete, not empty.
+				return nil, ctx.Err()
+			}
 			// Probably SpecifiedArrayIndexInvalid. (XXX: Check?)
-			c.Vlogf("igd: GetGenericPortMappingEntry returned: %s\n", err)
+			c.logf(base.LevelWarn, "GetListOfPortMappings", "igd: GetGenericPortMappingEntry returned: %s\n", err)
 			break
 		}
 		if respBody.GetGenericPortMappingEntryResponse != nil {
-			// Too long, much too long.
 			r := respBody.GetGenericPortMappingEntryResponse
-			remoteHost := r.RemoteHost
-			if remoteHost == "" {
-				remoteHost = "0.0.0.0"
+			m, err := r.toPortMapping()
+			if err != nil {
+				c.logf(base.LevelWarn, "GetListOfPortMappings", "igd: skipping entry %d: %s\n", idx, err)
+				continue
 			}
-			s := fmt.Sprintf("'%s' %s:%d <-> %s:%d %s (%d sec)",
-				r.PortMappingDescription,
-				r.InternalClient,
-				r.InternalPort,
-				remoteHost,
-				r.ExternalPort,
-				r.Protocol,
-				r.LeaseDuration)
-			c.Vlogf("%s\n", s)
-			resps = append(resps, s)
+			c.logf(base.LevelDebug, "GetListOfPortMappings", "%d: '%s' %s:%d <-> :%d %s (%d sec)\n", idx, m.Description, m.InternalIP, m.InternalPort, m.ExternalPort, m.Protocol, m.LeaseDuration)
+			resps = append(resps, *m)
 		}
 	}
 	return resps, nil
 }
 
-// AddPortMapping adds a new TCP/IP port mapping.  The internal IP address of
-// the client is used as the destination.  Per the UPnP spec, duration can
-// range from 0 to 604800, with the behavior on 0 changing depending on the
-// version of the spec.
-func (c *Client) AddPortMapping(descr string, internalPort, externalPort, duration int) error {
-	if duration > maxMappingDuration {
-		return syscall.ERANGE
-	}
+// GetPortMapping queries the router for the port forwarding entry for the
+// given protocol and external port.
+func (c *Client) GetPortMapping(protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	return c.GetPortMappingContext(context.Background(), protocol, externalPort)
+}
 
-	c.Vlogf("AddPortMapping: '%s' %s:%d <-> 0.0.0.0:%d (%d sec)\n", descr, c.internalAddr, internalPort, externalPort, duration)
+// GetPortMappingContext queries the router for the port forwarding entry for
+// the given protocol and external port.
+func (c *Client) GetPortMappingContext(ctx context.Context, protocol base.Protocol, externalPort int) (*base.PortMapping, error) {
+	c.logf(base.LevelDebug, "GetPortMapping", "GetSpecificPortMappingEntry: 0.0.0.0:%d %s\n", externalPort, protocol)
 
 	argsXML := "<NewRemoteHost></NewRemoteHost>" +
 		"<NewExternalPort>" + strconv.FormatUint(uint64(externalPort), 10) + "</NewExternalPort>" +
-		"<NewProtocol>TCP</NewProtocol>" +
+		"<NewProtocol>" + protocol.String() + "</NewProtocol>"
+
+	// A missing entry is NoSuchEntryInArray, which is in
+	// base.CategoryNotFound.
+	respBody, err := c.issueSoapRequest(ctx, c.ctrl, "GetSpecificPortMappingEntry", argsXML)
+	if err != nil {
+		return nil, err
+	}
+	r := respBody.GetSpecificPortMappingEntryResponse
+	if r == nil {
+		return nil, fmt.Errorf("igd: GetSpecificPortMappingEntry() failed")
+	}
+	m := &base.PortMapping{
+		Description:   r.PortMappingDescription,
+		InternalIP:    net.ParseIP(r.InternalClient),
+		InternalPort:  r.InternalPort,
+		ExternalPort:  externalPort,
+		Protocol:      protocol,
+		Enabled:       r.Enabled != 0,
+		LeaseDuration: r.LeaseDuration,
+	}
+	return m, nil
+}
+
+// AddPortMapping adds a new port mapping for the given protocol.  The internal
+// IP address of the client is used as the destination.  Per the UPnP spec,
+// duration can range from 0 to 604800, with the behavior on 0 changing
+// depending on the version of the spec, and is clamped to the range in the
+// router's service description, if any.  If the router refuses the lease, the
+// mapping is retried with the other kind of lease (See LeasePolicy), and the
+// lease that was granted is returned.  If the external port is taken, and
+// base.Options.AlternatePort is set, another port is mapped, either by the
+// router via AddAnyPortMapping if it is supported, or by trying the ports
+// after the requested one.
+func (c *Client) AddPortMapping(descr string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	return c.AddPortMappingContext(context.Background(), descr, protocol, internalPort, externalPort, duration)
+}
+
+// AddPortMappingContext adds a new port mapping for the given protocol.
+func (c *Client) AddPortMappingContext(ctx context.Context, descr string, protocol base.Protocol, internalPort, externalPort, duration int) (*base.PortMapping, error) {
+	if descr == "" {
+		descr = c.opts.Description
+	}
+	if duration < 0 || duration > maxMappingDuration {
+		return nil, syscall.ERANGE
+	}
+	duration = c.applyLeasePolicy(duration)
+
+	err := c.addPortMapping(ctx, descr, protocol, internalPort, externalPort, duration)
+	if err != nil && c.leasePolicy == LeasePolicyAny && isLeaseRefusal(err) {
+		alt, policy := c.alternateLease(duration)
+		c.logf(base.LevelInfo, "AddPortMapping", "igd: router refused a %d sec lease (%s), retrying with %d sec\n", duration, err, alt)
+		err = c.addPortMapping(ctx, descr, protocol, internalPort, externalPort, alt)
+
+		// A fault other than a lease refusal (Eg: ConflictInMappingEntry)
+		// means that the router got past the lease, so stick with it,
+		// including for the alternate port search.
+		var fault *base.Error
+		if err == nil || (errors.As(err, &fault) && !isLeaseRefusal(err)) {
+			c.logf(base.LevelInfo, "AddPortMapping", "igd: router requires %s leases\n", policy)
+			c.leasePolicy = policy
+			duration = alt
+			if c.opts.Cache != nil {
+				c.storeCached()
+			}
+		}
+	}
+	if err != nil && c.opts.AlternatePort && errors.Is(err, base.CategoryConflict) {
+		var port int
+		if port, err = c.addAlternatePortMapping(ctx, descr, protocol, internalPort, externalPort, duration, err); err == nil {
+			c.logf(base.LevelInfo, "AddPortMapping", "igd: mapped external port %d in place of %d\n", port, externalPort)
+			externalPort = port
+		}
+	}
+	if err != nil {
+		c.logf(base.LevelWarn, "AddPortMapping", "igd: AddPortMapping failed: %s\n", err)
+		return nil, err
+	}
+	m := &base.PortMapping{
+		Description:   descr,
+		InternalIP:    c.internalAddr,
+		InternalPort:  internalPort,
+		ExternalPort:  externalPort,
+		Protocol:      protocol,
+		Enabled:       true,
+		LeaseDuration: c.effectiveLease(duration),
+	}
+	return m, nil
+}
+
+func (c *Client) addPortMapping(ctx context.Context, descr string, protocol base.Protocol, internalPort, externalPort, duration int) error {
+	c.logf(base.LevelDebug, "AddPortMapping", "AddPortMapping: '%s' %s:%d <-> 0.0.0.0:%d %s (%d sec)\n", descr, c.internalAddr, internalPort, externalPort, protocol, duration)
+
+	// HTTP 200 means that things worked.  The response isn't interesting
+	// enough to warrant parsing.
+	_, err := c.issueSoapRequest(ctx, c.ctrl, "AddPortMapping", c.mappingArgsXML(descr, protocol, internalPort, externalPort, duration))
+	return err
+}
+
+// addAlternatePortMapping maps some other external port than externalPort,
+// which was refused with conflictErr, and returns the port.
+func (c *Client) addAlternatePortMapping(ctx context.Context, descr string, protocol base.Protocol, internalPort, externalPort, duration int, conflictErr error) (int, error) {
+	// IGD2 devices can pick a free port themselves.
+	if c.ctrl.advertises("AddAnyPortMapping") {
+		c.logf(base.LevelDebug, "AddPortMapping", "AddAnyPortMapping: '%s' %s:%d <-> 0.0.0.0:%d %s (%d sec)\n", descr, c.internalAddr, internalPort, externalPort, protocol, duration)
+		respBody, err := c.issueSoapRequest(ctx, c.ctrl, "AddAnyPortMapping", c.mappingArgsXML(descr, protocol, internalPort, externalPort, duration))
+		switch {
+		case err != nil:
+			// Search the range instead.
+			c.logf(base.LevelInfo, "AddPortMapping", "igd: AddAnyPortMapping failed: %s\n", err)
+		case respBody.AddAnyPortMappingResponse == nil:
+			c.logf(base.LevelInfo, "AddPortMapping", "igd: AddAnyPortMapping returned no reserved port\n")
+		default:
+			port := respBody.AddAnyPortMappingResponse.ReservedPort
+			if c.opts.AcceptsAlternatePort(port) {
+				return port, nil
+			}
+
+			// Undo the mapping that isn't acceptable, and search the range.
+			c.logf(base.LevelInfo, "AddPortMapping", "igd: router reserved external port %d, which is outside of %s\n", port, c.opts.AlternatePortRange)
+			c.DeletePortMappingContext(ctx, protocol, internalPort, port)
+		}
+	}
+
+	err := conflictErr
+	port := externalPort
+	for i := 0; i < maxPortSearch; i++ {
+		if port = c.opts.AlternatePortRange.Next(port); port == externalPort {
+			break
+		}
+		if err = c.addPortMapping(ctx, descr, protocol, internalPort, port, duration); err == nil {
+			return port, nil
+		}
+		if !errors.Is(err, base.CategoryConflict) {
+			break
+		}
+	}
+	return 0, err
+}
+
+func (c *Client) mappingArgsXML(descr string, protocol base.Protocol, internalPort, externalPort, duration int) string {
+	return "<NewRemoteHost></NewRemoteHost>" +
+		"<NewExternalPort>" + strconv.FormatUint(uint64(externalPort), 10) + "</NewExternalPort>" +
+		"<NewProtocol>" + protocol.String() + "</NewProtocol>" +
 		"<NewInternalPort>" + strconv.FormatUint(uint64(internalPort), 10) + "</NewInternalPort>" +
 		"<NewInternalClient>" + c.internalAddr.String() + "</NewInternalClient>" +
 		"<NewEnabled>1</NewEnabled>" +
-		"<NewPortMappingDescription>" + descr + "</NewPortMappingDescription>" +
+		"<NewPortMappingDescription>" + xmlEscape(descr) + "</NewPortMappingDescription>" +
 		"<NewLeaseDuration>" + strconv.FormatUint(uint64(duration), 10) + "</NewLeaseDuration>"
+}
 
-	// HTTP 200 means that things worked.  The response isn't interesting
-	// enough to warrant parsing.
-	_, err := c.issueSoapRequest("AddPortMapping", argsXML)
-	if err != nil {
-		c.Vlogf("igd: AddPortMapping failed: %s\n", err)
-		return err
-	}
-	return nil
+// xmlEscape escapes s for use as character data, since requests are crafted
+// by hand.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// DeletePortMapping removes an existing port forwarding entry for the given
+// protocol between clientIP:internalPort and 0.0.0.0:externalPort.
+func (c *Client) DeletePortMapping(protocol base.Protocol, internalPort, externalPort int) error {
+	return c.DeletePortMappingContext(context.Background(), protocol, internalPort, externalPort)
 }
 
-// DeletePortMapping removes an existing TCP/IP port forwarding entry
-// between clientIP:internalPort and 0.0.0.0:externalPort.
-func (c *Client) DeletePortMapping(internalPort, externalPort int) error {
-	c.Vlogf("DeletePortMapping: %s:%d <-> 0.0.0.0:%d\n", c.internalAddr, internalPort, externalPort)
+// DeletePortMappingContext removes an existing port forwarding entry.
+func (c *Client) DeletePortMappingContext(ctx context.Context, protocol base.Protocol, internalPort, externalPort int) error {
+	c.logf(base.LevelDebug, "DeletePortMapping", "DeletePortMapping: %s:%d <-> 0.0.0.0:%d %s\n", c.internalAddr, internalPort, externalPort, protocol)
 
 	argsXML := "<NewRemoteHost></NewRemoteHost>" +
 		"<NewExternalPort>" + strconv.FormatUint(uint64(externalPort), 10) + "</NewExternalPort>" +
-		"<NewProtocol>TCP</NewProtocol>"
+		"<NewProtocol>" + protocol.String() + "</NewProtocol>"
 
 	// HTTP 200 means that things worked.  The response isn't interesting
 	// enough to warrant parsing.
-	_, err := c.issueSoapRequest("DeletePortMapping", argsXML)
+	_, err := c.issueSoapRequest(ctx, c.ctrl, "DeletePortMapping", argsXML)
 	if err != nil {
-		c.Vlogf("igd: DeletePortMapping failed: %s\n", err)
+		c.logf(base.LevelWarn, "DeletePortMapping", "igd: DeletePortMapping failed: %s\n", err)
 		return err
 	}
 	return nil
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/upnp/upnptest"
+)
+
+const testDescr = "tor-fw-helper test"
+
+// newTestClient starts a fake IGD with cfg, and discovers it.
+func newTestClient(t *testing.T, cfg *upnptest.Config, opts *base.Options) (*upnptest.IGD, *Client) {
+	t.Helper()
+	igd, err := upnptest.New(cfg)
+	if err != nil {
+		t.Fatalf("upnptest.New() failed: %s", err)
+	}
+	if opts == nil {
+		opts = &base.Options{}
+	}
+	opts.SSDPMX = 1
+	f := &ClientFactory{SSDPAddr: igd.SSDPAddr()}
+	c, err := f.New(opts)
+	if err != nil {
+		igd.Close()
+		t.Fatalf("New() failed: %s", err)
+	}
+	return igd, c.(*Client)
+}
+
+func TestDiscover(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		igd, c := newTestClient(t, &upnptest.Config{Version: version}, nil)
+		if c.ctrl.urn.version != version {
+			t.Errorf("IGD%d: discovered version %d", version, c.ctrl.urn.version)
+		}
+		r := c.Router()
+		if r.Backend != methodName {
+			t.Errorf("IGD%d: Router().Backend = %s", version, r.Backend)
+		}
+		if want := "urn:schemas-upnp-org:service:WANIPConnection:" + strconv.Itoa(version); r.ServiceType != want {
+			t.Errorf("IGD%d: Router().ServiceType = %s, want %s", version, r.ServiceType, want)
+		}
+		if r.LocalAddr == nil || !r.LocalAddr.IsLoopback() {
+			t.Errorf("IGD%d: Router().LocalAddr = %v", version, r.LocalAddr)
+		}
+		c.Close()
+		igd.Close()
+	}
+}
+
+func TestPortMapping(t *testing.T) {
+	// IGD1 lists via GetGenericPortMappingEntry, IGD2 via
+	// GetListOfPortMappings.
+	for _, version := range []int{1, 2} {
+		igd, c := newTestClient(t, &upnptest.Config{Version: version}, nil)
+
+		m, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9002, 3600)
+		if err != nil {
+			t.Fatalf("IGD%d: AddPortMapping() failed: %s", version, err)
+		}
+		if m.ExternalPort != 9002 || m.InternalPort != 9001 || m.LeaseDuration != 3600 || !m.Enabled {
+			t.Errorf("IGD%d: AddPortMapping() returned %+v", version, m)
+		}
+		ms := igd.Mappings()
+		if len(ms) != 1 {
+			t.Fatalf("IGD%d: router has %d mappings, want 1", version, len(ms))
+		}
+		if ms[0].ExternalPort != 9002 || ms[0].InternalPort != 9001 || ms[0].Protocol != base.TCP ||
+			ms[0].InternalClient != c.internalAddr.String() || ms[0].Description != testDescr {
+			t.Errorf("IGD%d: router has mapping %+v", version, ms[0])
+		}
+
+		// Include a mapping that someone else made, which should be listed
+		// as well.
+		igd.AddMapping(upnptest.Mapping{ExternalPort: 53, Protocol: base.UDP, InternalPort: 53, InternalClient: "192.168.1.2", Enabled: true, Description: "dns"})
+		ents, err := c.GetListOfPortMappings()
+		if err != nil {
+			t.Fatalf("IGD%d: GetListOfPortMappings() failed: %s", version, err)
+		}
+		if len(ents) != 2 {
+			t.Fatalf("IGD%d: GetListOfPortMappings() returned %d entries, want 2", version, len(ents))
+		}
+		found := false
+		for _, e := range ents {
+			if e.Protocol == base.TCP && e.ExternalPort == 9002 {
+				found = e.InternalPort == 9001 && e.InternalIP.Equal(c.internalAddr) && e.Description == testDescr
+			}
+		}
+		if !found {
+			t.Errorf("IGD%d: GetListOfPortMappings() returned %+v", version, ents)
+		}
+
+		if err = c.DeletePortMapping(base.TCP, 9001, 9002); err != nil {
+			t.Errorf("IGD%d: DeletePortMapping() failed: %s", version, err)
+		}
+		if ms = igd.Mappings(); len(ms) != 1 || ms[0].Description != "dns" {
+			t.Errorf("IGD%d: router has mappings %+v after DeletePortMapping()", version, ms)
+		}
+		c.Close()
+		igd.Close()
+	}
+}
+
+func TestGetExternalIPAddress(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	ip, err := c.GetExternalIPAddress()
+	if err != nil {
+		t.Fatalf("GetExternalIPAddress() failed: %s", err)
+	}
+	if !ip.Equal(igd.ExternalIP()) {
+		t.Errorf("GetExternalIPAddress() = %s, want %s", ip, igd.ExternalIP())
+	}
+}
+
+func TestDeleteMissingPortMapping(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	err := c.DeletePortMapping(base.TCP, 9001, 9001)
+	if err == nil {
+		t.Fatalf("DeletePortMapping() succeeded for a missing mapping")
+	}
+	if !errors.Is(err, base.CategoryNotFound) {
+		t.Errorf("DeletePortMapping() error %q is in category %s, want %s", err, base.CategoryOf(err), base.CategoryNotFound)
+	}
+	if !errors.Is(err, ErrNoSuchEntryInArray) {
+		t.Errorf("DeletePortMapping() error %q is not ErrNoSuchEntryInArray", err)
+	}
+	var e *base.Error
+	if !errors.As(err, &e) || e.Code != 714 {
+		t.Errorf("DeletePortMapping() error %q does not carry code 714", err)
+	}
+}
+
+func TestPortMappingDescriptionEscaping(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	// The description is arbitrary user input, which must neither break
+	// the request nor inject arguments.
+	for _, descr := range []string{
+		"x<y",
+		"Tor & friends",
+		"a</NewPortMappingDescription><NewLeaseDuration>1</NewLeaseDuration><NewPortMappingDescription>b",
+	} {
+		if _, err := c.AddPortMapping(descr, base.TCP, 9001, 9001, 3600); err != nil {
+			t.Errorf("AddPortMapping(%q) failed: %s", descr, err)
+			continue
+		}
+		ms := igd.Mappings()
+		if len(ms) != 1 || ms[0].Description != descr || ms[0].LeaseDuration != 3600 {
+			t.Errorf("AddPortMapping(%q): router has mappings %+v", descr, ms)
+		}
+	}
+}
+
+func TestAlternatePortMapping(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  upnptest.Config
+		opts base.Options
+		want int
+	}{
+		// IGD1 has no AddAnyPortMapping, so the ports after the requested
+		// one are tried.
+		{"IGD1", upnptest.Config{}, base.Options{AlternatePort: true}, 9002},
+		{"IGD1 range", upnptest.Config{}, base.Options{AlternatePort: true, AlternatePortRange: base.PortRange{Min: 20000, Max: 20010}}, 20000},
+
+		// IGD2 picks the port via AddAnyPortMapping, which is undone and
+		// searched for if it is outside of the range.
+		{"IGD2", upnptest.Config{Version: 2}, base.Options{AlternatePort: true}, 9002},
+		{"IGD2 range", upnptest.Config{Version: 2}, base.Options{AlternatePort: true, AlternatePortRange: base.PortRange{Min: 20000, Max: 20010}}, 20000},
+		{"IGD2 without AddAnyPortMapping", upnptest.Config{Version: 2, Actions: []string{"GetExternalIPAddress", "GetStatusInfo", "AddPortMapping", "DeletePortMapping", "GetGenericPortMappingEntry"}}, base.Options{AlternatePort: true}, 9002},
+
+		// A failed AddAnyPortMapping falls back to searching.
+		{"IGD2 AddAnyPortMapping fails", upnptest.Config{Version: 2, Faults: map[string]int{"AddAnyPortMapping": 501}}, base.Options{AlternatePort: true}, 9002},
+	} {
+		opts := tc.opts
+		igd, c := newTestClient(t, &tc.cfg, &opts)
+		igd.AddMapping(upnptest.Mapping{ExternalPort: 9001, Protocol: base.TCP, InternalPort: 9001, InternalClient: "192.168.1.2", Enabled: true})
+
+		m, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600)
+		if err != nil {
+			t.Errorf("%s: AddPortMapping() failed: %s", tc.name, err)
+		} else if m.ExternalPort != tc.want {
+			t.Errorf("%s: AddPortMapping() mapped external port %d, want %d", tc.name, m.ExternalPort, tc.want)
+		}
+		found := false
+		for _, rm := range igd.Mappings() {
+			if rm.InternalClient == c.internalAddr.String() {
+				if found || rm.ExternalPort != tc.want {
+					t.Errorf("%s: router has mapping %+v", tc.name, rm)
+				}
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: router has no mapping for the client", tc.name)
+		}
+		c.Close()
+		igd.Close()
+	}
+}
+
+func TestAlternatePortMappingDisabled(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	igd.AddMapping(upnptest.Mapping{ExternalPort: 9001, Protocol: base.TCP, InternalPort: 9001, InternalClient: "192.168.1.2", Enabled: true})
+	_, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600)
+	if !errors.Is(err, ErrConflictInMappingEntry) {
+		t.Errorf("AddPortMapping() error %v is not ErrConflictInMappingEntry", err)
+	}
+	if ms := igd.Mappings(); len(ms) != 1 {
+		t.Errorf("router has mappings %+v", ms)
+	}
+}
+
+func TestGetPortMapping(t *testing.T) {
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	igd.AddMapping(upnptest.Mapping{ExternalPort: 9001, Protocol: base.TCP, InternalPort: 9030, InternalClient: "192.168.1.2", Description: "someone else", LeaseDuration: 3600})
+	m, err := c.GetPortMapping(base.TCP, 9001)
+	if err != nil {
+		t.Fatalf("GetPortMapping() failed: %s", err)
+	}
+	if m.ExternalPort != 9001 || m.Protocol != base.TCP || m.InternalPort != 9030 ||
+		m.InternalIP.String() != "192.168.1.2" || m.Description != "someone else" || m.Enabled {
+		t.Errorf("GetPortMapping() returned %+v", m)
+	}
+	if m.LeaseDuration <= 0 || m.LeaseDuration > 3600 {
+		t.Errorf("GetPortMapping() returned a %d sec lease", m.LeaseDuration)
+	}
+
+	// The same port, but the other protocol, is not mapped.
+	_, err = c.GetPortMapping(base.UDP, 9001)
+	if !errors.Is(err, base.CategoryNotFound) {
+		t.Errorf("GetPortMapping() error %v is not in category %s", err, base.CategoryNotFound)
+	}
+}
+
+func TestGetPortMappingUnsupported(t *testing.T) {
+	cfg := &upnptest.Config{Actions: []string{"GetExternalIPAddress", "GetStatusInfo", "AddPortMapping", "DeletePortMapping", "GetGenericPortMappingEntry"}}
+	igd, c := newTestClient(t, cfg, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	// Unsupported is distinct from not found, so that callers can fall
+	// back to something else (Eg: the journal).
+	_, err := c.GetPortMapping(base.TCP, 9001)
+	if !errors.Is(err, base.CategoryUnsupported) {
+		t.Errorf("GetPortMapping() error %v is not in category %s", err, base.CategoryUnsupported)
+	}
+}
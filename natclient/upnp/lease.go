@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"errors"
+	"fmt"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// UPnP lease durations are a minefield.  IGD1 devices are supposed to treat
+// "0" as an indefinite lease, but some of them refuse anything else with
+// OnlyPermanentLeasesSupported, while IGD2 devices did away with indefinite
+// leases, and some of them refuse "0" with OnlyPermanentLeasesSupported or
+// InvalidArgs instead of treating it as the maximum.  AddPortMapping retries
+// with the other kind of lease when it sees one of those faults, and sticks
+// with whatever the router accepted for the rest of the Client's lifetime
+// (and in the discovery cache, if any).
+
+// LeasePolicy is the kind of lease that a router was found to require.
+type LeasePolicy int
+
+const (
+	// LeasePolicyAny is for routers that have not refused a lease.
+	LeasePolicyAny LeasePolicy = iota
+
+	// LeasePolicyIndefinite is for routers that refused a finite lease, but
+	// accepted "0".
+	LeasePolicyIndefinite
+
+	// LeasePolicyFinite is for routers that refused "0", but accepted a
+	// finite lease.
+	LeasePolicyFinite
+)
+
+func (p LeasePolicy) String() string {
+	switch p {
+	case LeasePolicyAny:
+		return "any"
+	case LeasePolicyIndefinite:
+		return "indefinite"
+	case LeasePolicyFinite:
+		return "finite"
+	default:
+		return fmt.Sprintf("[Unknown LeasePolicy: %d]", int(p))
+	}
+}
+
+func leasePolicyFromString(s string) LeasePolicy {
+	for _, p := range []LeasePolicy{LeasePolicyIndefinite, LeasePolicyFinite} {
+		if s == p.String() {
+			return p
+		}
+	}
+	return LeasePolicyAny
+}
+
+// LeasePolicy returns the kind of lease that the router was found to require
+// by AddPortMapping, LeasePolicyAny if it has not refused one.
+func (c *Client) LeasePolicy() LeasePolicy {
+	return c.leasePolicy
+}
+
+func isLeaseRefusal(err error) bool {
+	return errors.Is(err, ErrOnlyPermanentLeasesSupported) || errors.Is(err, ErrInvalidArgs)
+}
+
+// maxLease returns the longest finite lease that the router allows.
+func (c *Client) maxLease() int {
+	if _, max, ok := c.ctrl.argRange("AddPortMapping", "NewLeaseDuration"); ok && max > 0 && max < maxMappingDuration {
+		return max
+	}
+	return maxMappingDuration
+}
+
+// applyLeasePolicy returns the lease to request in place of duration, given
+// what the router is known to accept, either from refusing a previous lease,
+// or from the range in its service description.
+func (c *Client) applyLeasePolicy(duration int) int {
+	switch {
+	case c.leasePolicy == LeasePolicyIndefinite && duration != 0:
+		duration = 0
+	case c.leasePolicy == LeasePolicyFinite && duration == 0:
+		duration = c.maxLease()
+	}
+
+	min, max, ok := c.ctrl.argRange("AddPortMapping", "NewLeaseDuration")
+	if !ok || min > max {
+		return duration
+	}
+	lease := duration
+	switch {
+	case duration == 0 && min > 0:
+		// Routers that do not allow "0" require finite leases.
+		lease = c.maxLease()
+	case duration < min:
+		lease = min
+	case duration > max:
+		lease = max
+	}
+	if lease != duration {
+		c.logf(base.LevelInfo, "AddPortMapping", "igd: lease duration %d is outside of the allowed range [%d, %d], using %d\n", duration, min, max, lease)
+	}
+	return lease
+}
+
+// alternateLease returns the lease to retry with when the router refused
+// duration, and the policy that it implies.
+func (c *Client) alternateLease(duration int) (int, LeasePolicy) {
+	if duration == 0 {
+		return c.maxLease(), LeasePolicyFinite
+	}
+	return 0, LeasePolicyIndefinite
+}
+
+// effectiveLease returns the lease that the router granted for a request of
+// duration.
+func (c *Client) effectiveLease(duration int) int {
+	if duration == 0 && c.ctrl.urn.version >= 2 {
+		// IGD2 does away with indefinite leases, "0" means the maximum.
+		return maxMappingDuration
+	}
+	return duration
+}
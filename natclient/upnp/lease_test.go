@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/upnp/upnptest"
+)
+
+func TestLeaseNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      upnptest.Config
+		duration int
+
+		// policy is the LeasePolicy that the router should be found to
+		// require, and granted and routerLease are the leases reported by
+		// AddPortMapping and held by the router.
+		policy      LeasePolicy
+		granted     int
+		routerLease int
+	}{
+		{"IGD1 finite", upnptest.Config{}, 3600, LeasePolicyAny, 3600, 3600},
+		{"IGD1 permanent only", upnptest.Config{OnlyPermanentLeases: true}, 3600, LeasePolicyIndefinite, 0, 0},
+		{"IGD1 no indefinite (402)", upnptest.Config{NoIndefiniteLeases: 402}, 0, LeasePolicyFinite, maxMappingDuration, maxMappingDuration},
+		{"IGD2 indefinite", upnptest.Config{Version: 2}, 0, LeasePolicyAny, maxMappingDuration, maxMappingDuration},
+		{"IGD2 no indefinite (725)", upnptest.Config{Version: 2, NoIndefiniteLeases: 725}, 0, LeasePolicyFinite, maxMappingDuration, maxMappingDuration},
+
+		// Leases outside of the range in the service description are
+		// clamped to it, without the router having to refuse them.
+		{"IGD1 ranged indefinite", upnptest.Config{LeaseRange: []int{1, 86400}}, 0, LeasePolicyAny, 86400, 86400},
+		{"IGD1 ranged too short", upnptest.Config{LeaseRange: []int{120, 86400}}, 60, LeasePolicyAny, 120, 120},
+		{"IGD2 ranged too long", upnptest.Config{Version: 2, LeaseRange: []int{1, 86400}}, maxMappingDuration, LeasePolicyAny, 86400, 86400},
+	} {
+		igd, c := newTestClient(t, &tc.cfg, nil)
+
+		// The second mapping should use the policy learned from the
+		// first without being refused again, which the fake router would
+		// fail if the policy was not applied.
+		for _, port := range []int{9001, 9002} {
+			m, err := c.AddPortMapping(testDescr, base.TCP, port, port, tc.duration)
+			if err != nil {
+				t.Errorf("%s: AddPortMapping(%d) failed: %s", tc.name, port, err)
+				continue
+			}
+			if m.LeaseDuration != tc.granted {
+				t.Errorf("%s: AddPortMapping(%d) granted %d sec, want %d", tc.name, port, m.LeaseDuration, tc.granted)
+			}
+		}
+		if p := c.LeasePolicy(); p != tc.policy {
+			t.Errorf("%s: LeasePolicy() = %s, want %s", tc.name, p, tc.policy)
+		}
+		for _, m := range igd.Mappings() {
+			if m.LeaseDuration != tc.routerLease {
+				t.Errorf("%s: router holds a %d sec lease, want %d", tc.name, m.LeaseDuration, tc.routerLease)
+			}
+		}
+		c.Close()
+		igd.Close()
+	}
+}
+
+func TestLeaseNegotiationConflict(t *testing.T) {
+	// A conflict is not a lease refusal, and must not change the policy.
+	igd, c := newTestClient(t, nil, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	igd.AddMapping(upnptest.Mapping{ExternalPort: 9001, Protocol: base.TCP, InternalPort: 9001, InternalClient: "192.168.1.2", Enabled: true})
+	if _, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600); err == nil {
+		t.Fatalf("AddPortMapping() succeeded despite the conflict")
+	}
+	if p := c.LeasePolicy(); p != LeasePolicyAny {
+		t.Errorf("LeasePolicy() = %s after a conflict", p)
+	}
+}
+
+func TestLeaseNegotiationAlternatePort(t *testing.T) {
+	// The router refuses the finite lease, and then the port with the
+	// indefinite one, so the alternate port search must use the latter.
+	for _, version := range []int{1, 2} {
+		cfg := &upnptest.Config{Version: version, OnlyPermanentLeases: true}
+		igd, c := newTestClient(t, cfg, &base.Options{AlternatePort: true})
+		igd.AddMapping(upnptest.Mapping{ExternalPort: 9001, Protocol: base.TCP, InternalPort: 9001, InternalClient: "192.168.1.2", Enabled: true})
+
+		m, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600)
+		if err != nil {
+			t.Errorf("IGD%d: AddPortMapping() failed: %s", version, err)
+		} else if m.ExternalPort == 9001 {
+			t.Errorf("IGD%d: AddPortMapping() mapped the conflicting port", version)
+		}
+		if p := c.LeasePolicy(); p != LeasePolicyIndefinite {
+			t.Errorf("IGD%d: LeasePolicy() = %s, want %s", version, p, LeasePolicyIndefinite)
+		}
+		c.Close()
+		igd.Close()
+	}
+}
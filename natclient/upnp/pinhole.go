@@ -0,0 +1,316 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	maxPinholeDuration = 86400
+
+	ianaProtoTCP = 6
+	ianaProtoUDP = 17
+)
+
+// The WANIPv6FirewallControl service is used to open inbound pinholes in the
+// router's IPv6 firewall.  Unlike WANIPConnection, there is no address
+// translation involved, so the only thing that is needed is the host's global
+// IPv6 address.
+
+type getFwStatusResponse struct {
+	FirewallEnabled       bool `xml:"FirewallEnabled"`
+	InboundPinholeAllowed bool `xml:"InboundPinholeAllowed"`
+}
+
+type getOutPhTimeResponse struct {
+	OutboundPinholeTimeout int `xml:"OutboundPinholeTimeout"`
+}
+
+type addPinholeResponse struct {
+	UniqueID int `xml:"UniqueID"`
+}
+
+func protocolToIANA(protocol base.Protocol) (int, error) {
+	switch protocol {
+	case base.TCP:
+		return ianaProtoTCP, nil
+	case base.UDP:
+		return ianaProtoUDP, nil
+	default:
+		return 0, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+}
+
+func pinholeArgsXML(protocol base.Protocol, remoteHost net.IP, remotePort int, internalClient net.IP, internalPort int) (string, error) {
+	proto, err := protocolToIANA(protocol)
+	if err != nil {
+		return "", err
+	}
+
+	// An empty RemoteHost and a RemotePort of 0 are wildcards.
+	rHost := ""
+	if remoteHost != nil {
+		rHost = remoteHost.String()
+	}
+	argsXML := "<RemoteHost>" + rHost + "</RemoteHost>" +
+		"<RemotePort>" + strconv.FormatUint(uint64(remotePort), 10) + "</RemotePort>" +
+		"<InternalClient>" + internalClient.String() + "</InternalClient>" +
+		"<InternalPort>" + strconv.FormatUint(uint64(internalPort), 10) + "</InternalPort>" +
+		"<Protocol>" + strconv.Itoa(proto) + "</Protocol>"
+	return argsXML, nil
+}
+
+func (c *Client) requireFwCtrl() error {
+	if c.fwCtrl == nil {
+		return fmt.Errorf("igd: router does not have a %s service", wanIPv6FirewallControl)
+	}
+	return nil
+}
+
+// GetFirewallStatus queries the router for whether the IPv6 firewall is
+// enabled, and if the creation of inbound pinholes is allowed.
+func (c *Client) GetFirewallStatus() (enabled, inboundAllowed bool, err error) {
+	return c.GetFirewallStatusContext(context.Background())
+}
+
+// GetFirewallStatusContext queries the router for the IPv6 firewall status.
+func (c *Client) GetFirewallStatusContext(ctx context.Context) (enabled, inboundAllowed bool, err error) {
+	if err = c.requireFwCtrl(); err != nil {
+		return
+	}
+	respBody, err := c.issueSoapRequest(ctx, c.fwCtrl, "GetFirewallStatus", "")
+	if err != nil {
+		return
+	}
+	if r := respBody.GetFirewallStatusResponse; r != nil {
+		return r.FirewallEnabled, r.InboundPinholeAllowed, nil
+	}
+	return false, false, fmt.Errorf("igd: GetFirewallStatus() failed")
+}
+
+// GetOutboundPinholeTimeout queries the router for the timeout in seconds of
+// the implicit pinhole that is created by outbound traffic matching the
+// given parameters.
+func (c *Client) GetOutboundPinholeTimeout(protocol base.Protocol, remoteHost net.IP, remotePort int, internalClient net.IP, internalPort int) (int, error) {
+	return c.GetOutboundPinholeTimeoutContext(context.Background(), protocol, remoteHost, remotePort, internalClient, internalPort)
+}
+
+// GetOutboundPinholeTimeoutContext queries the router for the timeout of
+// implicit outbound pinholes.
+func (c *Client) GetOutboundPinholeTimeoutContext(ctx context.Context, protocol base.Protocol, remoteHost net.IP, remotePort int, internalClient net.IP, internalPort int) (int, error) {
+	if err := c.requireFwCtrl(); err != nil {
+		return 0, err
+	}
+	argsXML, err := pinholeArgsXML(protocol, remoteHost, remotePort, internalClient, internalPort)
+	if err != nil {
+		return 0, err
+	}
+	respBody, err := c.issueSoapRequest(ctx, c.fwCtrl, "GetOutboundPinholeTimeout", argsXML)
+	if err != nil {
+		return 0, err
+	}
+	if r := respBody.GetOutboundPinholeTimeoutResponse; r != nil {
+		return r.OutboundPinholeTimeout, nil
+	}
+	return 0, fmt.Errorf("igd: GetOutboundPinholeTimeout() failed")
+}
+
+// AddPinhole creates a new inbound pinhole between remoteHost:remotePort and
+// internalClient:internalPort, and returns the router assigned UniqueID.  A
+// nil remoteHost or a remotePort of 0 matches all remote peers.  Per the UPnP
+// spec, leaseTime can range from 1 to 86400.
+func (c *Client) AddPinhole(protocol base.Protocol, remoteHost net.IP, remotePort int, internalClient net.IP, internalPort, leaseTime int) (int, error) {
+	return c.AddPinholeContext(context.Background(), protocol, remoteHost, remotePort, internalClient, internalPort, leaseTime)
+}
+
+// AddPinholeContext creates a new inbound pinhole.
+func (c *Client) AddPinholeContext(ctx context.Context, protocol base.Protocol, remoteHost net.IP, remotePort int, internalClient net.IP, internalPort, leaseTime int) (int, error) {
+	if err := c.requireFwCtrl(); err != nil {
+		return 0, err
+	}
+	if leaseTime < 1 || leaseTime > maxPinholeDuration {
+		return 0, syscall.ERANGE
+	}
+
+	c.logf(base.LevelDebug, "AddPinhole", "AddPinhole: [%s]:%d %s (%d sec)\n", internalClient, internalPort, protocol, leaseTime)
+
+	argsXML, err := pinholeArgsXML(protocol, remoteHost, remotePort, internalClient, internalPort)
+	if err != nil {
+		return 0, err
+	}
+	argsXML += "<LeaseTime>" + strconv.FormatUint(uint64(leaseTime), 10) + "</LeaseTime>"
+	respBody, err := c.issueSoapRequest(ctx, c.fwCtrl, "AddPinhole", argsXML)
+	if err != nil {
+		c.logf(base.LevelWarn, "AddPinhole", "igd: AddPinhole failed: %s\n", err)
+		return 0, err
+	}
+	if r := respBody.AddPinholeResponse; r != nil {
+		c.logf(base.LevelDebug, "AddPinhole", "igd: AddPinhole UniqueID: %d\n", r.UniqueID)
+		return r.UniqueID, nil
+	}
+	return 0, fmt.Errorf("igd: AddPinhole() failed")
+}
+
+// UpdatePinhole extends the lease of an existing pinhole.
+func (c *Client) UpdatePinhole(uniqueID, leaseTime int) error {
+	return c.UpdatePinholeContext(context.Background(), uniqueID, leaseTime)
+}
+
+// UpdatePinholeContext extends the lease of an existing pinhole.
+func (c *Client) UpdatePinholeContext(ctx context.Context, uniqueID, leaseTime int) error {
+	if err := c.requireFwCtrl(); err != nil {
+		return err
+	}
+	if leaseTime < 1 || leaseTime > maxPinholeDuration {
+		return syscall.ERANGE
+	}
+
+	c.logf(base.LevelDebug, "UpdatePinhole", "UpdatePinhole: %d (%d sec)\n", uniqueID, leaseTime)
+
+	argsXML := "<UniqueID>" + strconv.FormatUint(uint64(uniqueID), 10) + "</UniqueID>" +
+		"<NewLeaseTime>" + strconv.FormatUint(uint64(leaseTime), 10) + "</NewLeaseTime>"
+	_, err := c.issueSoapRequest(ctx, c.fwCtrl, "UpdatePinhole", argsXML)
+	if err != nil {
+		c.logf(base.LevelWarn, "UpdatePinhole", "igd: UpdatePinhole failed: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// DeletePinhole removes an existing pinhole.
+func (c *Client) DeletePinhole(uniqueID int) error {
+	return c.DeletePinholeContext(context.Background(), uniqueID)
+}
+
+// DeletePinholeContext removes an existing pinhole.
+func (c *Client) DeletePinholeContext(ctx context.Context, uniqueID int) error {
+	if err := c.requireFwCtrl(); err != nil {
+		return err
+	}
+
+	c.logf(base.LevelDebug, "DeletePinhole", "DeletePinhole: %d\n", uniqueID)
+
+	argsXML := "<UniqueID>" + strconv.FormatUint(uint64(uniqueID), 10) + "</UniqueID>"
+	_, err := c.issueSoapRequest(ctx, c.fwCtrl, "DeletePinhole", argsXML)
+	if err != nil {
+		c.logf(base.LevelWarn, "DeletePinhole", "igd: DeletePinhole failed: %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// OpenIPv6Pinhole opens an inbound pinhole to the host's global IPv6 address
+// and internalPort.  A 0 duration will request a 86400 second lease.
+func (c *Client) OpenIPv6Pinhole(protocol base.Protocol, internalPort, duration int) (*base.Pinhole, error) {
+	return c.OpenIPv6PinholeContext(context.Background(), protocol, internalPort, duration)
+}
+
+// OpenIPv6PinholeContext opens an inbound pinhole to the host's global IPv6
+// address and internalPort.
+func (c *Client) OpenIPv6PinholeContext(ctx context.Context, protocol base.Protocol, internalPort, duration int) (*base.Pinhole, error) {
+	if duration == 0 {
+		duration = maxPinholeDuration
+	}
+
+	enabled, inboundAllowed, err := c.GetFirewallStatusContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		// Nothing to do, inbound traffic is not being filtered.
+		c.logf(base.LevelWarn, "OpenIPv6Pinhole", "igd: IPv6 firewall is disabled\n")
+		return &base.Pinhole{InternalPort: internalPort, Protocol: protocol}, nil
+	}
+	if !inboundAllowed {
+		return nil, fmt.Errorf("igd: router does not allow inbound pinholes")
+	}
+
+	addr, err := localIPv6Addr(c.internalAddr)
+	if err != nil {
+		c.logf(base.LevelWarn, "OpenIPv6Pinhole", "failed to determine local IPv6 address: %s\n", err)
+		return nil, err
+	}
+	uniqueID, err := c.AddPinholeContext(ctx, protocol, nil, 0, addr, internalPort, duration)
+	if err != nil {
+		return nil, err
+	}
+	p := &base.Pinhole{
+		UniqueID:      uniqueID,
+		InternalIP:    addr,
+		InternalPort:  internalPort,
+		Protocol:      protocol,
+		LeaseDuration: duration,
+	}
+	return p, nil
+}
+
+// RenewIPv6Pinhole extends the lease of a pinhole opened by OpenIPv6Pinhole.
+// A 0 duration will request a 86400 second lease.
+func (c *Client) RenewIPv6Pinhole(uniqueID, duration int) (int, error) {
+	return c.RenewIPv6PinholeContext(context.Background(), uniqueID, duration)
+}
+
+// RenewIPv6PinholeContext extends the lease of a pinhole opened by
+// OpenIPv6Pinhole.
+func (c *Client) RenewIPv6PinholeContext(ctx context.Context, uniqueID, duration int) (int, error) {
+	if duration == 0 {
+		duration = maxPinholeDuration
+	}
+	if err := c.UpdatePinholeContext(ctx, uniqueID, duration); err != nil {
+		return 0, err
+	}
+	return duration, nil
+}
+
+// CloseIPv6Pinhole closes a pinhole opened by OpenIPv6Pinhole.
+func (c *Client) CloseIPv6Pinhole(uniqueID int) error {
+	return c.DeletePinholeContext(context.Background(), uniqueID)
+}
+
+// CloseIPv6PinholeContext closes a pinhole opened by OpenIPv6Pinhole.
+func (c *Client) CloseIPv6PinholeContext(ctx context.Context, uniqueID int) error {
+	return c.DeletePinholeContext(ctx, uniqueID)
+}
+
+// localIPv6Addr returns a global IPv6 address belonging to the same interface
+// as the IPv4 address that is used to talk to the router.
+func localIPv6Addr(v4Addr net.IP) (net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		isLANIface := false
+		var candidates []net.IP
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.Equal(v4Addr) {
+				isLANIface = true
+			} else if ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+				candidates = append(candidates, ipNet.IP)
+			}
+		}
+		if isLANIface && len(candidates) > 0 {
+			return candidates[0], nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find a global IPv6 address")
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// The Service Control Protocol Description (SCPD) document lists the actions
+// that a service implements, along with their arguments, and the state
+// variables that the arguments are typed by.  Optional actions (and a
+// surprising number of "required" ones) are frequently missing, so the
+// document is used to avoid issuing actions that the router does not
+// support.
+
+type scpdRoot struct {
+	Actions   []scpdAction        `xml:"actionList>action"`
+	StateVars []scpdStateVariable `xml:"serviceStateTable>stateVariable"`
+}
+
+type scpdAction struct {
+	Name      string         `xml:"name"`
+	Arguments []scpdArgument `xml:"argumentList>argument"`
+}
+
+type scpdArgument struct {
+	Name                 string `xml:"name"`
+	Direction            string `xml:"direction"`
+	RelatedStateVariable string `xml:"relatedStateVariable"`
+}
+
+type scpdStateVariable struct {
+	Name          string   `xml:"name"`
+	DataType      string   `xml:"dataType"`
+	DefaultValue  string   `xml:"defaultValue"`
+	AllowedValues []string `xml:"allowedValueList>allowedValue"`
+	AllowedRange  *struct {
+		Minimum string `xml:"minimum"`
+		Maximum string `xml:"maximum"`
+		Step    string `xml:"step"`
+	} `xml:"allowedValueRange"`
+}
+
+// serviceDescription is the parsed SCPD of a service.
+type serviceDescription struct {
+	actions   map[string]*scpdAction
+	stateVars map[string]*scpdStateVariable
+}
+
+// actionNotSupportedError is the error returned when attempting to issue an
+// action that the service does not advertise.
+type actionNotSupportedError struct {
+	kindType string
+	action   string
+}
+
+func (e *actionNotSupportedError) Error() string {
+	return fmt.Sprintf("igd: %s does not support %s", e.kindType, e.action)
+}
+
+// Unwrap returns base.CategoryUnsupported, so that the error is categorized
+// like the InvalidAction fault that the router would have returned.
+func (e *actionNotSupportedError) Unwrap() error {
+	return base.CategoryUnsupported
+}
+
+func (c *Client) retrieveServiceDescription(ctx context.Context, cp *controlPoint) (*serviceDescription, error) {
+	if cp.scpdURL == nil {
+		return nil, fmt.Errorf("service has no SCPDURL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", cp.scpdURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.opts.UserAgent)
+	resp, err := c.newHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SCPD fetch failed with status: %s", resp.Status)
+	}
+	xmlDoc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	scpd := &scpdRoot{}
+	if err = xml.Unmarshal(xmlDoc, scpd); err != nil {
+		return nil, err
+	}
+
+	// A SCPD without any actions is useless (and more likely to be broken
+	// than correct), so treat it as a failure.
+	if len(scpd.Actions) == 0 {
+		return nil, fmt.Errorf("SCPD has no actions")
+	}
+	sd := &serviceDescription{
+		actions:   make(map[string]*scpdAction),
+		stateVars: make(map[string]*scpdStateVariable),
+	}
+	for i := range scpd.Actions {
+		a := &scpd.Actions[i]
+		sd.actions[strings.TrimSpace(a.Name)] = a
+	}
+	for i := range scpd.StateVars {
+		v := &scpd.StateVars[i]
+		sd.stateVars[strings.TrimSpace(v.Name)] = v
+	}
+	return sd, nil
+}
+
+func (c *Client) fetchServiceDescription(ctx context.Context, cp *controlPoint) {
+	// 3. Pull down the "Service Description" document.
+	//
+	// Plenty of routers serve garbage (or nothing at all) here while
+	// implementing the service just fine, so failure is not fatal, and just
+	// results in all of the actions being attempted blindly.
+	c.logf(base.LevelDebug, base.OpDiscover, "downloading 'Service Description' from %s\n", cp.scpdURL)
+	sd, err := c.retrieveServiceDescription(ctx, cp)
+	if err != nil {
+		c.logf(base.LevelWarn, base.OpDiscover, "SCPD download failed, assuming all actions are supported: %s\n", err)
+		return
+	}
+	c.logf(base.LevelDebug, base.OpDiscover, "%s supports %d actions\n", cp.urn.kindType, len(sd.actions))
+	cp.desc = sd
+}
+
+// supports returns true if the action may be issued, that is if it is
+// advertised or if the service description is unknown.
+func (cp *controlPoint) supports(action string) bool {
+	return cp.desc == nil || cp.advertises(action)
+}
+
+// advertises returns true iff the service description is known and lists the
+// action.
+func (cp *controlPoint) advertises(action string) bool {
+	if cp.desc == nil {
+		return false
+	}
+	_, ok := cp.desc.actions[action]
+	return ok
+}
+
+// argRange returns the allowedValueRange of an action's argument, if the
+// service description specifies one.
+func (cp *controlPoint) argRange(action, arg string) (min, max int, ok bool) {
+	if cp.desc == nil {
+		return 0, 0, false
+	}
+	a := cp.desc.actions[action]
+	if a == nil {
+		return 0, 0, false
+	}
+	for _, aa := range a.Arguments {
+		if aa.Name != arg {
+			continue
+		}
+		v := cp.desc.stateVars[aa.RelatedStateVariable]
+		if v == nil || v.AllowedRange == nil {
+			return 0, 0, false
+		}
+		var err error
+		if min, err = strconv.Atoi(strings.TrimSpace(v.AllowedRange.Minimum)); err != nil {
+			return 0, 0, false
+		}
+		if max, err = strconv.Atoi(strings.TrimSpace(v.AllowedRange.Maximum)); err != nil {
+			return 0, 0, false
+		}
+		return min, max, true
+	}
+	return 0, 0, false
+}
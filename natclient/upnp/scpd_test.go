@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"errors"
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/upnp/upnptest"
+)
+
+func TestServiceDescription(t *testing.T) {
+	cfg := &upnptest.Config{
+		Version: 2,
+		Actions: []string{"GetExternalIPAddress", "GetStatusInfo", "AddPortMapping", "GetGenericPortMappingEntry"},
+	}
+	igd, c := newTestClient(t, cfg, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	if c.ctrl.desc == nil {
+		t.Fatalf("service description was not retrieved")
+	}
+	for _, a := range cfg.Actions {
+		if !c.ctrl.advertises(a) {
+			t.Errorf("advertises(%s) = false", a)
+		}
+	}
+	for _, a := range []string{"DeletePortMapping", "AddAnyPortMapping", "GetListOfPortMappings"} {
+		if c.ctrl.advertises(a) || c.ctrl.supports(a) {
+			t.Errorf("%s is advertised or supported", a)
+		}
+	}
+
+	// Unadvertised actions fail without being issued.
+	if _, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600); err != nil {
+		t.Fatalf("AddPortMapping() failed: %s", err)
+	}
+	err := c.DeletePortMapping(base.TCP, 9001, 9001)
+	var nsErr *actionNotSupportedError
+	if !errors.As(err, &nsErr) {
+		t.Errorf("DeletePortMapping() error %q is not an actionNotSupportedError", err)
+	}
+	if !errors.Is(err, base.CategoryUnsupported) {
+		t.Errorf("DeletePortMapping() error %q is in category %s, want %s", err, base.CategoryOf(err), base.CategoryUnsupported)
+	}
+	if ms := igd.Mappings(); len(ms) != 1 {
+		t.Errorf("router has mappings %+v after an unsupported DeletePortMapping()", ms)
+	}
+
+	// The optional GetListOfPortMappings is not used when it is not
+	// advertised, even on IGD2.
+	ents, err := c.GetListOfPortMappings()
+	if err != nil {
+		t.Fatalf("GetListOfPortMappings() failed: %s", err)
+	}
+	if len(ents) != 1 || ents[0].ExternalPort != 9001 {
+		t.Errorf("GetListOfPortMappings() returned %+v", ents)
+	}
+}
+
+func TestNoServiceDescription(t *testing.T) {
+	// Without a service description, every action is attempted.
+	igd, c := newTestClient(t, &upnptest.Config{Version: 2, NoSCPD: true}, nil)
+	defer igd.Close()
+	defer c.Close()
+
+	if c.ctrl.desc != nil {
+		t.Fatalf("service description was retrieved despite NoSCPD")
+	}
+	if !c.ctrl.supports("GetListOfPortMappings") || c.ctrl.advertises("GetListOfPortMappings") {
+		t.Errorf("unknown actions must be supported, but not advertised")
+	}
+	if _, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600); err != nil {
+		t.Fatalf("AddPortMapping() failed: %s", err)
+	}
+	if ents, err := c.GetListOfPortMappings(); err != nil || len(ents) != 1 {
+		t.Errorf("GetListOfPortMappings() = %+v, %v", ents, err)
+	}
+	if err := c.DeletePortMapping(base.TCP, 9001, 9001); err != nil {
+		t.Errorf("DeletePortMapping() failed: %s", err)
+	}
+}
@@ -6,18 +6,20 @@
 package upnp
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/http/httptrace"
 	"net/url"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
 	"git.torproject.org/tor-fw-helper.git/natclient/upnp/httpu"
 )
 
@@ -26,22 +28,34 @@ const (
 	mSearchURL    = "*"
 	mSearchHost   = "239.255.255.250:1900"
 	mSearchMan    = "\"ssdp:discover\""
-	mSearchMx     = "2"
+	mSearchMx     = 2
 	mSearchStRoot = "upnp:rootdevice"
 
 	internetGatewayDevice = "InternetGatewayDevice"
+	layer3Forwarding      = "Layer3Forwarding"
 	wanDevice             = "WANDevice"
 	wanConnectionDevice   = "WANConnectionDevice"
 	wanIPConnection       = "WANIPConnection"
 	wanPPPConnection      = "WANPPPConnection"
 
-	maxRetries     = 3
-	requestTimeout = 2 * time.Second // Match mSearchMx
+	wanIPv6FirewallControl = "WANIPv6FirewallControl"
+
+	maxRetries = 3
+
+	// httpRequestTimeout bounds each HTTP (device/service description, SOAP)
+	// request, so that a router that accepts the connection but never
+	// responds can not hang the client indefinitely.
+	httpRequestTimeout = 10 * time.Second
 )
 
 type controlPoint struct {
-	url *url.URL
-	urn *upnpURN
+	url      *url.URL
+	urn      *upnpURN
+	eventURL *url.URL
+	scpdURL  *url.URL
+
+	// desc is the service description, nil if it is unknown.
+	desc *serviceDescription
 }
 
 type upnpURN struct {
@@ -121,25 +135,70 @@ func (s *upnpService) is(k string) bool {
 	return urn.kind == "service" && urn.kindType == k
 }
 
-func (d *upnpDevice) findChild(k string) *upnpDevice {
-	for _, dd := range d.DeviceList.Device {
-		if dd.is(k) {
-			return &dd
+func (d *upnpDevice) findChildren(k string) []*upnpDevice {
+	var ret []*upnpDevice
+	for i := range d.DeviceList.Device {
+		if dd := &d.DeviceList.Device[i]; dd.is(k) {
+			ret = append(ret, dd)
 		}
 	}
-	return nil
+	return ret
 }
 
-func (d *upnpDevice) findService(k string) *upnpService {
-	for _, s := range d.ServiceList.Service {
-		if s.is(k) {
-			return &s
+func (d *upnpDevice) findServices(k string) []*upnpService {
+	var ret []*upnpService
+	for i := range d.ServiceList.Service {
+		if s := &d.ServiceList.Service[i]; s.is(k) {
+			ret = append(ret, s)
 		}
 	}
+	return ret
+}
+
+func (d *upnpDevice) findService(k string) *upnpService {
+	if s := d.findServices(k); len(s) > 0 {
+		return s[0]
+	}
 	return nil
 }
 
-func (c *Client) discover() (cp *controlPoint, localAddr net.IP, err error) {
+func resolveURL(urlBase *url.URL, ref string) (*url.URL, error) {
+	if urlBase != nil {
+		// The URL is relative, so build it using urlBase.  This assumes that
+		// none of the routers use a BaseURL or URL that contains querys or
+		// fragments, which may be incorrect.
+		u := *urlBase
+		u.Path = path.Join(u.Path, ref)
+		return &u, nil
+	}
+
+	// The URL is absolute.
+	return url.Parse(ref)
+}
+
+func newControlPoint(urlBase *url.URL, s *upnpService) (*controlPoint, error) {
+	var err error
+	cp := &controlPoint{}
+	if cp.url, err = resolveURL(urlBase, s.ControlURL); err != nil {
+		return nil, err
+	}
+	if cp.urn, err = parseURN(s.ServiceType); err != nil {
+		return nil, err
+	}
+	if s.SCPDURL != "" {
+		// Likewise for the SCPDURL, since the service description is only
+		// used as a hint.
+		cp.scpdURL, _ = resolveURL(urlBase, s.SCPDURL)
+	}
+	if s.EventSubURL != "" {
+		// Eventing is optional as far as we are concerned, so a malformed
+		// eventSubURL is not fatal.
+		cp.eventURL, _ = resolveURL(urlBase, s.EventSubURL)
+	}
+	return cp, nil
+}
+
+func (c *Client) discover(ctx context.Context, ssdpAddr string) (cp, fwCp *controlPoint, localAddr net.IP, err error) {
 	// The uPNP discovery process is 3 steps.
 	//  1. Figure out where the relevant device is via M-SEARCH over UDP
 	//     multicast.
@@ -148,27 +207,31 @@ func (c *Client) discover() (cp *controlPoint, localAddr net.IP, err error) {
 	//  3. Pull down the "Service Description" document for each of the
 	//     services, to figure out the details.
 	//
-	// This implementation skips step 3 because all of the desired services are
-	// so basic that only the most shady fly-by-night of uPNP implementors will
-	// screw them up to the point where our calls don't "work" (Note: At least
-	// historically, most shady fly-by-night uPNP implementors like Broadcom
-	// have screwed up UPnP to the point where "work" is loosely defined.)
+	// Step 3 is used to figure out which actions are supported, but only as a
+	// hint, because the most shady fly-by-night of uPNP implementors manage to
+	// screw up the service description while the services themselves "work"
+	// (Note: At least historically, most shady fly-by-night uPNP implementors
+	// like Broadcom have screwed up UPnP to the point where "work" is loosely
+	// defined.)
 
 	// 1. Find the target devices.
-	c.Vlogf("probing for UPNP root devices via M-SEARCH\n")
-	rootXMLLocs, err := discoverRootDevices()
+	c.logf(base.LevelDebug, base.OpDiscover, "probing for UPNP root devices via M-SEARCH\n")
+	rootXMLLocs, err := c.discoverRootDevices(ctx, ssdpAddr)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	c.Vlogf("received %d potential root devices\n", len(rootXMLLocs))
+	c.logf(base.LevelDebug, base.OpDiscover, "received %d potential root devices\n", len(rootXMLLocs))
 
 	for _, rootLoc := range rootXMLLocs {
 		// 2. Pull down the "Device Description" document.
-		c.Vlogf("downloading 'Device Description' from %s\n", rootLoc)
-		rootXML, localAddr, err := retrieveDeviceDescription(rootLoc)
+		c.logf(base.LevelDebug, base.OpDiscover, "downloading 'Device Description' from %s\n", rootLoc)
+		rootXML, localAddr, err := c.retrieveDeviceDescription(ctx, rootLoc)
 		if err != nil {
-			c.Vlogf("download failed: %s\n", err)
+			c.logf(base.LevelWarn, base.OpDiscover, "download failed: %s\n", err)
+			if ctx.Err() != nil {
+				return nil, nil, nil, ctx.Err()
+			}
 			continue
 		}
 
@@ -176,6 +239,8 @@ func (c *Client) discover() (cp *controlPoint, localAddr net.IP, err error) {
 		//
 		//  -+- InternetGatewayDevice
 		//       |
+		//       +- Layer3Forwarding (Service)
+		//       |
 		//       +- WANDevice
 		//       |   |
 		//       |   +- WANConnectionDevice
@@ -183,12 +248,12 @@ func (c *Client) discover() (cp *controlPoint, localAddr net.IP, err error) {
 		//       |   |   +- WANIPConnection (Service)
 		//       |   |   |
 		//       |   |   +- WANPPPConnection (Service)
+		//       |   |   |
+		//       |   |   +- WANIPv6FirewallControl (Service, IGD2)
 		//
-		// Ugh.  Technically things under the InternetGatewayDevice can be
-		// duplicated, but if anyone has a multihomed home router with more
-		// than one uplink connection, it's probably ok to assume that they
-		// can setup port forwarding themselves, or can pay someone to do so.
-		cp = &controlPoint{}
+		// Ugh.  Everything under the InternetGatewayDevice can be duplicated,
+		// and frequently is on DSL/fiber routers, so all of the connection
+		// services are checked to find the one that is actually in use.
 		var urlBase *url.URL
 		if rootXML.SpecVersion.Major == 1 && rootXML.SpecVersion.Minor == 0 {
 			// uPNP 1.0 has an optional URLBase that is used as the base for
@@ -197,7 +262,7 @@ func (c *Client) discover() (cp *controlPoint, localAddr net.IP, err error) {
 			if rootXML.URLBase != "" {
 				urlBase, err = url.Parse(rootXML.URLBase)
 				if err != nil {
-					c.Vlogf("malformed URLBase: %s\n", err)
+					c.logf(base.LevelWarn, base.OpDiscover, "malformed URLBase: %s\n", err)
 					continue
 				}
 			} else {
@@ -207,62 +272,50 @@ func (c *Client) discover() (cp *controlPoint, localAddr net.IP, err error) {
 				urlBase = &url.URL{Scheme: rootLoc.Scheme, Host: rootLoc.Host}
 			}
 		}
-		rootD := rootXML.Device // InternetGatewayDevice
-		c.Vlogf("device: %s - %s\n", rootD.Manufacturer, rootD.ModelName)
+		rootD := &rootXML.Device // InternetGatewayDevice
+		c.logf(base.LevelInfo, base.OpDiscover, "device: %s - %s\n", rootD.Manufacturer, rootD.ModelName)
 		if !rootD.is(internetGatewayDevice) {
-			c.Vlogf("root device is not a %s\n", internetGatewayDevice)
-			continue
-		}
-		wanD := rootD.findChild(wanDevice) // WANDevice
-		if wanD == nil {
-			c.Vlogf("device does not have a %s\n", wanDevice)
+			c.logf(base.LevelDebug, base.OpDiscover, "root device is not a %s\n", internetGatewayDevice)
 			continue
 		}
-		wanConnD := wanD.findChild(wanConnectionDevice) // WANConnectionDevice
-		if wanConnD == nil {
-			c.Vlogf("device does not have a %s\n", wanConnectionDevice)
+		w, err := c.selectWANConnection(ctx, urlBase, rootD)
+		if err != nil {
+			c.logf(base.LevelWarn, base.OpDiscover, "%s\n", err)
+			if ctx.Err() != nil {
+				return nil, nil, nil, ctx.Err()
+			}
 			continue
 		}
-
-		// WANIPConnection is the prefered service to use, though a lot of
-		// routers export both, and really old DSL modems only export one.
-		// Check both, with preference towards the new hotness, what we want to
-		// do works with either.
-		okServices := []string{wanIPConnection, wanPPPConnection}
-		for _, svc := range okServices {
-			s := wanConnD.findService(svc)
-			if s != nil {
-				if urlBase != nil {
-					// ControlURL is relative, so build it using urlBase.
-					// This assumes that none of the routers use a BaseURL or
-					// ControlURL that contains querys or fragments, which may
-					// be incorrect.
-					cp.url = urlBase
-					cp.url.Path = path.Join(cp.url.Path, s.ControlURL)
-				} else {
-					// ControlURL is absolute.
-					cp.url, err = url.Parse(s.ControlURL)
-					if err != nil {
-						c.Vlogf("malformed ControlURL: %s\n", err)
-						continue
-					}
-				}
-				cp.urn, _ = parseURN(s.ServiceType)
-
-				// 3. Pull down the "Service Description" document. (Skipped)
-				c.Vlogf("found a %s at %s\n", cp.urn.kindType, cp.url)
-				c.Vlogf("local IP is %s\n", localAddr)
-
-				return cp, localAddr, nil
+		cp = w.cp
+		c.logf(base.LevelInfo, base.OpDiscover, "using %s at %s\n", cp.urn.kindType, cp.url)
+		c.logf(base.LevelInfo, base.OpDiscover, "local IP is %s\n", localAddr)
+		c.fetchServiceDescription(ctx, cp)
+
+		// IGD2 devices that support IPv6 will also have a
+		// WANIPv6FirewallControl service for managing inbound pinholes.  It
+		// is optional, so failing to find it is not fatal.
+		if s := w.dev.findService(wanIPv6FirewallControl); s != nil {
+			fwCp, err = newControlPoint(urlBase, s)
+			if err != nil {
+				c.logf(base.LevelWarn, base.OpDiscover, "malformed ControlURL: %s\n", err)
+				fwCp = nil
+			} else {
+				c.logf(base.LevelDebug, base.OpDiscover, "found a %s at %s\n", fwCp.urn.kindType, fwCp.url)
+				c.fetchServiceDescription(ctx, fwCp)
 			}
 		}
 
-		c.Vlogf("device has no compatible upstream services\n")
+		if err = ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		c.udn = rootD.UDN
+		c.manufacturer, c.modelName = rootD.Manufacturer, rootD.ModelName
+		return cp, fwCp, localAddr, nil
 	}
-	return nil, nil, fmt.Errorf("failed to find a compatible service")
+	return nil, nil, nil, fmt.Errorf("failed to find a compatible service")
 }
 
-func discoverRootDevices() ([]*url.URL, error) {
+func (c *Client) discoverRootDevices(ctx context.Context, ssdpAddr string) ([]*url.URL, error) {
 	// 1.3.2 Search request with M-SEARCH
 	//
 	// This is done via a HTTPMU request.  The response is unicasted back.
@@ -278,18 +331,25 @@ func discoverRootDevices() ([]*url.URL, error) {
 	if err != nil {
 		return nil, err
 	}
-	req.Host = mSearchHost
+	req.Host = ssdpAddr
 	req.URL.Opaque = mSearchURL // NewRequest escapes the path, use Opaque.
 	req.Header.Set("MAN", mSearchMan)
-	req.Header.Set("MX", mSearchMx)
+	req.Header.Set("MX", strconv.Itoa(c.opts.SSDPMX))
 	req.Header.Set("ST", mSearchStRoot)
-	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("User-Agent", c.opts.UserAgent)
 
-	hc, err := httpu.New(outgoingPort)
+	hc, err := httpu.New(c.opts.OutgoingPort)
 	if err != nil {
 		return nil, err
 	}
-	resps, err := hc.Do(req, requestTimeout, maxRetries)
+	if c.srcAddr != nil {
+		if err = hc.SetInterfaceAddr(c.srcAddr); err != nil {
+			return nil, err
+		}
+	}
+	// Devices may take up to MX seconds to respond, so wait that long.
+	timeout := time.Duration(c.opts.SSDPMX) * time.Second
+	resps, err := hc.DoContext(ctx, req, timeout, c.opts.Retries)
 	if err != nil {
 		return nil, err
 	}
@@ -314,26 +374,36 @@ func discoverRootDevices() ([]*url.URL, error) {
 	return nil, fmt.Errorf("ssdp: failed to discover any root devices")
 }
 
-func retrieveDeviceDescription(xmlLoc *url.URL) (*upnpRoot, net.IP, error) {
-	c, err := net.Dial("tcp", xmlLoc.Host)
-	if err != nil {
-		return nil, nil, err
+// newHTTPClient returns a http.Client suitable for talking to routers, which
+// tend to handle persistent connections and compression poorly, if at all,
+// that connects from the source address if one was specified.
+func (c *Client) newHTTPClient() *http.Client {
+	httpTransport := &http.Transport{DisableKeepAlives: true, DisableCompression: true}
+	if c.srcAddr != nil {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: c.srcAddr}}
+		httpTransport.DialContext = dialer.DialContext
 	}
-	conn := httputil.NewClientConn(c, nil)
-	defer conn.Close()
+	return &http.Client{Transport: httpTransport, Timeout: c.opts.RequestTimeout}
+}
 
-	// At this point we have the local address of the http socket, that can
-	// apparently talk to the UPnP device, so save that off as the local
-	// address.
-	localAddr := c.LocalAddr()
+func (c *Client) retrieveDeviceDescription(ctx context.Context, xmlLoc *url.URL) (*upnpRoot, net.IP, error) {
+	// Once the connection is established we have the local address of the
+	// http socket, that can apparently talk to the UPnP device, so save that
+	// off as the local address.
+	var localAddr net.Addr
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			localAddr = info.Conn.LocalAddr()
+		},
+	}
 
-	req, err := http.NewRequest("GET", xmlLoc.String(), nil)
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "GET", xmlLoc.String(), nil)
 	if err != nil {
 		return nil, nil, err
 	}
-	req.Header.Set("User-Agent", userAgent)
-	resp, err := conn.Do(req)
-	if err != nil && err != httputil.ErrPersistEOF {
+	req.Header.Set("User-Agent", c.opts.UserAgent)
+	resp, err := c.newHTTPClient().Do(req)
+	if err != nil {
 		return nil, nil, err
 	}
 	defer resp.Body.Close()
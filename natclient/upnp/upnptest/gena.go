@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnptest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	eventPrefix   = "/evt/"
+	connEventPath = eventPrefix + "Conn"
+
+	genaNT  = "upnp:event"
+	genaNTS = "upnp:propchange"
+
+	defaultEventTimeout = 1800
+	notifyBacklog       = 64
+	notifyTimeout       = 5 * time.Second
+)
+
+// Subscription is a GENA event subscription to a connection service.
+type Subscription struct {
+	SID        string
+	Connection int
+
+	// Callback is the delivery URL that NOTIFY requests are sent to.
+	Callback string
+
+	// Timeout is the duration of the subscription that was granted in
+	// seconds, and Renewals is the number of times that it was renewed.
+	Timeout  int
+	Renewals int
+
+	seq uint32
+}
+
+// EventRequest is a SUBSCRIBE or UNSUBSCRIBE request received by the IGD.
+type EventRequest struct {
+	Method string
+	Header http.Header
+}
+
+type notification struct {
+	callback string
+	sid      string
+	seq      uint32
+	body     []byte
+}
+
+func (d *IGD) eventPath(conn int) string {
+	return connEventPath + strconv.Itoa(conn)
+}
+
+// Subscriptions returns a copy of the active event subscriptions.
+func (d *IGD) Subscriptions() []Subscription {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	subs := make([]Subscription, 0, len(d.subs))
+	for _, s := range d.subs {
+		subs = append(subs, *s)
+	}
+	return subs
+}
+
+// EventRequests returns the SUBSCRIBE and UNSUBSCRIBE requests received so
+// far, in order.
+func (d *IGD) EventRequests() []EventRequest {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]EventRequest(nil), d.eventReqs...)
+}
+
+func (d *IGD) onEvent(w http.ResponseWriter, r *http.Request) {
+	conn, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, connEventPath))
+	if err != nil || !strings.HasPrefix(r.URL.Path, connEventPath) || conn < 0 || conn >= len(d.conns) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.eventReqs = append(d.eventReqs, EventRequest{Method: r.Method, Header: r.Header.Clone()})
+
+	// UPnP Device Architecture 1.1 Section 4.1: SUBSCRIBE without a SID
+	// creates a subscription, with one renews it, and a SID with a CALLBACK
+	// or NT is a bad request.
+	sid := r.Header.Get("SID")
+	if sid != "" && (r.Header.Get("CALLBACK") != "" || r.Header.Get("NT") != "") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Method == "SUBSCRIBE" && sid == "":
+		callback := r.Header.Get("CALLBACK")
+		if r.Header.Get("NT") != genaNT || !strings.HasPrefix(callback, "<") || !strings.HasSuffix(callback, ">") {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		d.nextSID++
+		s := &Subscription{
+			SID:        fmt.Sprintf("%s-sub%d", d.cfg.UDN, d.nextSID),
+			Connection: conn,
+			Callback:   strings.SplitN(strings.Trim(callback, "<>"), "><", 2)[0],
+			Timeout:    d.eventTimeout(r.Header.Get("TIMEOUT")),
+		}
+		d.subs = append(d.subs, s)
+		writeSubscribeResponse(w, s)
+
+		// The initial event carries every evented variable.
+		d.notifyLocked(s, d.eventVarsLocked(conn))
+	case r.Method == "SUBSCRIBE":
+		s := d.findSubLocked(sid)
+		if s == nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.Timeout = d.eventTimeout(r.Header.Get("TIMEOUT"))
+		s.Renewals++
+		writeSubscribeResponse(w, s)
+	case r.Method == "UNSUBSCRIBE":
+		s := d.findSubLocked(sid)
+		if s == nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		live := d.subs[:0]
+		for _, ss := range d.subs {
+			if ss != s {
+				live = append(live, ss)
+			}
+		}
+		d.subs = live
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSubscribeResponse(w http.ResponseWriter, s *Subscription) {
+	w.Header().Set("Server", serverString)
+	w.Header().Set("SID", s.SID)
+	w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(s.Timeout))
+	w.WriteHeader(http.StatusOK)
+}
+
+// eventTimeout returns the subscription timeout to grant for a request of
+// "Second-n".
+func (d *IGD) eventTimeout(requested string) int {
+	if d.cfg.EventTimeout > 0 {
+		return d.cfg.EventTimeout
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(requested, "Second-")); err == nil && n > 0 {
+		return n
+	}
+	return defaultEventTimeout
+}
+
+func (d *IGD) findSubLocked(sid string) *Subscription {
+	for _, s := range d.subs {
+		if s.SID == sid {
+			return s
+		}
+	}
+	return nil
+}
+
+// eventVarsLocked returns the evented variables of a connection service.
+func (d *IGD) eventVarsLocked(conn int) []soapArg {
+	n := 0
+	for _, m := range d.mappings {
+		if m.Connection == conn {
+			n++
+		}
+	}
+	return []soapArg{
+		{"ExternalIPAddress", d.extIP.String()},
+		{"ConnectionStatus", d.conns[conn].Status},
+		{"PortMappingNumberOfEntries", strconv.Itoa(n)},
+	}
+}
+
+// notifyAllLocked notifies the subscribers to conn (or to every connection if
+// conn is -1) of the variables.
+func (d *IGD) notifyAllLocked(conn int, vars []soapArg) {
+	for _, s := range d.subs {
+		if conn < 0 || s.Connection == conn {
+			d.notifyLocked(s, vars)
+		}
+	}
+}
+
+func (d *IGD) notifyLocked(s *Subscription, vars []soapArg) {
+	if d.closed {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString("<?xml version=\"1.0\"?>\n")
+	b.WriteString("<e:propertyset xmlns:e=\"urn:schemas-upnp-org:event-1-0\">\n")
+	for _, v := range vars {
+		b.WriteString("<e:property><" + v.name + ">" + xmlEscape(v.value) + "</" + v.name + "></e:property>\n")
+	}
+	b.WriteString("</e:propertyset>\n")
+
+	n := notification{callback: s.Callback, sid: s.SID, seq: s.seq, body: b.Bytes()}
+	s.seq++
+	select {
+	case d.notifyChan <- n:
+	default:
+		// The subscriber is not keeping up, which a real device would not
+		// wait for either.
+	}
+}
+
+// notifyWorker delivers the NOTIFY requests in order.
+func (d *IGD) notifyWorker() {
+	defer d.wg.Done()
+
+	client := &http.Client{Timeout: notifyTimeout}
+	for n := range d.notifyChan {
+		req, err := http.NewRequest("NOTIFY", n.callback, bytes.NewReader(n.body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "text/xml; charset=\"utf-8\"")
+		req.Header.Set("NT", genaNT)
+		req.Header.Set("NTS", genaNTS)
+		req.Header.Set("SID", n.sid)
+		req.Header.Set("SEQ", strconv.FormatUint(uint64(n.seq), 10))
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
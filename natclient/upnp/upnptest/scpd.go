@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnptest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	scpdPrefix   = "/scpd/"
+	l3fSCPDPath  = scpdPrefix + "L3F.xml"
+	connSCPDPath = scpdPrefix + "Conn"
+)
+
+type scpdArg struct {
+	name     string
+	out      bool
+	stateVar string
+}
+
+type scpdStateVar struct {
+	dataType      string
+	allowedValues []string
+	allowedRange  []int // min, max
+}
+
+// connActions are the connection service actions that the fake IGD
+// implements, and their arguments.
+var connActions = map[string][]scpdArg{
+	"GetExternalIPAddress": {
+		{"NewExternalIPAddress", true, "ExternalIPAddress"},
+	},
+	"GetStatusInfo": {
+		{"NewConnectionStatus", true, "ConnectionStatus"},
+		{"NewLastConnectionError", true, "LastConnectionError"},
+		{"NewUptime", true, "Uptime"},
+	},
+	"AddPortMapping": {
+		{"NewRemoteHost", false, "RemoteHost"},
+		{"NewExternalPort", false, "ExternalPort"},
+		{"NewProtocol", false, "PortMappingProtocol"},
+		{"NewInternalPort", false, "InternalPort"},
+		{"NewInternalClient", false, "InternalClient"},
+		{"NewEnabled", false, "PortMappingEnabled"},
+		{"NewPortMappingDescription", false, "PortMappingDescription"},
+		{"NewLeaseDuration", false, "PortMappingLeaseDuration"},
+	},
+	"AddAnyPortMapping": {
+		{"NewRemoteHost", false, "RemoteHost"},
+		{"NewExternalPort", false, "ExternalPort"},
+		{"NewProtocol", false, "PortMappingProtocol"},
+		{"NewInternalPort", false, "InternalPort"},
+		{"NewInternalClient", false, "InternalClient"},
+		{"NewEnabled", false, "PortMappingEnabled"},
+		{"NewPortMappingDescription", false, "PortMappingDescription"},
+		{"NewLeaseDuration", false, "PortMappingLeaseDuration"},
+		{"NewReservedPort", true, "ExternalPort"},
+	},
+	"DeletePortMapping": {
+		{"NewRemoteHost", false, "RemoteHost"},
+		{"NewExternalPort", false, "ExternalPort"},
+		{"NewProtocol", false, "PortMappingProtocol"},
+	},
+	"GetGenericPortMappingEntry": {
+		{"NewPortMappingIndex", false, "PortMappingNumberOfEntries"},
+		{"NewRemoteHost", true, "RemoteHost"},
+		{"NewExternalPort", true, "ExternalPort"},
+		{"NewProtocol", true, "PortMappingProtocol"},
+		{"NewInternalPort", true, "InternalPort"},
+		{"NewInternalClient", true, "InternalClient"},
+		{"NewEnabled", true, "PortMappingEnabled"},
+		{"NewPortMappingDescription", true, "PortMappingDescription"},
+		{"NewLeaseDuration", true, "PortMappingLeaseDuration"},
+	},
+	"GetSpecificPortMappingEntry": {
+		{"NewRemoteHost", false, "RemoteHost"},
+		{"NewExternalPort", false, "ExternalPort"},
+		{"NewProtocol", false, "PortMappingProtocol"},
+		{"NewInternalPort", true, "InternalPort"},
+		{"NewInternalClient", true, "InternalClient"},
+		{"NewEnabled", true, "PortMappingEnabled"},
+		{"NewPortMappingDescription", true, "PortMappingDescription"},
+		{"NewLeaseDuration", true, "PortMappingLeaseDuration"},
+	},
+	"GetListOfPortMappings": {
+		{"NewStartPort", false, "ExternalPort"},
+		{"NewEndPort", false, "ExternalPort"},
+		{"NewProtocol", false, "PortMappingProtocol"},
+		{"NewManage", false, "A_ARG_TYPE_Manage"},
+		{"NewNumberOfPorts", false, "PortMappingNumberOfEntries"},
+		{"NewPortListing", true, "A_ARG_TYPE_PortListing"},
+	},
+}
+
+var l3fActions = map[string][]scpdArg{
+	"GetDefaultConnectionService": {
+		{"NewDefaultConnectionService", true, "DefaultConnectionService"},
+	},
+}
+
+var stateVars = map[string]scpdStateVar{
+	"ExternalIPAddress":          {dataType: "string"},
+	"ConnectionStatus":           {dataType: "string"},
+	"LastConnectionError":        {dataType: "string"},
+	"Uptime":                     {dataType: "ui4"},
+	"RemoteHost":                 {dataType: "string"},
+	"ExternalPort":               {dataType: "ui2"},
+	"PortMappingProtocol":        {dataType: "string", allowedValues: []string{"TCP", "UDP"}},
+	"InternalPort":               {dataType: "ui2", allowedRange: []int{1, 65535}},
+	"InternalClient":             {dataType: "string"},
+	"PortMappingEnabled":         {dataType: "boolean"},
+	"PortMappingDescription":     {dataType: "string"},
+	"PortMappingLeaseDuration":   {dataType: "ui4", allowedRange: []int{0, maxMappingDuration}},
+	"PortMappingNumberOfEntries": {dataType: "ui2"},
+	"A_ARG_TYPE_Manage":          {dataType: "boolean"},
+	"A_ARG_TYPE_PortListing":     {dataType: "string"},
+	"DefaultConnectionService":   {dataType: "string"},
+}
+
+// defaultActions returns the connection service actions implemented by an
+// IGD of the given version.
+func defaultActions(version int) []string {
+	actions := []string{
+		"GetExternalIPAddress",
+		"GetStatusInfo",
+		"AddPortMapping",
+		"DeletePortMapping",
+		"GetGenericPortMappingEntry",
+		"GetSpecificPortMappingEntry",
+	}
+	if version >= 2 {
+		actions = append(actions, "AddAnyPortMapping", "GetListOfPortMappings")
+	}
+	return actions
+}
+
+// implements returns true iff the connection services implement the action.
+func (d *IGD) implements(action string) bool {
+	return d.actions[action]
+}
+
+func (d *IGD) scpdPath(conn int) string {
+	return connSCPDPath + strconv.Itoa(conn) + ".xml"
+}
+
+func (d *IGD) onSCPD(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if d.cfg.NoSCPD {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var doc string
+	switch {
+	case r.URL.Path == l3fSCPDPath && !d.cfg.NoLayer3Forwarding:
+		doc = scpd(l3fActions, nil, stateVars)
+	case strings.HasPrefix(r.URL.Path, connSCPDPath) && strings.HasSuffix(r.URL.Path, ".xml"):
+		idx, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, connSCPDPath), ".xml"))
+		if err != nil || idx < 0 || idx >= len(d.conns) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		doc = scpd(connActions, d.actions, d.connStateVars())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	w.Header().Set("Server", serverString)
+	fmt.Fprint(w, doc)
+}
+
+// connStateVars returns the state variables of the connection services, which
+// differ from stateVars per the configuration.
+func (d *IGD) connStateVars() map[string]scpdStateVar {
+	if d.cfg.LeaseRange == nil {
+		return stateVars
+	}
+	vars := make(map[string]scpdStateVar, len(stateVars))
+	for name, v := range stateVars {
+		vars[name] = v
+	}
+	vars["PortMappingLeaseDuration"] = scpdStateVar{dataType: "ui4", allowedRange: d.cfg.LeaseRange}
+	return vars
+}
+
+// scpd generates a service description for the actions in the table, limited
+// to the ones in filter if it is non-nil, using vars for the state variables.
+func scpd(table map[string][]scpdArg, filter map[string]bool, vars map[string]scpdStateVar) string {
+	var names []string
+	for name := range table {
+		if filter == nil || filter[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	usedVars := make(map[string]bool)
+	b.WriteString("<?xml version=\"1.0\"?>\n")
+	b.WriteString("<scpd xmlns=\"urn:schemas-upnp-org:service-1-0\">\n")
+	b.WriteString("<specVersion><major>1</major><minor>0</minor></specVersion>\n")
+	b.WriteString("<actionList>\n")
+	for _, name := range names {
+		b.WriteString("<action><name>" + name + "</name><argumentList>\n")
+		for _, arg := range table[name] {
+			dir := "in"
+			if arg.out {
+				dir = "out"
+			}
+			b.WriteString("<argument><name>" + arg.name + "</name><direction>" + dir + "</direction>" +
+				"<relatedStateVariable>" + arg.stateVar + "</relatedStateVariable></argument>\n")
+			usedVars[arg.stateVar] = true
+		}
+		b.WriteString("</argumentList></action>\n")
+	}
+	b.WriteString("</actionList>\n")
+
+	var varNames []string
+	for name := range usedVars {
+		varNames = append(varNames, name)
+	}
+	sort.Strings(varNames)
+	b.WriteString("<serviceStateTable>\n")
+	for _, name := range varNames {
+		v := vars[name]
+		b.WriteString("<stateVariable sendEvents=\"no\"><name>" + name + "</name>" +
+			"<dataType>" + v.dataType + "</dataType>")
+		if len(v.allowedValues) > 0 {
+			b.WriteString("<allowedValueList>")
+			for _, av := range v.allowedValues {
+				b.WriteString("<allowedValue>" + av + "</allowedValue>")
+			}
+			b.WriteString("</allowedValueList>")
+		}
+		if v.allowedRange != nil {
+			fmt.Fprintf(&b, "<allowedValueRange><minimum>%d</minimum><maximum>%d</maximum></allowedValueRange>",
+				v.allowedRange[0], v.allowedRange[1])
+		}
+		b.WriteString("</stateVariable>\n")
+	}
+	b.WriteString("</serviceStateTable>\n")
+	b.WriteString("</scpd>\n")
+	return b.String()
+}
@@ -0,0 +1,465 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnptest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	errInvalidAction               = 401
+	errInvalidArgs                 = 402
+	errSpecifiedArrayIndexInvalid  = 713
+	errNoSuchEntryInArray          = 714
+	errWildCardNotPermittedInExtPt = 716
+	errConflictInMappingEntry      = 718
+	errOnlyPermanentLeases         = 725
+	errNoPortMapsAvailable         = 728
+	errPortMappingNotFound         = 730
+)
+
+var errorDescriptions = map[int]string{
+	errInvalidAction:               "Invalid Action",
+	errInvalidArgs:                 "Invalid Args",
+	errSpecifiedArrayIndexInvalid:  "SpecifiedArrayIndexInvalid",
+	errNoSuchEntryInArray:          "NoSuchEntryInArray",
+	errWildCardNotPermittedInExtPt: "WildCardNotPermittedInExtPort",
+	errConflictInMappingEntry:      "ConflictInMappingEntry",
+	errOnlyPermanentLeases:         "OnlyPermanentLeasesSupported",
+	errNoPortMapsAvailable:         "NoPortMapsAvailable",
+	errPortMappingNotFound:         "PortMappingNotFound",
+}
+
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+// soapArgs are the arguments to an action, keyed by name.
+type soapArgs map[string]string
+
+func (a soapArgs) port(name string) (int, bool) {
+	v, err := strconv.ParseUint(strings.TrimSpace(a[name]), 10, 16)
+	return int(v), err == nil
+}
+
+func (a soapArgs) uint(name string) (int, bool) {
+	v, err := strconv.ParseUint(strings.TrimSpace(a[name]), 10, 32)
+	return int(v), err == nil
+}
+
+func (a soapArgs) protocol() (base.Protocol, bool) {
+	// Routers are case sensitive here, so be strict.
+	switch a["NewProtocol"] {
+	case "TCP":
+		return base.TCP, true
+	case "UDP":
+		return base.UDP, true
+	}
+	return base.TCP, false
+}
+
+// soapArg is an output argument, in the order that they appear in the
+// response.
+type soapArg struct {
+	name  string
+	value string
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (d *IGD) onControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Figure out which service is being controlled, conn is -1 for
+	// Layer3Forwarding.
+	conn := -1
+	serviceURN := layer3ForwardingURN
+	if r.URL.Path != l3fControlPath || d.cfg.NoLayer3Forwarding {
+		idx, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, connControlPath))
+		if err != nil || !strings.HasPrefix(r.URL.Path, connControlPath) || idx < 0 || idx >= len(d.conns) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		conn = idx
+		serviceURN = d.serviceURN(conn)
+	}
+
+	// SOAPAction: "urn:schemas-upnp-org:service:serviceType:v#actionName"
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), "\"")
+	split := strings.SplitN(soapAction, "#", 2)
+	if len(split) != 2 || split[0] != serviceURN {
+		d.writeFault(w, errInvalidAction)
+		return
+	}
+	actionName := split[1]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := &soapRequest{}
+	if err = xml.Unmarshal(body, req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := req.Body.Action
+	if action.XMLName.Local != actionName || action.XMLName.Space != serviceURN {
+		d.writeFault(w, errInvalidAction)
+		return
+	}
+	args := make(soapArgs)
+	for _, a := range action.Args {
+		args[a.XMLName.Local] = a.Value
+	}
+
+	var out []soapArg
+	code := 0
+	d.lock.Lock()
+	d.expireLocked(time.Now())
+	switch {
+	case conn < 0 && actionName == "GetDefaultConnectionService":
+		c := d.cfg.DefaultConnection
+		defConnSvc := fmt.Sprintf("%s:WANConnectionDevice:%d,%s", d.wanConnDeviceUDN(c), d.cfg.Version, d.serviceID(c))
+		out = []soapArg{{"NewDefaultConnectionService", defConnSvc}}
+	case conn < 0, !d.implements(actionName):
+		code = errInvalidAction
+	case d.cfg.Faults[actionName] != 0:
+		code = d.cfg.Faults[actionName]
+	case actionName == "GetExternalIPAddress":
+		out = []soapArg{{"NewExternalIPAddress", d.extIP.String()}}
+	case actionName == "GetStatusInfo":
+		out = []soapArg{
+			{"NewConnectionStatus", d.conns[conn].Status},
+			{"NewLastConnectionError", "ERROR_NONE"},
+			{"NewUptime", "0"},
+		}
+	case actionName == "AddPortMapping":
+		_, code = d.addPortMappingLocked(conn, args, false)
+	case actionName == "AddAnyPortMapping":
+		var port int
+		if port, code = d.addPortMappingLocked(conn, args, true); code == 0 {
+			out = []soapArg{{"NewReservedPort", strconv.Itoa(port)}}
+		}
+	case actionName == "DeletePortMapping":
+		code = d.deletePortMappingLocked(conn, args)
+	case actionName == "GetGenericPortMappingEntry":
+		out, code = d.getGenericPortMappingEntryLocked(conn, args)
+	case actionName == "GetSpecificPortMappingEntry":
+		out, code = d.getSpecificPortMappingEntryLocked(conn, args)
+	case actionName == "GetListOfPortMappings":
+		out, code = d.getListOfPortMappingsLocked(conn, args)
+	default:
+		code = errInvalidAction
+	}
+	d.lock.Unlock()
+
+	if code != 0 {
+		d.writeFault(w, code)
+		return
+	}
+	d.writeResponse(w, serviceURN, actionName, out)
+}
+
+// addPortMappingLocked implements AddPortMapping, and AddAnyPortMapping if
+// anyPort is set, returning the external port that was mapped.
+func (d *IGD) addPortMappingLocked(conn int, args soapArgs, anyPort bool) (int, int) {
+	externalPort, ok := args.port("NewExternalPort")
+	if !ok {
+		return 0, errInvalidArgs
+	}
+	internalPort, ok := args.port("NewInternalPort")
+	if !ok || internalPort == 0 {
+		return 0, errInvalidArgs
+	}
+	protocol, ok := args.protocol()
+	if !ok {
+		return 0, errInvalidArgs
+	}
+	internalClient := args["NewInternalClient"]
+	if net.ParseIP(internalClient) == nil {
+		return 0, errInvalidArgs
+	}
+	enabled, ok := args.uint("NewEnabled")
+	if !ok {
+		return 0, errInvalidArgs
+	}
+	leaseDuration, ok := args.uint("NewLeaseDuration")
+	if !ok || leaseDuration > maxMappingDuration {
+		return 0, errInvalidArgs
+	}
+	if r := d.cfg.LeaseRange; r != nil && (leaseDuration < r[0] || leaseDuration > r[1]) {
+		return 0, errInvalidArgs
+	}
+	if externalPort == 0 {
+		return 0, errWildCardNotPermittedInExtPt
+	}
+	if leaseDuration != 0 && d.cfg.OnlyPermanentLeases {
+		return 0, errOnlyPermanentLeases
+	}
+	if leaseDuration == 0 && d.cfg.NoIndefiniteLeases != 0 {
+		return 0, d.cfg.NoIndefiniteLeases
+	}
+	if leaseDuration == 0 && d.cfg.Version >= 2 {
+		// IGD2 does away with indefinite leases, 0 means the maximum.
+		leaseDuration = maxMappingDuration
+	}
+
+	m := Mapping{
+		Connection:     conn,
+		RemoteHost:     args["NewRemoteHost"],
+		ExternalPort:   externalPort,
+		Protocol:       protocol,
+		InternalPort:   internalPort,
+		InternalClient: internalClient,
+		Enabled:        enabled != 0,
+		Description:    args["NewPortMappingDescription"],
+		LeaseDuration:  leaseDuration,
+	}
+	if leaseDuration > 0 {
+		m.expiresAt = time.Now().Add(time.Duration(leaseDuration) * time.Second)
+	}
+
+	// Re-adding an existing mapping for the same client updates it, while
+	// mapping a port that belongs to someone else is a conflict, unless the
+	// IGD gets to pick another port.
+	if i := d.findLocked(conn, m.RemoteHost, externalPort, protocol); i >= 0 {
+		if d.mappings[i].InternalClient == internalClient {
+			d.mappings[i] = m
+			return externalPort, 0
+		}
+		if !anyPort {
+			return 0, errConflictInMappingEntry
+		}
+		if m.ExternalPort = d.freePortLocked(conn, m.RemoteHost, protocol, externalPort); m.ExternalPort == 0 {
+			return 0, errNoPortMapsAvailable
+		}
+	}
+	d.mappings = append(d.mappings, m)
+	return m.ExternalPort, 0
+}
+
+func (d *IGD) freePortLocked(conn int, remoteHost string, protocol base.Protocol, hint int) int {
+	// Pick the closest port above the hint that is free, wrapping around to
+	// the unprivileged range.
+	port := hint
+	for i := 0; i < 65535; i++ {
+		port++
+		if port > 65535 {
+			port = 1024
+		}
+		if d.findLocked(conn, remoteHost, port, protocol) < 0 {
+			return port
+		}
+	}
+	return 0
+}
+
+func (d *IGD) deletePortMappingLocked(conn int, args soapArgs) int {
+	externalPort, ok := args.port("NewExternalPort")
+	if !ok {
+		return errInvalidArgs
+	}
+	protocol, ok := args.protocol()
+	if !ok {
+		return errInvalidArgs
+	}
+	i := d.findLocked(conn, args["NewRemoteHost"], externalPort, protocol)
+	if i < 0 {
+		return errNoSuchEntryInArray
+	}
+	d.mappings = append(d.mappings[:i], d.mappings[i+1:]...)
+	return 0
+}
+
+func (d *IGD) getGenericPortMappingEntryLocked(conn int, args soapArgs) ([]soapArg, int) {
+	idx, ok := args.port("NewPortMappingIndex")
+	if !ok {
+		return nil, errInvalidArgs
+	}
+
+	// Each connection has a mapping table of its own.
+	var m *Mapping
+	for i := range d.mappings {
+		if d.mappings[i].Connection != conn {
+			continue
+		}
+		if idx == 0 {
+			m = &d.mappings[i]
+			break
+		}
+		idx--
+	}
+	if m == nil {
+		return nil, errSpecifiedArrayIndexInvalid
+	}
+	enabled := "0"
+	if m.Enabled {
+		enabled = "1"
+	}
+	out := []soapArg{
+		{"NewRemoteHost", m.RemoteHost},
+		{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+		{"NewProtocol", m.Protocol.String()},
+		{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+		{"NewInternalClient", m.InternalClient},
+		{"NewEnabled", enabled},
+		{"NewPortMappingDescription", m.Description},
+		{"NewLeaseDuration", strconv.Itoa(m.remaining(time.Now()))},
+	}
+	return out, 0
+}
+
+func (d *IGD) getSpecificPortMappingEntryLocked(conn int, args soapArgs) ([]soapArg, int) {
+	externalPort, ok := args.port("NewExternalPort")
+	if !ok {
+		return nil, errInvalidArgs
+	}
+	protocol, ok := args.protocol()
+	if !ok {
+		return nil, errInvalidArgs
+	}
+	i := d.findLocked(conn, args["NewRemoteHost"], externalPort, protocol)
+	if i < 0 {
+		return nil, errNoSuchEntryInArray
+	}
+	m := &d.mappings[i]
+	enabled := "0"
+	if m.Enabled {
+		enabled = "1"
+	}
+	out := []soapArg{
+		{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+		{"NewInternalClient", m.InternalClient},
+		{"NewEnabled", enabled},
+		{"NewPortMappingDescription", m.Description},
+		{"NewLeaseDuration", strconv.Itoa(m.remaining(time.Now()))},
+	}
+	return out, 0
+}
+
+func (d *IGD) getListOfPortMappingsLocked(conn int, args soapArgs) ([]soapArg, int) {
+	startPort, ok := args.port("NewStartPort")
+	if !ok {
+		return nil, errInvalidArgs
+	}
+	endPort, ok := args.port("NewEndPort")
+	if !ok || endPort < startPort {
+		return nil, errInvalidArgs
+	}
+	protocol, ok := args.protocol()
+	if !ok {
+		return nil, errInvalidArgs
+	}
+	numPorts, ok := args.port("NewNumberOfPorts")
+	if !ok {
+		return nil, errInvalidArgs
+	}
+
+	var ents []*Mapping
+	for i := range d.mappings {
+		m := &d.mappings[i]
+		if m.Connection == conn && m.Protocol == protocol && m.ExternalPort >= startPort && m.ExternalPort <= endPort {
+			ents = append(ents, m)
+		}
+	}
+	if len(ents) == 0 {
+		return nil, errPortMappingNotFound
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].ExternalPort < ents[j].ExternalPort })
+	if numPorts > 0 && len(ents) > numPorts {
+		ents = ents[:numPorts]
+	}
+
+	// The listing is a XML document of its own, which gets escaped when
+	// placed in the response.
+	var b bytes.Buffer
+	now := time.Now()
+	b.WriteString(xml.Header)
+	b.WriteString("<p:PortMappingList xmlns:p=\"urn:schemas-upnp-org:gw:WANIPConnection\">")
+	for _, m := range ents {
+		enabled := "0"
+		if m.Enabled {
+			enabled = "1"
+		}
+		b.WriteString("<p:PortMappingEntry>")
+		b.WriteString("<p:NewRemoteHost>" + xmlEscape(m.RemoteHost) + "</p:NewRemoteHost>")
+		b.WriteString("<p:NewExternalPort>" + strconv.Itoa(m.ExternalPort) + "</p:NewExternalPort>")
+		b.WriteString("<p:NewProtocol>" + m.Protocol.String() + "</p:NewProtocol>")
+		b.WriteString("<p:NewInternalPort>" + strconv.Itoa(m.InternalPort) + "</p:NewInternalPort>")
+		b.WriteString("<p:NewInternalClient>" + xmlEscape(m.InternalClient) + "</p:NewInternalClient>")
+		b.WriteString("<p:NewEnabled>" + enabled + "</p:NewEnabled>")
+		b.WriteString("<p:NewDescription>" + xmlEscape(m.Description) + "</p:NewDescription>")
+		b.WriteString("<p:NewLeaseTime>" + strconv.Itoa(m.remaining(now)) + "</p:NewLeaseTime>")
+		b.WriteString("</p:PortMappingEntry>")
+	}
+	b.WriteString("</p:PortMappingList>")
+	return []soapArg{{"NewPortListing", b.String()}}, 0
+}
+
+func (d *IGD) writeResponse(w http.ResponseWriter, serviceURN, actionName string, out []soapArg) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString("<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" " +
+		"s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\"><s:Body>")
+	b.WriteString("<u:" + actionName + "Response xmlns:u=\"" + serviceURN + "\">")
+	for _, a := range out {
+		b.WriteString("<" + a.name + ">" + xmlEscape(a.value) + "</" + a.name + ">")
+	}
+	b.WriteString("</u:" + actionName + "Response>")
+	b.WriteString("</s:Body></s:Envelope>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	w.Header().Set("Server", serverString)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+}
+
+func (d *IGD) writeFault(w http.ResponseWriter, code int) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString("<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" " +
+		"s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\"><s:Body>")
+	b.WriteString("<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>")
+	b.WriteString("<detail><UPnPError xmlns=\"urn:schemas-upnp-org:control-1-0\">")
+	fmt.Fprintf(&b, "<errorCode>%d</errorCode>", code)
+	b.WriteString("<errorDescription>" + errorDescriptions[code] + "</errorDescription>")
+	b.WriteString("</UPnPError></detail></s:Fault>")
+	b.WriteString("</s:Body></s:Envelope>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	w.Header().Set("Server", serverString)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnptest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	ssdpAll        = "ssdp:all"
+	ssdpRootDevice = "upnp:rootdevice"
+	ssdpDiscover   = "\"ssdp:discover\""
+	serverString   = "Go/1 UPnP/1.1 upnptest/1.0"
+
+	maxRequestSize = 65535
+)
+
+func (d *IGD) ssdpWorker() {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxRequestSize)
+	for {
+		n, addr, err := d.ssdpConn.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			// Closed.
+			return
+		}
+
+		// Garbage is silently ignored, as a real device would.
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil {
+			continue
+		}
+		if req.Method != "M-SEARCH" || req.Header.Get("MAN") != ssdpDiscover {
+			continue
+		}
+		if resp := d.searchResponse(req.Header.Get("ST")); resp != nil {
+			d.ssdpConn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func (d *IGD) searchResponse(st string) []byte {
+	//  HTTP/1.1 200 OK
+	//  CACHE-CONTROL: max-age = seconds until advertisement expires
+	//  EXT:
+	//  LOCATION: URL for UPnP description for root device
+	//  SERVER: OS/version UPnP/1.1 product/version
+	//  ST: search target
+	//  USN: composite identifier for the advertisement
+	var usn string
+	switch st {
+	case ssdpAll, ssdpRootDevice:
+		// ssdp:all is supposed to elicit a response for every device and
+		// service, but the root device is all that anyone cares about.
+		st = ssdpRootDevice
+		usn = d.cfg.UDN + "::" + ssdpRootDevice
+	case d.cfg.UDN:
+		usn = d.cfg.UDN
+	case d.deviceURN():
+		usn = d.cfg.UDN + "::" + st
+	default:
+		for i := range d.conns {
+			if st == d.serviceURN(i) {
+				usn = d.wanConnDeviceUDN(i) + "::" + st
+				break
+			}
+		}
+		if usn == "" {
+			return nil
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 200 OK\r\n")
+	b.WriteString("CACHE-CONTROL: max-age=1800\r\n")
+	b.WriteString("EXT:\r\n")
+	b.WriteString("LOCATION: " + d.Location() + "\r\n")
+	b.WriteString("SERVER: " + serverString + "\r\n")
+	b.WriteString("ST: " + st + "\r\n")
+	b.WriteString("USN: " + usn + "\r\n")
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func (d *IGD) onDescription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var desc string
+	if d.cfg.DeviceDescription != nil {
+		desc = d.cfg.DeviceDescription(d.baseURL)
+	} else {
+		desc = d.description()
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=\"utf-8\"")
+	w.Header().Set("Server", serverString)
+	fmt.Fprint(w, desc)
+}
+
+func (d *IGD) description() string {
+	// UPnP 1.0 devices may use relative URLs, resolved against URLBase (or
+	// the location of the description), while UPnP 1.1 requires absolute
+	// URLs.
+	specMinor := 1
+	urlPrefix := d.baseURL
+	if d.cfg.UPnP10 {
+		specMinor = 0
+		urlPrefix = ""
+	}
+	toURL := func(path string) string {
+		if urlPrefix == "" {
+			return strings.TrimPrefix(path, "/")
+		}
+		return urlPrefix + path
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<?xml version=\"1.0\"?>\n")
+	b.WriteString("<root xmlns=\"urn:schemas-upnp-org:device-1-0\">\n")
+	fmt.Fprintf(&b, "<specVersion><major>1</major><minor>%d</minor></specVersion>\n", specMinor)
+	if d.cfg.UPnP10 && d.cfg.URLBase != "" {
+		b.WriteString("<URLBase>" + xmlEscape(d.cfg.URLBase) + "</URLBase>\n")
+	}
+	b.WriteString("<device>\n")
+	b.WriteString("<deviceType>" + d.deviceURN() + "</deviceType>\n")
+	b.WriteString("<friendlyName>" + xmlEscape(d.cfg.FriendlyName) + "</friendlyName>\n")
+	b.WriteString("<manufacturer>" + xmlEscape(d.cfg.Manufacturer) + "</manufacturer>\n")
+	b.WriteString("<modelName>" + xmlEscape(d.cfg.ModelName) + "</modelName>\n")
+	b.WriteString("<UDN>" + d.cfg.UDN + "</UDN>\n")
+	if !d.cfg.NoLayer3Forwarding {
+		b.WriteString("<serviceList>\n")
+		writeService(&b, layer3ForwardingURN, "urn:upnp-org:serviceId:L3Forwarding1", toURL(l3fSCPDPath), toURL(l3fControlPath), "")
+		b.WriteString("</serviceList>\n")
+	}
+
+	// Each connection gets a WANConnectionDevice of its own, grouped under
+	// the WANDevices in order.
+	nWANDevices := 0
+	for _, conn := range d.conns {
+		if conn.WANDevice >= nWANDevices {
+			nWANDevices = conn.WANDevice + 1
+		}
+	}
+	b.WriteString("<deviceList>\n")
+	for wanDev := 0; wanDev < nWANDevices; wanDev++ {
+		b.WriteString("<device>\n")
+		fmt.Fprintf(&b, "<deviceType>urn:schemas-upnp-org:device:WANDevice:%d</deviceType>\n", d.cfg.Version)
+		b.WriteString("<friendlyName>WANDevice</friendlyName>\n")
+		b.WriteString("<UDN>" + d.wanDeviceUDN(wanDev) + "</UDN>\n")
+		b.WriteString("<deviceList>\n")
+		for i, conn := range d.conns {
+			if conn.WANDevice != wanDev {
+				continue
+			}
+			b.WriteString("<device>\n")
+			fmt.Fprintf(&b, "<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:%d</deviceType>\n", d.cfg.Version)
+			b.WriteString("<friendlyName>WANConnectionDevice</friendlyName>\n")
+			b.WriteString("<UDN>" + d.wanConnDeviceUDN(i) + "</UDN>\n")
+			b.WriteString("<serviceList>\n")
+			writeService(&b, d.serviceURN(i), d.serviceID(i), toURL(d.scpdPath(i)), toURL(d.controlPath(i)), toURL(d.eventPath(i)))
+			b.WriteString("</serviceList>\n")
+			b.WriteString("</device>\n")
+		}
+		b.WriteString("</deviceList>\n")
+		b.WriteString("</device>\n")
+	}
+	b.WriteString("</deviceList>\n")
+	b.WriteString("</device>\n")
+	b.WriteString("</root>\n")
+	return b.String()
+}
+
+func writeService(b *bytes.Buffer, serviceType, serviceID, scpdURL, controlURL, eventSubURL string) {
+	b.WriteString("<service>\n")
+	b.WriteString("<serviceType>" + serviceType + "</serviceType>\n")
+	b.WriteString("<serviceId>" + serviceID + "</serviceId>\n")
+	b.WriteString("<SCPDURL>" + scpdURL + "</SCPDURL>\n")
+	b.WriteString("<controlURL>" + controlURL + "</controlURL>\n")
+	b.WriteString("<eventSubURL>" + eventSubURL + "</eventSubURL>\n")
+	b.WriteString("</service>\n")
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+// Package upnptest implements an in-process fake UPnP Internet Gateway Device
+// suitable for exercising the upnp package without a router.  The IGD runs a
+// SSDP responder, serves a device description, handles SOAP requests against a
+// real port mapping table, and GENA event subscriptions, all over the loopback
+// interface.
+//
+// To point a client at the fake device:
+//
+//	igd, err := upnptest.New(nil)
+//	...
+//	defer igd.Close()
+//	f := &upnp.ClientFactory{SSDPAddr: igd.SSDPAddr()}
+//	c, err := f.New(nil)
+package upnptest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	// WANIPConnection and WANPPPConnection are the supported connection
+	// service types.
+	WANIPConnection  = "WANIPConnection"
+	WANPPPConnection = "WANPPPConnection"
+
+	// StatusConnected and StatusDisconnected are common ConnectionStatus
+	// values.
+	StatusConnected    = "Connected"
+	StatusDisconnected = "Disconnected"
+
+	layer3ForwardingURN = "urn:schemas-upnp-org:service:Layer3Forwarding:1"
+
+	descPath        = "/rootDesc.xml"
+	controlPrefix   = "/ctl/"
+	l3fControlPath  = controlPrefix + "L3F"
+	connControlPath = controlPrefix + "Conn"
+
+	maxMappingDuration = 604800
+)
+
+// Config is the configuration of a fake IGD.  The zero value is a UPnP 1.1
+// IGD1 device exposing a single connected WANIPConnection service.
+type Config struct {
+	// Version is the IGD version of the device and service (1 or 2).
+	Version int
+
+	// ServiceType is the connection service that is exposed when
+	// Connections is empty, either WANIPConnection or WANPPPConnection.
+	ServiceType string
+
+	// Connections are the WAN connections exposed by the device, each in
+	// a WANConnectionDevice of its own.
+	Connections []Connection
+
+	// DefaultConnection is the index of the connection that
+	// Layer3Forwarding's GetDefaultConnectionService returns.
+	DefaultConnection int
+
+	// NoLayer3Forwarding omits the Layer3Forwarding service.
+	NoLayer3Forwarding bool
+
+	// Actions, if non-nil, are the actions that the connection services
+	// implement and advertise in their service descriptions.  By default
+	// all of the actions are supported, other than AddAnyPortMapping and
+	// GetListOfPortMappings on IGD1 devices.
+	Actions []string
+
+	// NoSCPD causes requests for the service descriptions to fail.
+	NoSCPD bool
+
+	// OnlyPermanentLeases causes AddPortMapping to refuse finite leases
+	// with OnlyPermanentLeasesSupported (725), like some IGD1 devices.
+	OnlyPermanentLeases bool
+
+	// NoIndefiniteLeases, if non-zero, is the UPnP error code that
+	// AddPortMapping refuses a lease of "0" with (Eg: 402 or 725), like
+	// some IGD2 devices.
+	NoIndefiniteLeases int
+
+	// Faults, if set, are the UPnP error codes that actions fail with,
+	// keyed by action name.
+	Faults map[string]int
+
+	// LeaseRange, if set, is the {minimum, maximum} lease duration that the
+	// service descriptions advertise, and that AddPortMapping refuses
+	// anything outside of with InvalidArgs (402).
+	LeaseRange []int
+
+	// UPnP10 makes the device description claim UPnP 1.0, and use URLs
+	// relative to URLBase, or to the description's location if URLBase is
+	// unset.
+	UPnP10  bool
+	URLBase string
+
+	// FriendlyName, Manufacturer, and ModelName are reported in the device
+	// description.
+	FriendlyName string
+	Manufacturer string
+	ModelName    string
+
+	// UDN is the device's unique device name.
+	UDN string
+
+	// ExternalIP is the address returned by GetExternalIPAddress.
+	ExternalIP net.IP
+
+	// EventTimeout, if non-zero, is the event subscription timeout that is
+	// granted in seconds, in place of the requested one.
+	EventTimeout int
+
+	// DeviceDescription, if set, is called to generate the device
+	// description instead of the built in template.  baseURL is the
+	// "http://host:port" of the fake IGD's HTTP server.
+	DeviceDescription func(baseURL string) string
+}
+
+// Connection is a WAN connection service.
+type Connection struct {
+	// ServiceType is either WANIPConnection or WANPPPConnection.
+	ServiceType string
+
+	// WANDevice is the index of the WANDevice that the connection's
+	// WANConnectionDevice is under.
+	WANDevice int
+
+	// Status is the ConnectionStatus returned by GetStatusInfo, with ""
+	// being treated as StatusConnected.
+	Status string
+}
+
+// Mapping is an entry in the fake IGD's port mapping table.
+type Mapping struct {
+	// Connection is the index of the connection that the mapping belongs
+	// to.
+	Connection int
+
+	RemoteHost     string
+	ExternalPort   int
+	Protocol       base.Protocol
+	InternalPort   int
+	InternalClient string
+	Enabled        bool
+	Description    string
+
+	// LeaseDuration is the lease that was requested, 0 if the lease is
+	// indefinite.
+	LeaseDuration int
+
+	expiresAt time.Time
+}
+
+func (m *Mapping) remaining(now time.Time) int {
+	if m.expiresAt.IsZero() {
+		return 0
+	}
+	left := int(m.expiresAt.Sub(now) / time.Second)
+	if left < 1 {
+		// Not quite expired yet, 0 would mean indefinite.
+		left = 1
+	}
+	return left
+}
+
+// IGD is a fake UPnP Internet Gateway Device.
+type IGD struct {
+	cfg Config
+
+	ssdpConn *net.UDPConn
+	listener net.Listener
+	server   *http.Server
+	baseURL  string
+	wg       sync.WaitGroup
+
+	actions map[string]bool
+
+	lock      sync.Mutex
+	conns     []Connection
+	mappings  []Mapping
+	extIP     net.IP
+	subs      []*Subscription
+	eventReqs []EventRequest
+	nextSID   int
+
+	// notifyChan is the NOTIFY queue, which is closed (and closed set) by
+	// Close.
+	notifyChan chan notification
+	closed     bool
+}
+
+// New starts a fake IGD with the given configuration, with a nil cfg being
+// equivalent to the zero value.
+func New(cfg *Config) (*IGD, error) {
+	d := &IGD{notifyChan: make(chan notification, notifyBacklog)}
+	if cfg != nil {
+		d.cfg = *cfg
+	}
+	if d.cfg.Version == 0 {
+		d.cfg.Version = 1
+	}
+	if len(d.cfg.Connections) == 0 {
+		d.cfg.Connections = []Connection{{ServiceType: d.cfg.ServiceType}}
+	}
+	d.conns = make([]Connection, 0, len(d.cfg.Connections))
+	for _, conn := range d.cfg.Connections {
+		if conn.ServiceType == "" {
+			conn.ServiceType = WANIPConnection
+		}
+		if conn.ServiceType != WANIPConnection && conn.ServiceType != WANPPPConnection {
+			return nil, fmt.Errorf("upnptest: invalid service type: %s", conn.ServiceType)
+		}
+		if conn.WANDevice < 0 {
+			return nil, fmt.Errorf("upnptest: invalid WANDevice: %d", conn.WANDevice)
+		}
+		if conn.Status == "" {
+			conn.Status = StatusConnected
+		}
+		d.conns = append(d.conns, conn)
+	}
+	if d.cfg.DefaultConnection < 0 || d.cfg.DefaultConnection >= len(d.conns) {
+		return nil, fmt.Errorf("upnptest: invalid default connection: %d", d.cfg.DefaultConnection)
+	}
+	actions := d.cfg.Actions
+	if actions == nil {
+		actions = defaultActions(d.cfg.Version)
+	}
+	d.actions = make(map[string]bool)
+	for _, a := range actions {
+		if connActions[a] == nil {
+			return nil, fmt.Errorf("upnptest: unknown action: %s", a)
+		}
+		d.actions[a] = true
+	}
+	if d.cfg.FriendlyName == "" {
+		d.cfg.FriendlyName = "upnptest IGD"
+	}
+	if d.cfg.Manufacturer == "" {
+		d.cfg.Manufacturer = "The Tor Project"
+	}
+	if d.cfg.ModelName == "" {
+		d.cfg.ModelName = "upnptest"
+	}
+	if d.cfg.UDN == "" {
+		d.cfg.UDN = "uuid:00000000-0000-0000-0000-000000000001"
+	}
+	d.extIP = d.cfg.ExternalIP
+	if d.extIP == nil {
+		d.extIP = net.IPv4(192, 0, 2, 1) // TEST-NET-1
+	}
+
+	var err error
+	if d.listener, err = net.Listen("tcp4", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	d.baseURL = "http://" + d.listener.Addr().String()
+	if d.ssdpConn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		d.listener.Close()
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(descPath, d.onDescription)
+	mux.HandleFunc(controlPrefix, d.onControl)
+	mux.HandleFunc(scpdPrefix, d.onSCPD)
+	mux.HandleFunc(eventPrefix, d.onEvent)
+	d.server = &http.Server{Handler: mux}
+
+	d.wg.Add(3)
+	go func() {
+		defer d.wg.Done()
+		d.server.Serve(d.listener)
+	}()
+	go d.ssdpWorker()
+	go d.notifyWorker()
+
+	return d, nil
+}
+
+// SSDPAddr returns the "host:port" of the fake IGD's SSDP responder, for use
+// as upnp.ClientFactory.SSDPAddr.
+func (d *IGD) SSDPAddr() string {
+	return d.ssdpConn.LocalAddr().String()
+}
+
+// Location returns the URL of the fake IGD's device description.
+func (d *IGD) Location() string {
+	return d.baseURL + descPath
+}
+
+// ExternalIP returns the address returned by GetExternalIPAddress.
+func (d *IGD) ExternalIP() net.IP {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.extIP
+}
+
+// SetExternalIP changes the address returned by GetExternalIPAddress, and
+// notifies the event subscribers.
+func (d *IGD) SetExternalIP(ip net.IP) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.extIP = ip
+	d.notifyAllLocked(-1, []soapArg{{"ExternalIPAddress", ip.String()}})
+}
+
+// SetConnectionStatus changes the ConnectionStatus of a connection, and
+// notifies the connection's event subscribers.
+func (d *IGD) SetConnectionStatus(conn int, status string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.conns[conn].Status = status
+	d.notifyAllLocked(conn, []soapArg{{"ConnectionStatus", status}})
+}
+
+// Mappings returns a copy of the current port mapping table.
+func (d *IGD) Mappings() []Mapping {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.expireLocked(time.Now())
+	return append([]Mapping(nil), d.mappings...)
+}
+
+// AddMapping adds an entry to the port mapping table directly, as if another
+// host on the network had created it.
+func (d *IGD) AddMapping(m Mapping) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if m.LeaseDuration > 0 {
+		m.expiresAt = time.Now().Add(time.Duration(m.LeaseDuration) * time.Second)
+	}
+	d.mappings = append(d.mappings, m)
+}
+
+// Close shuts down the fake IGD.
+func (d *IGD) Close() {
+	d.ssdpConn.Close()
+	d.server.Close()
+	d.lock.Lock()
+	d.closed = true
+	close(d.notifyChan)
+	d.lock.Unlock()
+	d.wg.Wait()
+}
+
+func (d *IGD) expireLocked(now time.Time) {
+	live := d.mappings[:0]
+	for _, m := range d.mappings {
+		if m.expiresAt.IsZero() || now.Before(m.expiresAt) {
+			live = append(live, m)
+		}
+	}
+	d.mappings = live
+}
+
+func (d *IGD) findLocked(conn int, remoteHost string, externalPort int, protocol base.Protocol) int {
+	for i, m := range d.mappings {
+		if m.Connection == conn && m.RemoteHost == remoteHost && m.ExternalPort == externalPort && m.Protocol == protocol {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *IGD) deviceURN() string {
+	return fmt.Sprintf("urn:schemas-upnp-org:device:InternetGatewayDevice:%d", d.cfg.Version)
+}
+
+func (d *IGD) serviceURN(conn int) string {
+	return fmt.Sprintf("urn:schemas-upnp-org:service:%s:%d", d.conns[conn].ServiceType, d.cfg.Version)
+}
+
+func (d *IGD) serviceID(conn int) string {
+	if d.conns[conn].ServiceType == WANPPPConnection {
+		return "urn:upnp-org:serviceId:WANPPPConn1"
+	}
+	return "urn:upnp-org:serviceId:WANIPConn1"
+}
+
+func (d *IGD) wanDeviceUDN(wanDev int) string {
+	return fmt.Sprintf("%s-wan%d", d.cfg.UDN, wanDev)
+}
+
+func (d *IGD) wanConnDeviceUDN(conn int) string {
+	return fmt.Sprintf("%s-wanconn%d", d.cfg.UDN, conn)
+}
+
+func (d *IGD) controlPath(conn int) string {
+	return connControlPath + strconv.Itoa(conn)
+}
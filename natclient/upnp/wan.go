@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const connectionStatusConnected = "Connected"
+
+// Routers with more than one uplink (or DSL/fiber boxes that expose a PPP
+// instance per VC/VLAN, most of them unused) will have multiple WANDevices,
+// WANConnectionDevices, and/or connection services.  Mappings created on a
+// connection that is not up are useless, so every connection is considered,
+// and the one that is actually connected is used.
+
+type getDefConnSvcResponse struct {
+	DefaultConnectionService string `xml:"NewDefaultConnectionService"`
+}
+
+type getStatusInfoResponse struct {
+	ConnectionStatus    string `xml:"NewConnectionStatus"`
+	LastConnectionError string `xml:"NewLastConnectionError"`
+	Uptime              int    `xml:"NewUptime"`
+}
+
+// wanConnection is a candidate WAN connection service.
+type wanConnection struct {
+	dev *upnpDevice // WANConnectionDevice
+	svc *upnpService
+	cp  *controlPoint
+}
+
+func (w *wanConnection) is(defConnSvc string) bool {
+	// The default connection service is formatted as the UDN of the
+	// WANConnectionDevice (optionally suffixed by the device type) and the
+	// serviceId, separated by a comma.  Eg:
+	//
+	//  uuid:UDN:WANConnectionDevice:1,urn:upnp-org:serviceId:WANIPConn1
+	idx := strings.LastIndex(defConnSvc, ",")
+	if idx < 0 {
+		return false
+	}
+	udn, serviceID := strings.TrimSpace(defConnSvc[:idx]), strings.TrimSpace(defConnSvc[idx+1:])
+	if serviceID != w.svc.ServiceID {
+		return false
+	}
+	return udn == w.dev.UDN || strings.HasPrefix(udn, w.dev.UDN+":")
+}
+
+func (c *Client) getDefaultConnectionService(ctx context.Context, cp *controlPoint) (string, error) {
+	respBody, err := c.issueSoapRequest(ctx, cp, "GetDefaultConnectionService", "")
+	if err != nil {
+		return "", err
+	}
+	if respBody.GetDefaultConnectionServiceResponse == nil {
+		return "", fmt.Errorf("igd: GetDefaultConnectionService() failed")
+	}
+	return respBody.GetDefaultConnectionServiceResponse.DefaultConnectionService, nil
+}
+
+func (c *Client) getStatusInfo(ctx context.Context, cp *controlPoint) (string, error) {
+	respBody, err := c.issueSoapRequest(ctx, cp, "GetStatusInfo", "")
+	if err != nil {
+		return "", err
+	}
+	if respBody.GetStatusInfoResponse == nil {
+		return "", fmt.Errorf("igd: GetStatusInfo() failed")
+	}
+	return respBody.GetStatusInfoResponse.ConnectionStatus, nil
+}
+
+func (c *Client) findWANConnections(urlBase *url.URL, rootD *upnpDevice) []*wanConnection {
+	// WANIPConnection is the prefered service to use, though a lot of
+	// routers export both, and really old DSL modems only export one.
+	// Check both, with preference towards the new hotness, what we want to
+	// do works with either.
+	okServices := []string{wanIPConnection, wanPPPConnection}
+
+	var conns []*wanConnection
+	for _, wanD := range rootD.findChildren(wanDevice) {
+		for _, wanConnD := range wanD.findChildren(wanConnectionDevice) {
+			for _, svc := range okServices {
+				for _, s := range wanConnD.findServices(svc) {
+					cp, err := newControlPoint(urlBase, s)
+					if err != nil {
+						c.logf(base.LevelWarn, base.OpDiscover, "malformed ControlURL: %s\n", err)
+						continue
+					}
+					c.logf(base.LevelDebug, base.OpDiscover, "found a %s at %s\n", cp.urn.kindType, cp.url)
+					conns = append(conns, &wanConnection{dev: wanConnD, svc: s, cp: cp})
+				}
+			}
+		}
+	}
+	return conns
+}
+
+func (c *Client) selectWANConnection(ctx context.Context, urlBase *url.URL, rootD *upnpDevice) (*wanConnection, error) {
+	conns := c.findWANConnections(urlBase, rootD)
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("device has no compatible upstream services")
+	}
+
+	// Layer3Forwarding knows which connection is used for the default route,
+	// so check that first.  It is optional (and frequently broken), so any
+	// failures here are not fatal.
+	if s := rootD.findService(layer3Forwarding); s != nil {
+		if l3Cp, err := newControlPoint(urlBase, s); err != nil {
+			c.logf(base.LevelWarn, base.OpDiscover, "malformed ControlURL: %s\n", err)
+		} else if defConnSvc, err := c.getDefaultConnectionService(ctx, l3Cp); err != nil {
+			c.logf(base.LevelWarn, base.OpDiscover, "igd: GetDefaultConnectionService failed: %s\n", err)
+		} else {
+			c.logf(base.LevelDebug, base.OpDiscover, "default connection service is %s\n", defConnSvc)
+			for i, w := range conns {
+				if w.is(defConnSvc) {
+					reordered := append([]*wanConnection{w}, conns[:i]...)
+					conns = append(reordered, conns[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	// Use the first connection that is up.  If none are, prefer connections
+	// where the status could not be determined, since some routers do not
+	// implement GetStatusInfo.
+	var unknown *wanConnection
+	for _, w := range conns {
+		status, err := c.getStatusInfo(ctx, w.cp)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			c.logf(base.LevelWarn, base.OpDiscover, "igd: GetStatusInfo failed for %s: %s\n", w.cp.url, err)
+			if unknown == nil {
+				unknown = w
+			}
+			continue
+		}
+		c.logf(base.LevelDebug, base.OpDiscover, "%s at %s is %s\n", w.cp.urn.kindType, w.cp.url, status)
+		if status == connectionStatusConnected {
+			return w, nil
+		}
+	}
+	if unknown != nil {
+		return unknown, nil
+	}
+	c.logf(base.LevelInfo, base.OpDiscover, "no connected upstream services, using %s\n", conns[0].cp.url)
+	return conns[0], nil
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package upnp
+
+import (
+	"strings"
+	"testing"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/upnp/upnptest"
+)
+
+func TestSelectWANConnection(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  upnptest.Config
+		want int
+	}{
+		{
+			// The default connection wins, even if it is not first.
+			name: "default connection",
+			cfg: upnptest.Config{
+				Connections: []upnptest.Connection{
+					{ServiceType: upnptest.WANPPPConnection},
+					{ServiceType: upnptest.WANIPConnection, WANDevice: 1},
+				},
+				DefaultConnection: 1,
+			},
+			want: 1,
+		},
+		{
+			// Without Layer3Forwarding, the first connected one wins.
+			name: "first connected",
+			cfg: upnptest.Config{
+				Connections: []upnptest.Connection{
+					{ServiceType: upnptest.WANPPPConnection, Status: upnptest.StatusDisconnected},
+					{ServiceType: upnptest.WANIPConnection, Status: upnptest.StatusDisconnected},
+					{ServiceType: upnptest.WANPPPConnection, WANDevice: 1},
+				},
+				NoLayer3Forwarding: true,
+			},
+			want: 2,
+		},
+		{
+			// A disconnected default connection loses to a connected one.
+			name: "disconnected default",
+			cfg: upnptest.Config{
+				Connections: []upnptest.Connection{
+					{ServiceType: upnptest.WANIPConnection},
+					{ServiceType: upnptest.WANPPPConnection, Status: upnptest.StatusDisconnected},
+				},
+				DefaultConnection: 1,
+			},
+			want: 0,
+		},
+	} {
+		igd, c := newTestClient(t, &tc.cfg, nil)
+
+		// The mapping must land on the selected connection.
+		if _, err := c.AddPortMapping(testDescr, base.TCP, 9001, 9001, 3600); err != nil {
+			t.Errorf("%s: AddPortMapping() failed: %s", tc.name, err)
+		} else if ms := igd.Mappings(); len(ms) != 1 || ms[0].Connection != tc.want {
+			t.Errorf("%s: router has mappings %+v, want one on connection %d", tc.name, ms, tc.want)
+		}
+		wantType := tc.cfg.Connections[tc.want].ServiceType
+		if r := c.Router(); !strings.Contains(r.ServiceType, ":"+wantType+":") {
+			t.Errorf("%s: Router().ServiceType = %s, want %s", tc.name, r.ServiceType, wantType)
+		}
+		c.Close()
+		igd.Close()
+	}
+}
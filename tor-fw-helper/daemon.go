@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+const (
+	// retryInterval is how long to wait before attempting to re-establish a
+	// mapping that failed to be created or renewed.
+	retryInterval = 60 * time.Second
+
+	// minRenewInterval is the shortest interval between renewals, to avoid
+	// spamming routers that hand out absurdly short leases.
+	minRenewInterval = 1 * time.Second
+)
+
+// lease tracks when a forwarded port or pinhole needs to be renewed.
+type lease struct {
+	protocol base.Protocol
+	pair     portPair
+
+	// pinhole is set if the lease is for an IPv6 pinhole to pair.internal
+	// rather than a port mapping, and uniqueID is the pinhole's UniqueID, 0
+	// if it needs to be (re)opened.
+	pinhole  bool
+	uniqueID int
+
+	// renewAt is the time at which the mapping should be re-requested, zero
+	// if the lease is indefinite.
+	renewAt time.Time
+}
+
+func (l *lease) schedule(m *base.PortMapping, err error) {
+	duration := 0
+	if m != nil {
+		// Stick with the alternate port, if one was mapped.
+		l.pair.external = m.ExternalPort
+		duration = m.LeaseDuration
+	}
+	l.scheduleLease(duration, err)
+}
+
+func (l *lease) schedulePinhole(p *base.Pinhole, err error) {
+	duration := 0
+	if p != nil {
+		l.uniqueID = p.UniqueID
+		duration = p.LeaseDuration
+	}
+	l.scheduleLease(duration, err)
+}
+
+func (l *lease) scheduleLease(duration int, err error) {
+	now := time.Now()
+	switch {
+	case err != nil:
+		l.renewAt = now.Add(retryInterval)
+	case duration == 0:
+		// Indefinite lease, nothing to renew.
+		l.renewAt = time.Time{}
+	default:
+		// Renew at half the granted lifetime, per RFC 6886 Section 3.3.
+		interval := time.Duration(duration) * time.Second / 2
+		if interval < minRenewInterval {
+			interval = minRenewInterval
+		}
+		l.renewAt = now.Add(interval)
+	}
+}
+
+func runDaemon(c base.Client, leases []*lease, addrChan <-chan net.IP) {
+	c.Vlogf("entering daemon mode\n")
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	for {
+		// Find the next lease that requires renewal.
+		var next time.Time
+		for _, l := range leases {
+			if l.renewAt.IsZero() {
+				continue
+			}
+			if next.IsZero() || l.renewAt.Before(next) {
+				next = l.renewAt
+			}
+		}
+
+		// Sleep till either it is time to renew, or a signal is received.  If
+		// all of the leases are indefinite, this just waits for a signal.
+		var timer *time.Timer
+		var timerChan <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timerChan = timer.C
+		}
+		select {
+		case sig := <-sigChan:
+			c.Vlogf("received %s, exiting\n", sig)
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-timerChan:
+		case extAddr, ok := <-addrChan:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				addrChan = nil
+				continue
+			}
+
+			// The external address changed, report the new address in the
+			// same format as --fetch-public-ip, and renew everything
+			// immediately in case the gateway rebooted.
+			if jsonReport != nil {
+				jsonReport.ExternalIP = &externalIPResult{Address: extAddr}
+			} else {
+				fmt.Fprintf(os.Stderr, "tor-fw-helper: ExternalIPAddress = %s\n", extAddr)
+			}
+			for _, l := range leases {
+				l.renewAt = time.Now()
+			}
+		}
+
+		// Renew everything that is due, the results are reported over stdout
+		// in the same format as the initial forwarding.
+		now := time.Now()
+		for _, l := range leases {
+			if l.renewAt.IsZero() || l.renewAt.After(now) {
+				continue
+			}
+			if l.pinhole {
+				renewPinhole(c, l)
+				continue
+			}
+			c.Vlogf("renewing %s mapping %d <-> %d\n", l.protocol, l.pair.internal, l.pair.external)
+			m, err := forwardPort(c, l.protocol, l.pair)
+			l.schedule(m, err)
+		}
+		flushReport()
+	}
+}
+
+func renewPinhole(c base.Client, l *lease) {
+	if l.uniqueID != 0 {
+		c.Vlogf("renewing %s pinhole %d (UniqueID %d)\n", l.protocol, l.pair.internal, l.uniqueID)
+		duration, err := c.RenewIPv6Pinhole(l.uniqueID, mappingDuration)
+		if err == nil {
+			p := &base.Pinhole{
+				UniqueID:      l.uniqueID,
+				InternalPort:  l.pair.internal,
+				Protocol:      l.protocol,
+				LeaseDuration: duration,
+			}
+			reportPinhole(l.protocol, l.pair.internal, p, nil)
+			l.schedulePinhole(p, nil)
+			return
+		}
+
+		// The pinhole most likely expired or the router rebooted, so open
+		// a new one.
+		c.Vlogf("RenewIPv6Pinhole() failed: %s\n", err)
+		l.uniqueID = 0
+	}
+	c.Vlogf("opening %s pinhole %d\n", l.protocol, l.pair.internal)
+	p, err := openPinhole(c, l.protocol, l.pair.internal)
+	l.schedulePinhole(p, err)
+}
@@ -12,13 +12,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.torproject.org/tor-fw-helper.git/natclient"
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+	"git.torproject.org/tor-fw-helper.git/natclient/cache"
+	"git.torproject.org/tor-fw-helper.git/natclient/journal"
+	"git.torproject.org/tor-fw-helper.git/natclient/natpmp"
 )
 
 const (
@@ -30,6 +37,10 @@ const (
 	mappingDuration = 0
 
 	versionString = "0.3"
+
+	// testLogFile is where --test-commandline logs the arguments, relative
+	// to the current working directory.
+	testLogFile = "tor-fw-helper.log"
 )
 
 type portPair struct {
@@ -74,6 +85,150 @@ func (l *forwardList) Set(value string) error {
 	return nil
 }
 
+type pinhole struct {
+	protocol base.Protocol
+	port     int
+}
+
+type pinholeList []pinhole
+
+func (l *pinholeList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *pinholeList) Set(value string) error {
+	protocol, port, err := parsePortProtocol(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, pinhole{protocol, port})
+	return nil
+}
+
+// queryList is the list of external ports to query, which is parsed exactly
+// like the list of pinholes.
+type queryList []pinhole
+
+func (l *queryList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *queryList) Set(value string) error {
+	protocol, port, err := parsePortProtocol(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, pinhole{protocol, port})
+	return nil
+}
+
+// uniqueIDList is the list of pinhole UniqueIDs to close.
+type uniqueIDList []int
+
+func (l *uniqueIDList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *uniqueIDList) Set(value string) error {
+	tmp, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, int(tmp))
+	return nil
+}
+
+// parsePortProtocol parses "<port>[/tcp|/udp]".
+func parsePortProtocol(value string) (base.Protocol, int, error) {
+	protocol := base.TCP
+
+	// The protocol is optional, and defaults to TCP.
+	split := strings.Split(value, "/")
+	switch len(split) {
+	case 1:
+	case 2:
+		var err error
+		if protocol, err = base.ParseProtocol(split[1]); err != nil {
+			return 0, 0, err
+		}
+	default:
+		return 0, 0, fmt.Errorf("failed to parse '%s'", value)
+	}
+	tmp, err := strconv.ParseUint(split[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return protocol, int(tmp), nil
+}
+
+type ipFlag struct {
+	ip net.IP
+}
+
+func (f *ipFlag) String() string {
+	if f.ip == nil {
+		return ""
+	}
+	return f.ip.String()
+}
+
+func (f *ipFlag) Set(value string) error {
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid IPv4 address '%s'", value)
+	}
+	f.ip = ip
+	return nil
+}
+
+type portRangeFlag struct {
+	r   base.PortRange
+	set bool
+}
+
+func (f *portRangeFlag) String() string {
+	if !f.set {
+		return ""
+	}
+	return f.r.String()
+}
+
+func (f *portRangeFlag) Set(value string) error {
+	split := strings.Split(value, "-")
+	if len(split) != 2 {
+		return fmt.Errorf("failed to parse '%s'", value)
+	}
+	min, err := strconv.ParseUint(split[0], 10, 16)
+	if err != nil {
+		return err
+	}
+	max, err := strconv.ParseUint(split[1], 10, 16)
+	if err != nil {
+		return err
+	}
+	if min == 0 || min > max {
+		return fmt.Errorf("invalid port range '%s'", value)
+	}
+	f.r = base.PortRange{Min: int(min), Max: int(max)}
+	f.set = true
+	return nil
+}
+
+func formatPortMapping(m *base.PortMapping) string {
+	remoteHost := "0.0.0.0"
+	if m.RemoteHost != nil {
+		remoteHost = m.RemoteHost.String()
+	}
+	return fmt.Sprintf("'%s' %s:%d <-> %s:%d %s (%d sec)",
+		m.Description,
+		m.InternalIP,
+		m.InternalPort,
+		remoteHost,
+		m.ExternalPort,
+		m.Protocol,
+		m.LeaseDuration)
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "%s usage:\n"+
 		" [-h|--help]\n"+
@@ -82,20 +237,283 @@ func usage() {
 		" [-g|--fetch-public-ip]\n"+
 		" [-p|--forward-port ([<external port>]:<internal port>)]\n"+
 		" [-d|--unforward-port ([<external port>]:<internal port>]\n"+
+		" [--forward-udp-port ([<external port>]:<internal port>)]\n"+
+		" [--unforward-udp-port ([<external port>]:<internal port>)]\n"+
+		" [--open-ipv6-pinhole <internal port>[/tcp|/udp]]\n"+
+		" [--close-ipv6-pinhole <unique id>]\n"+
+		" [--query-port <external port>[/tcp|/udp]]\n"+
+		" [--allow-alternate-port]\n"+
+		" [--alternate-port-range <min port>-<max port>]\n"+
+		" [--unforward-journaled]\n"+
 		" [-l|--list-ports]\n"+
-		" [--protocol NAT-PMP,UPnP]\n", os.Args[0])
+		" [--journal <path>]\n"+
+		" [--discovery-cache <path>]\n"+
+		" [--daemon]\n"+
+		" [--protocol NAT-PMP,PCP,UPnP]\n"+
+		" [--output text|json]\n"+
+		" [--description <mapping description>]\n"+
+		" [--user-agent <UPnP User-Agent>]\n"+
+		" [--outgoing-port <UPnP SSDP source port>]\n"+
+		" [--ssdp-mx <seconds>]\n"+
+		" [--retries <count>]\n"+
+		" [--request-timeout <duration>]\n"+
+		" [--retry-timeout <duration>]\n"+
+		" [--interface <name>]\n"+
+		" [--source-address <IPv4 address>]\n", os.Args[0])
 	os.Exit(1)
 }
 
+// ctime returns t formatted like ctime(3), including the trailing newline.
+func ctime(t time.Time) string {
+	return t.Format(time.ANSIC) + "\n"
+}
+
+func logCommandlineOptions(args []string) error {
+	// This matches the C helper's output byte for byte, including the blank
+	// lines that result from ctime() including a trailing newline.
+	f, err := os.OpenFile(testLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(f, "START: %s\n", ctime(time.Now())); err != nil {
+		f.Close()
+		return err
+	}
+	for i, arg := range args {
+		if _, err = fmt.Fprintf(f, "ARG: %d: %s\n", i, arg); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err = fmt.Fprintf(os.Stderr, "ARG: %d: %s\n", i, arg); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err = fmt.Fprintf(f, "END: %s\n", ctime(time.Now())); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func protocolTag(protocol base.Protocol) string {
+	return strings.ToLower(protocol.String())
+}
+
+func dumpForwardList(title string, l forwardList) {
+	if len(l) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "V: %s:\n", title)
+	for _, ent := range l {
+		fmt.Fprintf(os.Stderr, "V: External %v, Internal: %v\n",
+			ent.external, ent.internal)
+	}
+}
+
+func forwardPort(c base.Client, protocol base.Protocol, pair portPair) (*base.PortMapping, error) {
+	// The response is delivered over stdout in a predefined format, with
+	// the external port that was actually mapped, which can differ from the
+	// requested one with --allow-alternate-port.
+	tag := protocolTag(protocol)
+	// The description is left to the client, which uses --description.
+	m, err := c.AddPortMapping("", protocol, pair.internal, pair.external, mappingDuration)
+	if err != nil {
+		c.Vlogf("AddPortMapping() failed: %s\n", err)
+	} else {
+		c.Vlogf("AddPortMapping() succeded\n")
+	}
+	externalPort := pair.external
+	if m != nil {
+		externalPort = m.ExternalPort
+	}
+	if jsonReport != nil {
+		r := newPortResult(protocol, pair.internal, externalPort, err)
+		if externalPort != pair.external {
+			r.RequestedExternalPort = pair.external
+		}
+		if m != nil {
+			r.Mapping = m
+		}
+		jsonReport.Forward = append(jsonReport.Forward, r)
+		return m, err
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "tor-fw-helper %s-forward %d %d FAIL\n", tag, externalPort, pair.internal)
+	} else {
+		fmt.Fprintf(os.Stdout, "tor-fw-helper %s-forward %d %d SUCCESS\n", tag, externalPort, pair.internal)
+	}
+	os.Stdout.Sync()
+	return m, err
+}
+
+func forwardPorts(c base.Client, protocol base.Protocol, l forwardList) []*lease {
+	// Forward some ports, and keep track of the leases for daemon mode.
+	leases := make([]*lease, 0, len(l))
+	for _, pair := range l {
+		m, err := forwardPort(c, protocol, pair)
+		ls := &lease{protocol: protocol, pair: pair}
+		ls.schedule(m, err)
+		leases = append(leases, ls)
+	}
+	return leases
+}
+
+func unforwardPorts(c base.Client, protocol base.Protocol, l forwardList) {
+	// Unforward some ports, the response is delivered over stdout in a
+	// predefined format similar to forwarding.
+	tag := protocolTag(protocol)
+	for _, pair := range l {
+		err := c.DeletePortMapping(protocol, pair.internal, pair.external)
+		if err != nil {
+			c.Vlogf("DeletePortMapping() failed: %s\n", err)
+		} else {
+			c.Vlogf("DeletePortMapping() succeded\n")
+		}
+		if jsonReport != nil {
+			jsonReport.Unforward = append(jsonReport.Unforward, newPortResult(protocol, pair.internal, pair.external, err))
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "tor-fw-helper %s-unforward %d %d FAIL\n", tag, pair.external, pair.internal)
+		} else {
+			fmt.Fprintf(os.Stdout, "tor-fw-helper %s-unforward %d %d SUCCESS\n", tag, pair.external, pair.internal)
+		}
+		os.Stdout.Sync()
+	}
+}
+
+func openPinhole(c base.Client, protocol base.Protocol, port int) (*base.Pinhole, error) {
+	p, err := c.OpenIPv6Pinhole(protocol, port, mappingDuration)
+	if err != nil {
+		c.Vlogf("OpenIPv6Pinhole() failed: %s\n", err)
+	} else {
+		c.Vlogf("OpenIPv6Pinhole() succeded\n")
+	}
+	reportPinhole(protocol, port, p, err)
+	return p, err
+}
+
+func reportPinhole(protocol base.Protocol, port int, p *base.Pinhole, err error) {
+	// The response is delivered over stdout in a format similar to
+	// forwarding, followed by the UniqueID needed to close the pinhole.
+	if jsonReport != nil {
+		r := newPortResult(protocol, port, 0, err)
+		r.Pinhole = p
+		jsonReport.IPv6Pinholes = append(jsonReport.IPv6Pinholes, r)
+		return
+	}
+	tag := protocolTag(protocol)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "tor-fw-helper %s-ipv6-pinhole %d FAIL\n", tag, port)
+	} else {
+		fmt.Fprintf(os.Stdout, "tor-fw-helper %s-ipv6-pinhole %d SUCCESS %d\n", tag, port, p.UniqueID)
+	}
+	os.Stdout.Sync()
+}
+
+func openPinholes(c base.Client, l pinholeList) []*lease {
+	// Open IPv6 pinholes, and keep track of the leases for daemon mode.
+	leases := make([]*lease, 0, len(l))
+	for _, ph := range l {
+		p, err := openPinhole(c, ph.protocol, ph.port)
+		ls := &lease{protocol: ph.protocol, pair: portPair{internal: ph.port}, pinhole: true}
+		ls.schedulePinhole(p, err)
+		leases = append(leases, ls)
+	}
+	return leases
+}
+
+func closePinholes(c base.Client, l []int) {
+	// Close IPv6 pinholes, the response is delivered over stdout in a format
+	// similar to unforwarding.
+	for _, id := range l {
+		err := c.CloseIPv6Pinhole(id)
+		if err != nil {
+			c.Vlogf("CloseIPv6Pinhole() failed: %s\n", err)
+		} else {
+			c.Vlogf("CloseIPv6Pinhole() succeded\n")
+		}
+		if jsonReport != nil {
+			r := &pinholeCloseResult{UniqueID: id, Success: err == nil}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			jsonReport.ClosePinholes = append(jsonReport.ClosePinholes, r)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "tor-fw-helper ipv6-pinhole-close %d FAIL\n", id)
+		} else {
+			fmt.Fprintf(os.Stdout, "tor-fw-helper ipv6-pinhole-close %d SUCCESS\n", id)
+		}
+		os.Stdout.Sync()
+	}
+}
+
+func queryPorts(c base.Client, l queryList) {
+	// Query some external ports, the response is delivered over stdout in a
+	// format similar to forwarding, followed by the mapping if one was
+	// found.
+	for _, q := range l {
+		tag := protocolTag(q.protocol)
+		m, err := c.GetPortMapping(q.protocol, q.port)
+		if err != nil {
+			c.Vlogf("GetPortMapping() failed: %s\n", err)
+		} else {
+			c.Vlogf("GetPortMapping() succeded\n")
+		}
+		notFound := errors.Is(err, base.CategoryNotFound)
+		if jsonReport != nil {
+			r := &queryResult{Protocol: q.protocol, ExternalPort: q.port, Found: m != nil}
+			switch {
+			case m != nil:
+				r.Mapping = m
+			case !notFound:
+				r.Error = err.Error()
+			}
+			jsonReport.QueryPorts = append(jsonReport.QueryPorts, r)
+			continue
+		}
+		switch {
+		case m != nil:
+			enabled := "enabled"
+			if !m.Enabled {
+				enabled = "disabled"
+			}
+			fmt.Fprintf(os.Stdout, "tor-fw-helper %s-query-port %d SUCCESS %s %d %s %d %s\n", tag, q.port, m.InternalIP, m.InternalPort, enabled, m.LeaseDuration, strconv.Quote(m.Description))
+		case notFound:
+			fmt.Fprintf(os.Stdout, "tor-fw-helper %s-query-port %d NOT-FOUND\n", tag, q.port)
+		default:
+			fmt.Fprintf(os.Stdout, "tor-fw-helper %s-query-port %d FAIL\n", tag, q.port)
+		}
+		os.Stdout.Sync()
+	}
+}
+
 func main() {
 	doHelp := false
 	doTest := false
 	isVerbose := false
 	doFetchIP := false
 	doList := false
+	doUnforwardJournaled := false
+	doDaemon := false
+	journalPath, _ := journal.DefaultPath()
+	cachePath, _ := cache.DefaultPath()
 	var portsToForward forwardList
 	var portsToUnforward forwardList
+	var udpPortsToForward forwardList
+	var udpPortsToUnforward forwardList
+	var pinholesToOpen pinholeList
+	var pinholesToClose uniqueIDList
+	var portsToQuery queryList
 	protocol := ""
+	outputFormat := outputText
+	opts := &base.Options{Description: mappingDescr}
+	var sourceAddr ipFlag
+	var alternatePortRange portRangeFlag
 
 	// So, the flag package kind of sucks and doesn't gracefully support the
 	// concept of aliased flags when printing usage, which results in a
@@ -113,11 +531,40 @@ func main() {
 	flag.BoolVar(&doList, "list-ports", false, "")
 	flag.BoolVar(&doList, "l", false, "")
 	flag.StringVar(&protocol, "protocol", "", "")
+	flag.StringVar(&outputFormat, "output", outputText, "")
 	flag.Var(&portsToForward, "forward-port", "")
 	flag.Var(&portsToForward, "p", "")
 	flag.Var(&portsToUnforward, "unforward-port", "")
 	flag.Var(&portsToUnforward, "d", "")
+	flag.Var(&udpPortsToForward, "forward-udp-port", "")
+	flag.Var(&udpPortsToUnforward, "unforward-udp-port", "")
+	flag.Var(&pinholesToOpen, "open-ipv6-pinhole", "")
+	flag.Var(&pinholesToClose, "close-ipv6-pinhole", "")
+	flag.Var(&portsToQuery, "query-port", "")
+	flag.BoolVar(&doUnforwardJournaled, "unforward-journaled", false, "")
+	flag.BoolVar(&opts.AlternatePort, "allow-alternate-port", false, "")
+	flag.Var(&alternatePortRange, "alternate-port-range", "")
+	flag.BoolVar(&doDaemon, "daemon", false, "")
+	flag.StringVar(&journalPath, "journal", journalPath, "")
+	flag.StringVar(&cachePath, "discovery-cache", cachePath, "")
+	flag.StringVar(&opts.Description, "description", opts.Description, "")
+	flag.StringVar(&opts.UserAgent, "user-agent", "", "")
+	flag.IntVar(&opts.OutgoingPort, "outgoing-port", 0, "")
+	flag.IntVar(&opts.SSDPMX, "ssdp-mx", 0, "")
+	flag.IntVar(&opts.Retries, "retries", 0, "")
+	flag.DurationVar(&opts.RequestTimeout, "request-timeout", 0, "")
+	flag.DurationVar(&opts.RetryTimeout, "retry-timeout", 0, "")
+	flag.StringVar(&opts.Interface, "interface", "", "")
+	flag.Var(&sourceAddr, "source-address", "")
 	flag.Parse()
+	opts.Verbose = isVerbose
+	opts.SourceAddress = sourceAddr.ip
+	if alternatePortRange.set {
+		// A range is pointless without alternate ports, so it implies
+		// --allow-alternate-port.
+		opts.AlternatePort = true
+		opts.AlternatePortRange = alternatePortRange.r
+	}
 
 	// Extra flag related handling.
 	if doHelp || flag.NArg() > 0 {
@@ -131,96 +578,182 @@ func main() {
 			"list_ports = %v, protocol = '%s'\n",
 			versionString, isVerbose, doHelp, doFetchIP, doList, protocol)
 
-		if len(portsToForward) > 0 {
-			fmt.Fprintf(os.Stderr, "V: TCP forwarding:\n")
-			for _, ent := range portsToForward {
-				fmt.Fprintf(os.Stderr, "V: External %v, Internal: %v\n",
-					ent.external, ent.internal)
+		dumpForwardList("TCP forwarding", portsToForward)
+		dumpForwardList("Remove TCP forwarding", portsToUnforward)
+		dumpForwardList("UDP forwarding", udpPortsToForward)
+		dumpForwardList("Remove UDP forwarding", udpPortsToUnforward)
+		if len(pinholesToOpen) > 0 {
+			fmt.Fprintf(os.Stderr, "V: IPv6 pinholes:\n")
+			for _, ph := range pinholesToOpen {
+				fmt.Fprintf(os.Stderr, "V: Internal: %v/%s\n", ph.port, ph.protocol)
 			}
 		}
-		if len(portsToUnforward) > 0 {
-			fmt.Fprintf(os.Stderr, "V: Remove TCP forwarding:\n")
-			for _, ent := range portsToUnforward {
-				fmt.Fprintf(os.Stderr, "V: External %v, Internal: %v\n",
-					ent.external, ent.internal)
+		if len(pinholesToClose) > 0 {
+			fmt.Fprintf(os.Stderr, "V: Close IPv6 pinholes:\n")
+			for _, id := range pinholesToClose {
+				fmt.Fprintf(os.Stderr, "V: UniqueID: %v\n", id)
+			}
+		}
+		if len(portsToQuery) > 0 {
+			fmt.Fprintf(os.Stderr, "V: Port queries:\n")
+			for _, q := range portsToQuery {
+				fmt.Fprintf(os.Stderr, "V: External: %v/%s\n", q.port, q.protocol)
 			}
 		}
 	}
 	if doTest {
 		// If the app is being called in test mode, dump the command line
-		// arguments to a file.
-		//
-		// TODO: I have no idea why this exists, I'll add this later.
-		fmt.Fprintf(os.Stderr, "E: --test-commandline not implemented yet\n")
-		os.Exit(1)
+		// arguments to a file, and exit without touching the network.
+		if err := logCommandlineOptions(os.Args); err != nil {
+			fmt.Fprintf(os.Stderr, "E: Failed to log the command line options: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-	if len(portsToForward) == 0 && !doFetchIP && !doList && len(portsToUnforward) == 0 {
+	if len(portsToForward) == 0 && !doFetchIP && !doList && len(portsToUnforward) == 0 &&
+		len(udpPortsToForward) == 0 && len(udpPortsToUnforward) == 0 && len(pinholesToOpen) == 0 &&
+		len(pinholesToClose) == 0 && len(portsToQuery) == 0 && !doUnforwardJournaled {
 		// Nothing to do, sad panda.
 		fmt.Fprintf(os.Stderr, "E: We require a port to be forwarded/unforwarded, "+
 			"fetch_public_ip request, or list_ports!\n")
 		os.Exit(1)
 	}
+	switch outputFormat {
+	case outputText:
+	case outputJSON:
+		jsonReport = &report{}
+	default:
+		fmt.Fprintf(os.Stderr, "E: Unknown output format: %s\n", outputFormat)
+		os.Exit(1)
+	}
+
+	// Open the mapping journal.  The helper is perfectly usable without one,
+	// so failure to do so is not fatal.
+	var j *journal.Journal
+	if journalPath != "" {
+		var err error
+		if j, err = journal.Open(journalPath); err != nil && isVerbose {
+			fmt.Fprintf(os.Stderr, "V: Failed to open journal: %s\n", err)
+		}
+	}
+	if doUnforwardJournaled && j == nil {
+		fatalf("--unforward-journaled requires a journal")
+	}
+
+	// Open the discovery cache.  Like the journal, it is purely an
+	// optimization, so failure to do so is not fatal.
+	if cachePath != "" {
+		if dc, err := cache.Open(cachePath, opts); err == nil {
+			opts.Cache = dc
+		} else if isVerbose {
+			fmt.Fprintf(os.Stderr, "V: Failed to open discovery cache: %s\n", err)
+		}
+	}
 
 	// Discover/Initialize a compatible NAT traversal method.
-	c, err := natclient.New(protocol, isVerbose)
+	var c base.Client
+	var jc *natclient.JournaledClient
+	var err error
+	if j != nil {
+		jc, err = natclient.NewJournaled(protocol, opts, j)
+		if err == nil {
+			c = jc
+		}
+	} else {
+		c, err = natclient.New(protocol, opts)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "E: %s\n", err)
-		os.Exit(1)
+		fatalf("%s", err)
 	}
 	defer c.Close()
-
-	// Forward some ports, the response is delivered over stdout in a
-	// predefined format.
-	for _, pair := range portsToForward {
-		err = c.AddPortMapping(mappingDescr, pair.internal, pair.external, mappingDuration)
-		if err != nil {
-			c.Vlogf("AddPortMapping() failed: %s\n", err)
-			fmt.Fprintf(os.Stdout, "tor-fw-helper tcp-forward %d %d FAIL\n", pair.external, pair.internal)
-		} else {
-			c.Vlogf("AddPortMapping() succeded\n")
-			fmt.Fprintf(os.Stdout, "tor-fw-helper tcp-forward %d %d SUCCESS\n", pair.external, pair.internal)
-		}
-		os.Stdout.Sync()
+	if jsonReport != nil {
+		jsonReport.Router = c.Router()
+		jsonReport.Backend = jsonReport.Router.Backend
 	}
 
-	// Unforward some ports, the response is delivered over stdout in a
-	// predefined format similar to forwarding.
-	for _, pair := range portsToUnforward {
-		err := c.DeletePortMapping(pair.internal, pair.external)
-		if err != nil {
-			c.Vlogf("DeletePortMapping() failed: %s\n", err)
-			fmt.Fprintf(os.Stdout, "tor-fw-helper tcp-unforward %d %d FAIL\n", pair.external, pair.internal)
-		} else {
-			c.Vlogf("DeletePortMapping() succeded\n")
-			fmt.Fprintf(os.Stdout, "tor-fw-helper tcp-unforward %d %d SUCCESS\n", pair.external, pair.internal)
+	// Remove the mappings that were previously created by the helper, as
+	// opposed to all of them.
+	if doUnforwardJournaled {
+		var tcpPorts, udpPorts forwardList
+		for _, e := range jc.JournaledPortMappings() {
+			pair := portPair{internal: e.InternalPort, external: e.ExternalPort}
+			if e.Protocol == base.UDP {
+				udpPorts = append(udpPorts, pair)
+			} else {
+				tcpPorts = append(tcpPorts, pair)
+			}
 		}
-		os.Stdout.Sync()
+		unforwardPorts(c, base.TCP, tcpPorts)
+		unforwardPorts(c, base.UDP, udpPorts)
 	}
 
+	// Forward and unforward the requested ports.
+	leases := forwardPorts(c, base.TCP, portsToForward)
+	leases = append(leases, forwardPorts(c, base.UDP, udpPortsToForward)...)
+	unforwardPorts(c, base.TCP, portsToUnforward)
+	unforwardPorts(c, base.UDP, udpPortsToUnforward)
+	leases = append(leases, openPinholes(c, pinholesToOpen)...)
+	closePinholes(c, pinholesToClose)
+	queryPorts(c, portsToQuery)
+
 	// Get the external IP.
 	if doFetchIP {
 		ip, err := c.GetExternalIPAddress()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "E: Failed to query the external IP address: %s\n", err)
-			os.Exit(1)
+			if jsonReport != nil {
+				jsonReport.ExternalIP = &externalIPResult{Error: err.Error()}
+			}
+			fatalf("Failed to query the external IP address: %s", err)
+		}
+		if jsonReport != nil {
+			jsonReport.ExternalIP = &externalIPResult{Address: ip}
+		} else {
+			fmt.Fprintf(os.Stderr, "tor-fw-helper: ExternalIPAddress = %s\n", ip)
 		}
-		fmt.Fprintf(os.Stderr, "tor-fw-helper: ExternalIPAddress = %s\n", ip)
 	}
 
 	// List the current mappings.
 	if doList {
 		ents, err := c.GetListOfPortMappings()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "E: Failed to query the list of mappings: %s\n", err)
-			os.Exit(1)
+			if jsonReport != nil {
+				jsonReport.List = &mappingListResult{Mappings: []base.PortMapping{}, Error: err.Error()}
+			}
+			fatalf("Failed to query the list of mappings: %s", err)
 		}
-		fmt.Fprintf(os.Stderr, "tor-fw-helper: Current port forwarding mappings:\n")
-		if len(ents) == 0 {
-			fmt.Fprintf(os.Stderr, "tor-fw-helper:  No entries found.\n")
+		if jsonReport != nil {
+			if ents == nil {
+				// Always emit a list, even if it is empty.
+				ents = []base.PortMapping{}
+			}
+			jsonReport.List = &mappingListResult{Mappings: ents}
 		} else {
-			for _, ent := range ents {
-				fmt.Fprintf(os.Stderr, "tor-fw-helper:  %s\n", ent)
+			fmt.Fprintf(os.Stderr, "tor-fw-helper: Current port forwarding mappings:\n")
+			if len(ents) == 0 {
+				fmt.Fprintf(os.Stderr, "tor-fw-helper:  No entries found.\n")
+			} else {
+				for _, ent := range ents {
+					fmt.Fprintf(os.Stderr, "tor-fw-helper:  %s\n", formatPortMapping(&ent))
+				}
+			}
+		}
+	}
+	flushReport()
+
+	// Keep the mappings alive till we are told to exit.
+	if doDaemon {
+		// NAT-PMP gateways announce external address changes, which is
+		// worth reporting, and is a good hint that the mappings were lost.
+		var addrChan <-chan net.IP
+		raw := c
+		if jc != nil {
+			raw = jc.Client
+		}
+		if nc, ok := raw.(*natpmp.Client); ok {
+			if addrChan, err = nc.ListenForAnnouncements(); err != nil {
+				c.Vlogf("ListenForAnnouncements() failed: %s\n", err)
 			}
 		}
+		runDaemon(c, leases, addrChan)
 	}
 }
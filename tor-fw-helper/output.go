@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2014, The Tor Project, Inc.
+ * See LICENSE for licensing information
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"git.torproject.org/tor-fw-helper.git/natclient/base"
+)
+
+// The "--output json" mode replaces the "tor-fw-helper ..." lines on stdout
+// and stderr with a single JSON document on stdout, so that scripts do not
+// need to scrape text that is meant for humans.  Diagnostics still go to
+// stderr as usual.  In daemon mode, a further document is written per line
+// each time a lease is renewed, or the external address changes.
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// portResult is the outcome of forwarding, unforwarding, or opening a pinhole
+// for a port.
+type portResult struct {
+	Protocol     base.Protocol `json:"protocol"`
+	InternalPort int           `json:"internal_port"`
+	ExternalPort int           `json:"external_port,omitempty"`
+	Success      bool          `json:"success"`
+	Error        string        `json:"error,omitempty"`
+
+	// RequestedExternalPort is the external port that was requested, when
+	// an alternate port was mapped in its place.
+	RequestedExternalPort int `json:"requested_external_port,omitempty"`
+
+	// Mapping is the mapping that the router created, when forwarding.
+	Mapping *base.PortMapping `json:"mapping,omitempty"`
+
+	// Pinhole is the pinhole that the router opened, when opening a pinhole.
+	Pinhole *base.Pinhole `json:"pinhole,omitempty"`
+}
+
+// queryResult is the outcome of querying an external port.  Error is only set
+// if the query itself failed, and not if there simply is no such mapping.
+type queryResult struct {
+	Protocol     base.Protocol     `json:"protocol"`
+	ExternalPort int               `json:"external_port"`
+	Found        bool              `json:"found"`
+	Mapping      *base.PortMapping `json:"mapping,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// pinholeCloseResult is the outcome of closing a pinhole.
+type pinholeCloseResult struct {
+	UniqueID int    `json:"unique_id"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+type externalIPResult struct {
+	Address net.IP `json:"address,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type mappingListResult struct {
+	Mappings []base.PortMapping `json:"mappings"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// report is the JSON document.  Each section is only present if the
+// corresponding operation was requested.
+type report struct {
+	Backend       string                `json:"backend,omitempty"`
+	Router        *base.Router          `json:"router,omitempty"`
+	Forward       []*portResult         `json:"forward,omitempty"`
+	Unforward     []*portResult         `json:"unforward,omitempty"`
+	IPv6Pinholes  []*portResult         `json:"ipv6_pinholes,omitempty"`
+	ClosePinholes []*pinholeCloseResult `json:"close_ipv6_pinholes,omitempty"`
+	QueryPorts    []*queryResult        `json:"query_ports,omitempty"`
+	ExternalIP    *externalIPResult     `json:"external_ip,omitempty"`
+	List          *mappingListResult    `json:"list,omitempty"`
+
+	// Error is set if the helper failed outright (Eg: no compatible
+	// backend was found).
+	Error string `json:"error,omitempty"`
+}
+
+// jsonReport is the report being built, nil unless "--output json" was
+// specified.
+var jsonReport *report
+
+func newPortResult(protocol base.Protocol, internalPort, externalPort int, err error) *portResult {
+	r := &portResult{
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: externalPort,
+		Success:      err == nil,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func (r *report) empty() bool {
+	return r.Backend == "" && r.Router == nil && len(r.Forward) == 0 && len(r.Unforward) == 0 &&
+		len(r.IPv6Pinholes) == 0 && len(r.ClosePinholes) == 0 && len(r.QueryPorts) == 0 && r.ExternalIP == nil && r.List == nil && r.Error == ""
+}
+
+// flushReport writes the report to stdout, and starts a new one for anything
+// that happens afterwards.  Empty reports are not written.
+func flushReport() {
+	if jsonReport == nil || jsonReport.empty() {
+		return
+	}
+	b, err := json.Marshal(jsonReport)
+	if err != nil {
+		// This should never happen, and the report can not be used to say
+		// that it did, so this is the same as fatalf without the report.
+		fmt.Fprintf(os.Stderr, "E: failed to marshal the report: %s\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(append(b, '\n'))
+	os.Stdout.Sync()
+	jsonReport = &report{}
+}
+
+// fatalf reports a fatal error to stderr (and in the report), and exits.
+func fatalf(f string, a ...interface{}) {
+	msg := fmt.Sprintf(f, a...)
+	fmt.Fprintf(os.Stderr, "E: %s\n", msg)
+	if jsonReport != nil {
+		jsonReport.Error = msg
+		flushReport()
+	}
+	os.Exit(1)
+}